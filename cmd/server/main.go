@@ -29,6 +29,10 @@ type application struct {
 	templateCache map[string]*template.Template
 	repo          *repositories.DBRepository
 	csvService    *services.CSVService
+	uploads       *services.UploadStore
+	importer      *services.ImportService
+	jobs          *services.JobQueue
+	auth          *services.AuthService
 	handlers      *handlers.AppHandlers
 }
 
@@ -52,15 +56,50 @@ func main() {
 	}
 	appLogger.Info("Template cache built.")
 
+	csvService := services.NewCSVService(services.InferenceOptions{
+		SampleRows: cfg.Inference.SampleRows,
+		Sampling:   cfg.Inference.Sampling,
+	})
+
 	app := &application{
 		config:        cfg,
 		logger:        appLogger,
 		templateCache: templateCache,
 		repo:          repo,
-		csvService:    services.NewCSVService(),
+		csvService:    csvService,
+		uploads:       services.NewUploadStore(appLogger, cfg.Uploads.TTL),
 	}
+	app.importer = services.NewImportService(appLogger, app.csvService, app.repo, services.SchemaOptions{Default: cfg.DB.DefaultSchema, Allowed: cfg.DB.AllowedSchemas})
+	app.jobs = services.NewJobQueue(appLogger, app.importer, app.uploads, services.JobOptions{
+		Workers:   cfg.Jobs.Workers,
+		QueueSize: cfg.Jobs.QueueSize,
+		TTL:       cfg.Uploads.TTL,
+	})
+	app.auth = services.NewAuthService(appLogger, app.repo, services.AuthOptions{
+		Mode:           cfg.Auth.Mode,
+		SessionTTL:     cfg.Auth.SessionTTL,
+		CookieSecure:   cfg.Auth.CookieSecure,
+		ProxyHeader:    cfg.Auth.ProxyHeader,
+		TrustedProxies: cfg.Auth.TrustedProxies,
+		DefaultRoles:   cfg.Auth.DefaultRoles,
+	})
+	app.bootstrapAuth()
 	// Pass 'app' as the Renderer to AppHandlers
-	app.handlers = handlers.NewAppHandlers(appLogger, app.csvService, app.repo, app)
+	app.handlers = handlers.NewAppHandlers(appLogger, app.csvService, app.uploads, app.importer, app.jobs, app.auth, app.repo, app)
+
+	// Background cleanup of expired uploads and backup tables, stopped on shutdown
+	janitorCtx, stopJanitor := context.WithCancel(context.Background())
+	defer stopJanitor()
+	go app.uploads.RunJanitor(janitorCtx, cfg.Uploads.JanitorInterval)
+	go app.importer.RunBackupJanitor(janitorCtx, cfg.Backups.Retention, cfg.Backups.JanitorInterval)
+
+	// Import job workers, whose running imports are cancelled and rolled back on shutdown
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobsDone := make(chan struct{})
+	go func() {
+		defer close(jobsDone)
+		app.jobs.Run(jobsCtx, cfg.Uploads.JanitorInterval)
+	}()
 
 	// Setup static file server with fs.Sub
 	handler, err := app.routes()
@@ -99,6 +138,39 @@ func main() {
 		appLogger.Errorf("Server failed to start or unexpectedly closed: %v", err)
 		os.Exit(1)
 	}
+
+	stopJobs()
+	<-jobsDone
+}
+
+// bootstrapAuth creates the configured first user in local authentication mode, and warns when nobody could sign in
+func (app *application) bootstrapAuth() {
+	switch app.auth.Mode() {
+	case services.AuthNone:
+		app.logger.Info("Authentication is disabled (AUTH_MODE=none); everyone who can reach the server can import.")
+		return
+	case services.AuthProxy:
+		app.logger.Infof("Users are signed in by the reverse proxy through the %s header.", app.config.Auth.ProxyHeader)
+		if len(app.config.Auth.DefaultRoles) == 0 {
+			app.logger.Info("AUTH_DEFAULT_ROLES is empty, so new users cannot import until they are given a role.")
+		}
+		return
+	}
+
+	ctx := context.Background()
+	if app.config.Auth.BootstrapUser != "" {
+		created, appErr := app.auth.Bootstrap(ctx, app.config.Auth.BootstrapUser, app.config.Auth.BootstrapPassword)
+		if appErr != nil {
+			app.logger.Error(appErr)
+		} else if created {
+			app.logger.Infof("Created first user '%s' with the %s role.", app.config.Auth.BootstrapUser, services.AdminRole)
+		}
+	}
+	if count, appErr := app.repo.CountUsers(ctx); appErr != nil {
+		app.logger.Error(appErr)
+	} else if count == 0 {
+		app.logger.Info("No users exist yet, so nobody can sign in. Set AUTH_BOOTSTRAP_USER and AUTH_BOOTSTRAP_PASSWORD to create the first one.")
+	}
 }
 
 // Implement Renderer interface methods on *application
@@ -35,6 +35,11 @@ func (rwd *responseWriterDelegator) Write(b []byte) (int, error) {
 	return rwd.ResponseWriter.Write(b)
 }
 
+// Unwrap returns the wrapped response writer, so http.ResponseController can flush it and change its deadlines
+func (rwd *responseWriterDelegator) Unwrap() http.ResponseWriter {
+	return rwd.ResponseWriter
+}
+
 // logRequest attaches an extra function to an http.Handler to ensure
 // detailed request logging
 func (app *application) logRequest(next http.Handler) http.Handler {
@@ -7,10 +7,13 @@ import (
 	"io/fs"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/chiltom/SheetBridge/internal/handlers"
 	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/services"
 	"github.com/chiltom/SheetBridge/web"
 )
 
@@ -22,6 +25,11 @@ func humanDate(t time.Time) string {
 	return t.Format("2006-01-02 15:04:00")
 }
 
+// humanDuration rounds durations to the tenth of a second, e.g. "1m2.3s"
+func humanDuration(d time.Duration) string {
+	return d.Round(100 * time.Millisecond).String()
+}
+
 // currentYear returns the current year as an integer
 func currentYear() int {
 	return time.Now().Year()
@@ -33,11 +41,38 @@ func findErrorClass(flashMsg string) bool {
 	return strings.Contains(lowerMsg, "error: ") || strings.Contains(lowerMsg, "failed: ") || strings.Contains(lowerMsg, "invalid: ")
 }
 
+// formatNumber renders an optional number without exponent notation, or an empty string when it is unset
+func formatNumber(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
+
+// columnTypes returns the column types offered when defining a new table
+func columnTypes() []models.ColumnTypeOption {
+	return models.ColumnTypes
+}
+
+// isListedColumnType reports whether colType is one of the offered column types, e.g. false for "NUMERIC(12,2)"
+func isListedColumnType(colType string) bool {
+	for _, option := range models.ColumnTypes {
+		if option.Value == colType {
+			return true
+		}
+	}
+	return false
+}
+
 // templateFunctions defines the function map that will be attached for use in all templates
 var templateFunctions = template.FuncMap{
-	"humanDate":      humanDate,
-	"currentYear":    currentYear,
-	"findErrorClass": findErrorClass,
+	"humanDate":          humanDate,
+	"humanDuration":      humanDuration,
+	"currentYear":        currentYear,
+	"findErrorClass":     findErrorClass,
+	"formatNumber":       formatNumber,
+	"columnTypes":        columnTypes,
+	"isListedColumnType": isListedColumnType,
 }
 
 // newTemplateCache creates a new template cache
@@ -118,6 +153,8 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, status in
 // newTemplateData initializes common template data
 func (app *application) newTemplateData(r *http.Request) *models.TemplateData {
 	return &models.TemplateData{
-		// Initialize with common data if any
+		User:      services.UserFromContext(r.Context()),
+		SignOut:   app.auth.Mode() == services.AuthLocal,
+		CSRFToken: handlers.CSRFToken(r),
 	}
 }
@@ -24,10 +24,41 @@ func (app *application) routes() (http.Handler, error) {
 	// Dynamic application routes
 	mux.HandleFunc("/", app.handlers.Home)
 	mux.HandleFunc("/upload", app.handlers.UploadCSV)
+	mux.HandleFunc("/preview", app.handlers.PreviewUpload)
 	mux.HandleFunc("/commit", app.handlers.CommitCSV)
+	mux.HandleFunc("/jobs/{id}", app.handlers.ImportJob)
+	mux.HandleFunc("/jobs/{id}/cancel", app.handlers.CancelJob)
+	mux.HandleFunc("/results/{id}", app.handlers.ImportResult)
+	mux.HandleFunc("/results/{id}/rejects.csv", app.handlers.DownloadRejects)
+	mux.HandleFunc("/tables/{name}", app.handlers.TableBrowser)
+	mux.HandleFunc("/tables/{name}/export.csv", app.handlers.ExportTable)
+	mux.HandleFunc("/history", app.handlers.History)
+	mux.HandleFunc("/history/{id}/undo", app.handlers.UndoImport)
+	mux.HandleFunc("/login", app.handlers.Login)
+	mux.HandleFunc("/logout", app.handlers.Logout)
 	mux.HandleFunc("/healthz", app.handlers.HealthCheckHandler)
 
+	// Versioned JSON API
+	mux.HandleFunc("/api/v1/uploads", app.handlers.APIUpload)
+	mux.HandleFunc("/api/v1/uploads/{id}", app.handlers.APIUploadPreview)
+	mux.HandleFunc("/api/v1/commits", app.handlers.APICommit)
+	mux.HandleFunc("/api/v1/jobs/{id}", app.handlers.APIJob)
+	mux.HandleFunc("/api/v1/jobs/{id}/cancel", app.handlers.APICancelJob)
+	mux.HandleFunc("/api/v1/jobs/{id}/events", app.handlers.APIJobEvents)
+	mux.HandleFunc("/api/v1/results/{id}", app.handlers.APIResult)
+	mux.HandleFunc("/api/v1/results/{id}/rejects", app.handlers.APIResultRejects)
+	mux.HandleFunc("/api/v1/history", app.handlers.APIHistory)
+	mux.HandleFunc("/api/v1/history/{id}/undo", app.handlers.APIUndoImport)
+	mux.HandleFunc("/api/v1/schemas", app.handlers.APISchemas)
+	mux.HandleFunc("/api/v1/tables", app.handlers.APITables)
+	mux.HandleFunc("/api/v1/tables/{name}", app.handlers.APITableSchema)
+	mux.HandleFunc("/api/v1/tables/{name}/rows", app.handlers.APITableRows)
+	mux.HandleFunc("/api/v1/tables/{name}/export", app.handlers.APIExportTable)
+	mux.HandleFunc("/api/", app.handlers.APINotFound)
+
 	var chain http.Handler = mux
+	chain = app.handlers.VerifyCSRF(chain)
+	chain = app.handlers.RequireAuth(chain)
 	chain = app.logRequest(chain)
 	chain = app.recoverPanic(chain)
 	// Add other global middleware here
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+	"github.com/chiltom/SheetBridge/internal/services"
+)
+
+// Output formats of the infer and schema commands
+const (
+	formatJSON = "json"
+	formatDDL  = "ddl"
+)
+
+// runImport imports a file into a table through the same pipeline as the web interface, and prints the result
+// The result is also printed when the import fails after rejecting rows, so they can be reviewed
+func runImport(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError {
+	table := fs.String("table", "", "Table to import into (default: derived from the file name)")
+	schema := fs.String("schema", "", "Schema of the table (default: DB_DEFAULT_SCHEMA)")
+	action := fs.String("action", string(models.ActionCreate), "create, overwrite, append or upsert")
+	sheet := fs.String("sheet", "", "Worksheet of an .xlsx file (default: the first one)")
+	types := columnTypes{}
+	fs.Var(types, "type", "Type of a new table's column as COLUMN=TYPE, e.g. amount=NUMERIC(12,2), overriding the inferred one; repeatable")
+	keys := fs.String("keys", "", "Comma-separated key columns identifying a row, for upsert")
+	evolve := fs.Bool("evolve", false, "On append, add the file's columns the table lacks and widen column types that cannot hold the new values")
+	validateOnly := fs.Bool("validate-only", false, "Run the import and roll it back, reporting what would happen")
+	skipInvalid := fs.Bool("skip-invalid", false, "Skip rows that fail type conversion instead of aborting")
+	maxRejected := fs.Int64("max-rejected", 0, "With -skip-invalid, roll back if more rows than this are rejected (0 = no limit)")
+	maxRejectedPercent := fs.Float64("max-rejected-percent", 0, "With -skip-invalid, roll back if more than this percentage of rows is rejected (0 = no limit)")
+	rejects := fs.String("rejects", "", "Write the rejected rows to this CSV file")
+	dialect := dialectFlags(c, fs)
+	if appErr := parseFlags(fs, args, 1); appErr != nil {
+		return appErr
+	}
+	if !slices.Contains(models.CommitActions, models.CommitAction(*action)) {
+		return apperrors.Wrap(nil, errUsage, fmt.Sprintf("Invalid action '%s'; use create, overwrite, append or upsert.", *action))
+	}
+
+	upload, appErr := c.csv.InspectLocalFile(fs.Arg(0), dialect(), *sheet)
+	if appErr != nil {
+		return appErr
+	}
+	names, colTypes, appErr := c.csv.OverrideColumnTypes(upload.InferredColumnDefs, types)
+	if appErr != nil {
+		return appErr
+	}
+	if appErr := c.connect(); appErr != nil {
+		return appErr
+	}
+
+	req := models.CommitRequest{
+		TableName:          cmp.Or(*table, upload.OriginalFilename),
+		Action:             models.CommitAction(*action),
+		ColumnNames:        names,
+		ColumnTypes:        colTypes,
+		Sheet:              *sheet,
+		Schema:             *schema,
+		EvolveSchema:       *evolve,
+		ValidateOnly:       *validateOnly,
+		KeyColumns:         splitList(*keys),
+		SkipInvalidRows:    *skipInvalid,
+		MaxRejectedRows:    *maxRejected,
+		MaxRejectedPercent: *maxRejectedPercent,
+	}
+	result, appErr := c.importer().Commit(ctx, upload, req)
+	if result != nil {
+		if result.RejectFile != "" {
+			if moveErr := keepRejectFile(result.RejectFile, *rejects); moveErr != nil && appErr == nil {
+				appErr = moveErr
+			}
+		}
+		if writeErr := c.writeJSON(result); writeErr != nil && appErr == nil {
+			appErr = writeErr
+		}
+	}
+	return appErr
+}
+
+// runInfer prints the schema inferred for a file: its columns, as they would be created, and their statistics as
+// JSON, or the CREATE TABLE statement that would create them
+func runInfer(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError {
+	table := fs.String("table", "", "Table named by the DDL (default: derived from the file name)")
+	schema := fs.String("schema", "", "Schema named by the DDL (default: DB_DEFAULT_SCHEMA)")
+	sheet := fs.String("sheet", "", "Worksheet of an .xlsx file (default: the first one)")
+	types := columnTypes{}
+	fs.Var(types, "type", "Type of a column as COLUMN=TYPE, overriding the inferred one; repeatable")
+	format := fs.String("format", formatJSON, "Output format: json or ddl")
+	dialect := dialectFlags(c, fs)
+	if appErr := parseFlags(fs, args, 1); appErr != nil {
+		return appErr
+	}
+	if *format != formatJSON && *format != formatDDL {
+		return apperrors.Wrap(nil, errUsage, fmt.Sprintf("Invalid format '%s'; use json or ddl.", *format))
+	}
+
+	upload, appErr := c.csv.InspectLocalFile(fs.Arg(0), dialect(), *sheet)
+	if appErr != nil {
+		return appErr
+	}
+	names, colTypes, appErr := c.csv.OverrideColumnTypes(upload.InferredColumnDefs, types)
+	if appErr != nil {
+		return appErr
+	}
+	ref := models.TableRef{
+		Schema: cmp.Or(*schema, c.cfg.DB.DefaultSchema),
+		Name:   c.csv.SanitizeTableName(cmp.Or(*table, upload.OriginalFilename)),
+	}
+	columns := c.csv.TableColumns(names, colTypes)
+
+	if *format == formatDDL {
+		fmt.Fprintln(c.stdout, repositories.CreateTableSQL(ref, columns))
+		return nil
+	}
+	return c.writeJSON(map[string]any{
+		"file":      upload.OriginalFilename,
+		"sheet":     upload.Sheet,
+		"dialect":   upload.Dialect,
+		"table":     ref,
+		"headers":   upload.Headers,
+		"columns":   columns,
+		"inference": upload.Inference,
+	})
+}
+
+// runTables lists the tables of a schema
+func runTables(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError {
+	schema := fs.String("schema", "", "Schema to list (default: DB_DEFAULT_SCHEMA)")
+	if appErr := parseFlags(fs, args, 0); appErr != nil {
+		return appErr
+	}
+	if appErr := c.connect(); appErr != nil {
+		return appErr
+	}
+
+	resolved, appErr := c.importer().ResolveSchema(ctx, *schema)
+	if appErr != nil {
+		return appErr
+	}
+	tables, appErr := c.repo.GetTableNames(ctx, resolved)
+	if appErr != nil {
+		return appErr
+	}
+	if tables == nil {
+		tables = []string{}
+	}
+	return c.writeJSON(map[string]any{"schema": resolved, "tables": tables})
+}
+
+// runSchema prints the columns of a table as JSON, or the CREATE TABLE statement that would recreate them
+func runSchema(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError {
+	schema := fs.String("schema", "", "Schema of the table (default: DB_DEFAULT_SCHEMA)")
+	format := fs.String("format", formatJSON, "Output format: json or ddl")
+	if appErr := parseFlags(fs, args, 1); appErr != nil {
+		return appErr
+	}
+	if *format != formatJSON && *format != formatDDL {
+		return apperrors.Wrap(nil, errUsage, fmt.Sprintf("Invalid format '%s'; use json or ddl.", *format))
+	}
+	if appErr := c.connect(); appErr != nil {
+		return appErr
+	}
+
+	resolved, appErr := c.importer().ResolveSchema(ctx, *schema)
+	if appErr != nil {
+		return appErr
+	}
+	table := models.TableRef{Schema: resolved, Name: fs.Arg(0)}
+	columns, appErr := c.repo.GetTableSchema(ctx, table)
+	if appErr != nil {
+		return appErr
+	}
+
+	if *format == formatDDL {
+		fmt.Fprintln(c.stdout, repositories.CreateTableSQL(table, columns))
+		return nil
+	}
+	return c.writeJSON(map[string]any{"schema": resolved, "name": table.Name, "columns": columns})
+}
+
+// runWatch polls a drop folder until interrupted, importing each file by the first watch rule its name matches
+func runWatch(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError {
+	dir := fs.String("dir", c.cfg.Watch.Dir, "Directory to watch (default: WATCH_DIR)")
+	rules := fs.String("rules", c.cfg.Watch.Rules, "JSON file of the rules routing files to tables (default: WATCH_RULES)")
+	interval := fs.Duration("interval", c.cfg.Watch.Interval, "How often the directory is polled (default: WATCH_INTERVAL)")
+	settle := fs.Duration("settle", c.cfg.Watch.Settle, "How long a file's size must stay the same before it is imported (default: WATCH_SETTLE)")
+	if appErr := parseFlags(fs, args, 0); appErr != nil {
+		return appErr
+	}
+	if *dir == "" || *rules == "" {
+		return apperrors.Wrap(nil, errUsage, "Both the directory to watch and its rules are required; set -dir and -rules, or WATCH_DIR and WATCH_RULES.")
+	}
+	if *interval <= 0 || *settle < 0 {
+		return apperrors.Wrap(nil, errUsage, "The poll interval must be positive and the settle time must not be negative.")
+	}
+	if info, err := os.Stat(*dir); err != nil || !info.IsDir() {
+		return apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("'%s' is not a directory.", *dir))
+	}
+	watchRules, appErr := services.LoadWatchRules(*rules)
+	if appErr != nil {
+		return appErr
+	}
+	if appErr := c.connect(); appErr != nil {
+		return appErr
+	}
+
+	watcher := services.NewWatcher(c.logger, c.csv, c.importer(), services.WatchOptions{
+		Dir:      *dir,
+		Interval: *interval,
+		Settle:   *settle,
+		Rules:    watchRules,
+	})
+	return watcher.Run(ctx)
+}
+
+// dialectFlags defines the CSV dialect flags of a command and returns a function giving the dialect they describe
+// once the flags are parsed
+func dialectFlags(c *cli, fs *flag.FlagSet) func() models.CSVDialect {
+	defaults := models.DefaultCSVDialect()
+	encoding := fs.String("encoding", "", "Text encoding: utf-8, utf-16le, utf-16be, windows-1252 or iso-8859-1 (default: detected)")
+	delimiter := fs.String("delimiter", "", `Field delimiter: a single character or "tab" (default: detected)`)
+	comment := fs.String("comment", "", "Skip lines starting with this character")
+	lazyQuotes := fs.Bool("lazy-quotes", defaults.LazyQuotes, "Tolerate bare and unescaped quotes inside fields")
+	trimLeadingSpace := fs.Bool("trim-leading-space", defaults.TrimLeadingSpace, "Ignore leading white space in fields")
+	noHeader := fs.Bool("no-header", !defaults.HasHeader, "The first row holds data rather than column names")
+	return func() models.CSVDialect {
+		dialect := defaults
+		dialect.Encoding = *encoding
+		dialect.Delimiter = *delimiter
+		dialect.Comment = *comment
+		dialect.LazyQuotes = *lazyQuotes
+		dialect.TrimLeadingSpace = *trimLeadingSpace
+		dialect.HasHeader = !*noHeader
+		return c.csv.NormalizeDialect(dialect)
+	}
+}
+
+// keepRejectFile moves the temp file holding an import's rejected rows to dst, or removes it when dst is empty
+func keepRejectFile(src, dst string) *apperrors.AppError {
+	if dst == "" {
+		os.Remove(src)
+		return nil
+	}
+	return services.MoveRejectFile(src, dst)
+}
+
+// columnTypes collects repeated COLUMN=TYPE flags
+type columnTypes map[string]string
+
+// String returns the flag's value in its command-line form
+func (t columnTypes) String() string {
+	pairs := make([]string, 0, len(t))
+	for column, colType := range t {
+		pairs = append(pairs, column+"="+colType)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Set adds a COLUMN=TYPE pair
+func (t columnTypes) Set(value string) error {
+	column, colType, ok := strings.Cut(value, "=")
+	column, colType = strings.TrimSpace(column), strings.TrimSpace(colType)
+	if !ok || column == "" || colType == "" {
+		return fmt.Errorf("%q is not COLUMN=TYPE", value)
+	}
+	t[column] = strings.ToUpper(colType)
+	return nil
+}
+
+// splitList splits a comma-separated list, dropping blank items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,196 @@
+// Command sheetbridge runs SheetBridge imports from the command line, for scripts and scheduled jobs
+// It reads the same configuration as the server and runs the same import pipeline, without the web interface
+//
+// Results are printed to stdout as JSON, or as DDL when asked for. A failure prints a JSON error to stderr, as
+// {"code": "...", "message": "..."}, and exits with status 1, or 2 when the command line is invalid
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+	"github.com/chiltom/SheetBridge/internal/services"
+	"github.com/chiltom/SheetBridge/internal/utils"
+)
+
+// Exit statuses
+const (
+	exitFailure = 1 // The command failed
+	exitUsage   = 2 // The command line is invalid
+)
+
+// Errors of the command line itself
+var (
+	errUsage = apperrors.New("invalid_usage", "The command line is invalid.")
+	errHelp  = apperrors.New("help", "Help was requested.") // Not an error: the usage was printed and the CLI succeeds
+)
+
+// command is a subcommand of the CLI
+type command struct {
+	usage   string // Arguments, after the command's name
+	summary string
+	run     func(c *cli, ctx context.Context, fs *flag.FlagSet, args []string) *apperrors.AppError // Defines its flags on fs
+}
+
+// commands are the subcommands of the CLI, by name
+var commands = map[string]command{
+	"import": {"[flags] FILE", "Import a .csv or .xlsx file into a table", runImport},
+	"infer":  {"[flags] FILE", "Print the schema inferred for a file, as JSON or DDL", runInfer},
+	"tables": {"[flags]", "List the tables of a schema", runTables},
+	"schema": {"[flags] TABLE", "Print the columns of a table, as JSON or DDL", runSchema},
+	"watch":  {"[flags]", "Import the files dropped into a directory, by rules matching their names", runWatch},
+}
+
+// commandOrder is the order commands are listed in by the usage message
+var commandOrder = []string{"import", "infer", "tables", "schema", "watch"}
+
+// cli holds what the commands share
+type cli struct {
+	cfg    *utils.Config
+	logger *logger.Logger
+	csv    *services.CSVService
+	stdout io.Writer
+	repo   *repositories.DBRepository // Set by connect
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command named by the first argument and returns the process's exit status
+func run(args []string) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help" {
+		printUsage(os.Stderr)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return 0
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		printUsage(os.Stderr)
+		return writeError(apperrors.Wrap(nil, errUsage, fmt.Sprintf("Unknown command '%s'.", args[0])))
+	}
+
+	cfg := utils.LoadConfig()
+	c := &cli{
+		cfg:    cfg,
+		logger: logger.New(os.Stderr, os.Stderr),
+		csv: services.NewCSVService(services.InferenceOptions{
+			SampleRows: cfg.Inference.SampleRows,
+			Sampling:   cfg.Inference.Sampling,
+		}),
+		stdout: os.Stdout,
+	}
+	defer c.close()
+
+	// An interrupted import is rolled back, and stops the watcher
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if appErr := cmd.run(c, ctx, newFlagSet(args[0], cmd), args[1:]); appErr != nil {
+		return writeError(appErr)
+	}
+	return 0
+}
+
+// printUsage lists the commands
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: sheetbridge COMMAND [flags] [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(w, "  %-8s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintln(w, "\nRun 'sheetbridge COMMAND -h' for the flags of a command.")
+	fmt.Fprintln(w, "Configuration is read from .env and the environment, as for the server.")
+}
+
+// newFlagSet returns the flag set of a command
+func newFlagSet(name string, cmd command) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: sheetbridge %s %s\n\n%s.\n\nFlags:\n", name, cmd.usage, cmd.summary)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// parseFlags parses a command's flags and checks it was given as many arguments as it takes, printing the command's
+// usage when they are invalid or help was asked for
+func parseFlags(fs *flag.FlagSet, args []string, nArgs int) *apperrors.AppError {
+	fs.SetOutput(io.Discard) // Parse errors are reported as JSON instead
+	err := fs.Parse(args)
+	fs.SetOutput(os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		fs.Usage()
+		return errHelp
+	}
+	if err == nil && fs.NArg() != nArgs {
+		err = fmt.Errorf("expected %d argument(s), got %d", nArgs, fs.NArg())
+	}
+	if err != nil {
+		fs.Usage()
+		return apperrors.Wrap(err, errUsage, fmt.Sprintf("Invalid command line: %v.", err))
+	}
+	return nil
+}
+
+// connect opens the database connection pool, once
+func (c *cli) connect() *apperrors.AppError {
+	if c.repo != nil {
+		return nil
+	}
+	repo, err := repositories.NewDBRepository(c.cfg)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to connect to the database: %v", err))
+	}
+	c.repo = repo
+	return nil
+}
+
+// close closes the database connection pool, if it was opened
+func (c *cli) close() {
+	if c.repo != nil {
+		c.repo.Close()
+	}
+}
+
+// importer returns an import service using the configured schemas; the database must be connected
+func (c *cli) importer() *services.ImportService {
+	return services.NewImportService(c.logger, c.csv, c.repo, services.SchemaOptions{Default: c.cfg.DB.DefaultSchema, Allowed: c.cfg.DB.AllowedSchemas})
+}
+
+// writeJSON prints v to stdout as indented JSON
+func (c *cli) writeJSON(v any) *apperrors.AppError {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to write output")
+	}
+	return nil
+}
+
+// writeError prints a command's error to stderr as JSON and returns the exit status it calls for
+// A help request prints nothing more and succeeds
+func writeError(appErr *apperrors.AppError) int {
+	switch {
+	case apperrors.Is(appErr, errHelp):
+		return 0
+	case apperrors.Is(appErr, errUsage):
+		json.NewEncoder(os.Stderr).Encode(appErr)
+		return exitUsage
+	default:
+		json.NewEncoder(os.Stderr).Encode(appErr)
+		return exitFailure
+	}
+}
@@ -4,14 +4,22 @@ import "fmt"
 
 // Standard application errors
 var (
-	ErrNotFound       = New("resource_not_found", "The requested resource could not be found.")
-	ErrInvalidInput   = New("invalid_input", "The input provided is invalid.")
-	ErrDatabase       = New("database_error", "A database error occurred.")
-	ErrCSVProcessing  = New("csv_processing_error", "An error occurred while processing the CSV file.")
-	ErrFileOperation  = New("file_operation_error", "An error occurred during a file operation.")
-	ErrInternalServer = New("internal_server_error", "An unexpected error occurred on the server.")
-	ErrDataConflict   = New("data_conflict", "The operation could not be completed due to a data conflict (e.g., table exists).")
-	ErrTypeConversion = New("type_conversion_error", "Failed to convert data to the target type.")
+	ErrNotFound         = New("resource_not_found", "The requested resource could not be found.")
+	ErrInvalidInput     = New("invalid_input", "The input provided is invalid.")
+	ErrDatabase         = New("database_error", "A database error occurred.")
+	ErrCSVProcessing    = New("csv_processing_error", "An error occurred while processing the CSV file.")
+	ErrFileOperation    = New("file_operation_error", "An error occurred during a file operation.")
+	ErrFileIntegrity    = New("file_integrity_error", "The file to import does not match the file that was previewed.")
+	ErrInternalServer   = New("internal_server_error", "An unexpected error occurred on the server.")
+	ErrDataConflict     = New("data_conflict", "The operation could not be completed due to a data conflict (e.g., table exists).")
+	ErrTypeConversion   = New("type_conversion_error", "Failed to convert data to the target type.")
+	ErrMethodNotAllowed = New("method_not_allowed", "The request method is not supported for this resource.")
+	ErrRejectThreshold  = New("reject_threshold_exceeded", "Too many rows were rejected; the import was rolled back.")
+	ErrUnauthorized     = New("unauthorized", "You must sign in to continue.")
+	ErrForbidden        = New("forbidden", "You do not have permission to do that.")
+	ErrInvalidCSRFToken = New("invalid_csrf_token", "The request could not be verified as coming from SheetBridge. Reload the page and try again.")
+	ErrCancelled        = New("cancelled", "The import was cancelled.")
+	ErrUnavailable      = New("service_unavailable", "The server is too busy to take this import. Try again shortly.")
 )
 
 // AppError defines a standard application error
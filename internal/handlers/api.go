@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// MaxJSONBodySize caps the size of JSON request bodies accepted by the API
+const MaxJSONBodySize = 1 << 20 // 1 MB
+
+// APIUpload accepts a multipart .csv or .xlsx upload (field "csvfile") and returns its preview as JSON
+// Optional form fields set the CSV dialect: encoding, delimiter, comment, lazyQuotes, trimLeadingSpace and hasHeader
+// The optional schema field picks the schema the preview looks up the suggested table in
+// POST /api/v1/uploads
+func (h *AppHandlers) APIUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+	if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, apperrors.Wrap(err, apperrors.ErrInvalidInput, "File exceeds maximum allowed size of 20MB."))
+			return
+		}
+		writeAPIError(w, http.StatusBadRequest, apperrors.Wrap(err, apperrors.ErrInvalidInput, "Error parsing multipart form."))
+		return
+	}
+
+	file, handler, err := r.FormFile("csvfile")
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, apperrors.Wrap(err, apperrors.ErrInvalidInput, "Multipart field 'csvfile' is required."))
+		return
+	}
+	defer file.Close()
+
+	if _, ok := h.csvService.DetectFormat(handler.Filename); !ok {
+		writeAPIError(w, http.StatusBadRequest, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Invalid file type. Please upload a .csv or .xlsx file."))
+		return
+	}
+
+	preview, appErr := h.stageUpload(r.Context(), handler, h.dialectFromValues(r.Form), r.FormValue("schema"))
+	if appErr != nil {
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, preview)
+}
+
+// APIUploadPreview returns the preview of a pending upload; for workbooks, ?sheet= switches the selected worksheet
+// The same dialect query parameters accepted on upload re-parse a CSV upload with new options, and ?schema= switches
+// the target schema
+// GET /api/v1/uploads/{id}
+func (h *AppHandlers) APIUploadPreview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	preview, appErr := h.repreviewUpload(r.Context(), r.PathValue("id"), query.Get("sheet"), h.dialectOverride(query), query.Get("schema"))
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) {
+			h.logger.Error(appErr)
+		}
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, preview)
+}
+
+// APICommit queues the commit of a previously uploaded file, described by a JSON CommitRequest, as a background job
+// and returns the job at once; its progress and outcome are fetched from /api/v1/jobs/{id}
+// With validateOnly, the import is run and rolled back, and the upload can still be committed afterwards
+// POST /api/v1/commits
+func (h *AppHandlers) APICommit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	var req models.CommitRequest
+	if appErr := readJSON(w, r, &req); appErr != nil {
+		writeAPIError(w, http.StatusBadRequest, appErr)
+		return
+	}
+	if req.UploadID == "" || req.TableName == "" || req.Action == "" {
+		writeAPIError(w, http.StatusBadRequest, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Fields 'uploadId', 'tableName' and 'action' are required."))
+		return
+	}
+	if appErr := h.importer.AuthorizeCommit(r.Context(), req); appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	job, appErr := h.jobs.Submit(r.Context(), req)
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) && !apperrors.Is(appErr, apperrors.ErrUnavailable) {
+			h.logger.Error(appErr)
+		}
+		writeAPIAppError(w, appErr)
+		return
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+// APIResult returns a kept commit result, including its first rejected rows
+// GET /api/v1/results/{id}
+func (h *AppHandlers) APIResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	result, appErr := h.uploads.GetResult(r.Context(), r.PathValue("id"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// APIResultRejects downloads the reject CSV of a kept commit result
+// GET /api/v1/results/{id}/rejects
+func (h *AppHandlers) APIResultRejects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	result, appErr := h.uploads.GetResult(r.Context(), r.PathValue("id"))
+	if appErr == nil && result.RejectFile == "" {
+		appErr = apperrors.Wrap(nil, apperrors.ErrNotFound, "this import result has no reject file")
+	}
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	if err := serveRejectFile(w, r, result); err != nil {
+		appErr = apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open reject file")
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+	}
+}
+
+// APISchemas lists the schemas tables can be imported into, along with the default one
+// GET /api/v1/schemas
+func (h *AppHandlers) APISchemas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	schemas, appErr := h.importer.Schemas(r.Context())
+	if appErr != nil {
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+		return
+	}
+	if schemas == nil {
+		schemas = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"schemas": schemas, "default": h.importer.DefaultSchema()})
+}
+
+// APITables lists the tables available for import in the schema given by ?schema=, or in the default schema
+// GET /api/v1/tables
+func (h *AppHandlers) APITables(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	schema, appErr := h.importer.ResolveSchema(r.Context(), r.URL.Query().Get("schema"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	tables, appErr := h.repo.GetTableNames(r.Context(), schema)
+	if appErr != nil {
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+		return
+	}
+	if tables == nil {
+		tables = []string{}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"schema": schema, "tables": tables})
+}
+
+// APITableSchema returns the column definitions of a single table in the schema given by ?schema=, or in the
+// default schema
+// GET /api/v1/tables/{name}
+func (h *AppHandlers) APITableSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	schema, appErr := h.importer.ResolveSchema(r.Context(), r.URL.Query().Get("schema"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	table := models.TableRef{Schema: schema, Name: r.PathValue("name")}
+	columns, appErr := h.repo.GetTableSchema(r.Context(), table)
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) {
+			h.logger.Error(appErr)
+		}
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"schema": schema, "name": table.Name, "columns": columns})
+}
+
+// APINotFound answers unknown API routes with a JSON error instead of an HTML page
+func (h *AppHandlers) APINotFound(w http.ResponseWriter, r *http.Request) {
+	writeAPIError(w, http.StatusNotFound, apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("No API endpoint at %s.", r.URL.Path)))
+}
+
+// statusForAppError maps an AppError code onto the HTTP status code returned by the API
+func statusForAppError(appErr *apperrors.AppError) int {
+	switch appErr.Code {
+	case apperrors.ErrNotFound.Code:
+		return http.StatusNotFound
+	case apperrors.ErrInvalidInput.Code, apperrors.ErrCSVProcessing.Code, apperrors.ErrFileIntegrity.Code, "invalid_action":
+		return http.StatusBadRequest
+	case apperrors.ErrUnauthorized.Code:
+		return http.StatusUnauthorized
+	case apperrors.ErrForbidden.Code, apperrors.ErrInvalidCSRFToken.Code:
+		return http.StatusForbidden
+	case apperrors.ErrDataConflict.Code:
+		return http.StatusConflict
+	case apperrors.ErrTypeConversion.Code, "data_mismatch", apperrors.ErrRejectThreshold.Code:
+		return http.StatusUnprocessableEntity
+	case apperrors.ErrUnavailable.Code:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeAPIAppError writes an AppError as JSON using the status code that matches its error code
+func writeAPIAppError(w http.ResponseWriter, appErr *apperrors.AppError) {
+	writeAPIError(w, statusForAppError(appErr), appErr)
+}
+
+// writeAPIError writes an AppError as JSON with the given status code
+func writeAPIError(w http.ResponseWriter, status int, appErr *apperrors.AppError) {
+	writeJSON(w, status, appErr)
+}
+
+// writeAPIMethodNotAllowed writes a JSON 405 response listing the allowed methods
+func writeAPIMethodNotAllowed(w http.ResponseWriter, allowedMethods ...string) {
+	w.Header().Set("Allow", strings.Join(allowedMethods, ", "))
+	writeAPIError(w, http.StatusMethodNotAllowed, apperrors.Wrap(nil, apperrors.ErrMethodNotAllowed, fmt.Sprintf("This resource only supports %s.", strings.Join(allowedMethods, ", "))))
+}
+
+// writeJSON encodes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// readJSON decodes a size-limited JSON request body into dst, rejecting unknown fields
+func readJSON(w http.ResponseWriter, r *http.Request, dst any) *apperrors.AppError {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxJSONBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid JSON body: %v", err))
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/services"
+)
+
+// SessionCookie is the name of the cookie holding the session token of a signed-in user
+const SessionCookie = "sheetbridge_session"
+
+// loginForm holds the fields of the sign-in form
+type loginForm struct {
+	Username string
+	Next     string // Where to go once signed in
+}
+
+// RequireAuth lets a request through only when it comes from a signed-in user, who is then carried by the request's
+// context. Pages send anonymous visitors to the sign-in page and the API answers them with a 401
+// Local users sign in with a session cookie, or with HTTP Basic credentials on the API; in proxy mode the username
+// is read from the proxy header of requests coming from a trusted proxy
+func (h *AppHandlers) RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if h.auth.Mode() == services.AuthNone || isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, appErr := h.requestUser(r)
+		if appErr != nil && !apperrors.Is(appErr, apperrors.ErrUnauthorized) {
+			if isAPIPath(r.URL.Path) {
+				h.logger.Error(appErr)
+				writeAPIAppError(w, appErr)
+				return
+			}
+			h.renderer.ServerError(w, r, appErr)
+			return
+		}
+		if appErr != nil {
+			if isAPIPath(r.URL.Path) {
+				if h.auth.Mode() == services.AuthLocal {
+					w.Header().Set("WWW-Authenticate", `Basic realm="SheetBridge", charset="UTF-8"`)
+				}
+				writeAPIAppError(w, appErr)
+				return
+			}
+			if h.auth.Mode() == services.AuthProxy {
+				h.renderer.ClientError(w, r, http.StatusUnauthorized, "401 Unauthorized: "+appErr.Message)
+				return
+			}
+			http.Redirect(w, r, "/login?"+url.Values{"next": {r.URL.RequestURI()}}.Encode(), http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(services.ContextWithUser(r.Context(), user)))
+	})
+}
+
+// requestUser returns the user who made a request, or ErrUnauthorized when nobody is signed in
+func (h *AppHandlers) requestUser(r *http.Request) (*models.User, *apperrors.AppError) {
+	if h.auth.Mode() == services.AuthProxy {
+		if !h.auth.TrustsProxy(r.RemoteAddr) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrUnauthorized, "Requests must come through the trusted reverse proxy.")
+		}
+		return h.auth.ProxyUser(r.Context(), r.Header.Get(h.auth.ProxyHeader()))
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		return h.auth.SessionUser(r.Context(), cookie.Value)
+	}
+	if username, password, ok := r.BasicAuth(); ok && isAPIPath(r.URL.Path) {
+		return h.auth.Authenticate(r.Context(), username, password)
+	}
+	return nil, apperrors.Wrap(nil, apperrors.ErrUnauthorized)
+}
+
+// Login renders the sign-in form, and signs a local user in with a session cookie when it is submitted
+// GET, POST /login
+func (h *AppHandlers) Login(w http.ResponseWriter, r *http.Request) {
+	if h.auth.Mode() != services.AuthLocal {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		h.loginPage(w, r)
+	case http.MethodPost:
+		h.login(w, r)
+	default:
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet, http.MethodPost)
+	}
+}
+
+// loginPage renders the sign-in form
+func (h *AppHandlers) loginPage(w http.ResponseWriter, r *http.Request) {
+	data := h.renderer.NewTemplateData(r)
+	data.Flash = r.URL.Query().Get("flash")
+	data.Form = &loginForm{Next: safeRedirect(r.URL.Query().Get("next"))}
+	h.renderer.Render(w, r, http.StatusOK, "login.page.tmpl", data)
+}
+
+// login signs a local user in with a session cookie and continues to the page they came from
+func (h *AppHandlers) login(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderer.ClientError(w, r, http.StatusBadRequest, "Error parsing form data.")
+		return
+	}
+
+	form := &loginForm{Username: r.PostFormValue("username"), Next: safeRedirect(r.PostFormValue("next"))}
+	user, token, expiresAt, appErr := h.auth.Login(r.Context(), form.Username, r.PostFormValue("password"))
+	if appErr != nil {
+		status := http.StatusUnauthorized
+		if !apperrors.Is(appErr, apperrors.ErrUnauthorized) {
+			h.logger.Error(appErr)
+			status = http.StatusInternalServerError
+		}
+		data := h.renderer.NewTemplateData(r)
+		data.Flash = "Error: " + appErr.Message
+		data.Form = form
+		h.renderer.Render(w, r, status, "login.page.tmpl", data)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   h.auth.CookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	h.logger.Infof("User '%s' signed in", user.Username)
+	http.Redirect(w, r, form.Next, http.StatusSeeOther)
+}
+
+// Logout ends the session of the signed-in user
+// POST /logout
+func (h *AppHandlers) Logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderer.MethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	if cookie, err := r.Cookie(SessionCookie); err == nil && cookie.Value != "" {
+		if appErr := h.auth.Logout(r.Context(), cookie.Value); appErr != nil {
+			h.logger.Error(appErr)
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.auth.CookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	h.clearCSRFToken(w)
+	redirectWithFlash(w, r, "/login", "You have been signed out.", false)
+}
+
+// isPublicPath reports whether a path can be reached without signing in
+func isPublicPath(path string) bool {
+	return path == "/login" || path == "/healthz" || strings.HasPrefix(path, "/static/")
+}
+
+// isAPIPath reports whether a path belongs to the JSON API
+func isAPIPath(path string) bool {
+	return strings.HasPrefix(path, "/api/")
+}
+
+// safeRedirect returns next when it is a path on this site, and "/" otherwise, so sign-in cannot be used to send
+// users to another site
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, `/\`) {
+		return "/"
+	}
+	return next
+}
+
+// currentUsername returns the name of the user who made a request, or "" when authentication is disabled
+func currentUsername(r *http.Request) string {
+	return services.UsernameFromContext(r.Context())
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+)
+
+// CSRF token transport
+const (
+	CSRFCookie = "sheetbridge_csrf" // Holds the browser session's token
+	CSRFField  = "csrf_token"       // Form field every state-changing form sends the token back in
+	CSRFHeader = "X-CSRF-Token"     // Header scripts may send the token in instead
+)
+
+// csrfContextKey is the context key of the request's CSRF token
+type csrfContextKey struct{}
+
+// VerifyCSRF gives every browser session a CSRF token, kept in a cookie and carried by the request's context for
+// the templates, and refuses state-changing requests that do not send it back with a 403
+// A page on another site can make the browser send SheetBridge's cookies, but cannot read the token, so a form it
+// submits is turned away. State-changing API requests must always send the CSRF header; see checkAPICSRFHeader
+func (h *AppHandlers) VerifyCSRF(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(CSRFCookie); err == nil {
+			token = cookie.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if token == "" && !isAPIPath(r.URL.Path) {
+				var appErr *apperrors.AppError
+				if token, appErr = h.issueCSRFToken(w); appErr != nil {
+					h.renderer.ServerError(w, r, appErr)
+					return
+				}
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)))
+			return
+		}
+
+		if isAPIPath(r.URL.Path) {
+			if appErr := checkAPICSRFHeader(r, token); appErr != nil {
+				writeAPIError(w, http.StatusForbidden, appErr)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)))
+			return
+		}
+		submitted, status, appErr := submittedCSRFToken(w, r)
+		if appErr == nil && (token == "" || !validCSRFToken(token, submitted)) {
+			status, appErr = http.StatusForbidden, apperrors.Wrap(nil, apperrors.ErrInvalidCSRFToken)
+		}
+		if appErr != nil {
+			if isAPIPath(r.URL.Path) {
+				writeAPIError(w, status, appErr)
+				return
+			}
+			h.renderer.ClientError(w, r, status, fmt.Sprintf("%d %s: %s", status, http.StatusText(status), appErr.Message))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)))
+	})
+}
+
+// checkAPICSRFHeader refuses a state-changing API request that does not send the CSRF header, or whose header does
+// not match the browser session's token when it has one. Scripts without the CSRF cookie may send any value
+// A page on another site cannot add a custom header to a cross-site request without a CORS preflight, which
+// SheetBridge never answers, so requiring it stops forged requests even when the browser resends cached HTTP Basic
+// credentials on its own and no cookies are sent
+func checkAPICSRFHeader(r *http.Request, token string) *apperrors.AppError {
+	submitted := r.Header.Get(CSRFHeader)
+	if submitted == "" {
+		return apperrors.Wrap(nil, apperrors.ErrInvalidCSRFToken, fmt.Sprintf("State-changing API requests must send the %s header: the session's CSRF token from a browser, or any value from a script.", CSRFHeader))
+	}
+	if token != "" && !validCSRFToken(token, submitted) {
+		return apperrors.Wrap(nil, apperrors.ErrInvalidCSRFToken, fmt.Sprintf("The %s header does not match the session's CSRF token.", CSRFHeader))
+	}
+	return nil
+}
+
+// issueCSRFToken sets a new CSRF token cookie, lasting as long as the browser session, and returns the token
+func (h *AppHandlers) issueCSRFToken(w http.ResponseWriter) (string, *apperrors.AppError) {
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate CSRF token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   h.auth.CookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+	return token, nil
+}
+
+// clearCSRFToken removes the CSRF token cookie, so the next browser session gets a new token
+func (h *AppHandlers) clearCSRFToken(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   h.auth.CookieSecure(),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// submittedCSRFToken returns the token a request sent back, from the CSRF header or the form
+// Multipart uploads are parsed here with the upload size limit so the token can be read from the form; handlers
+// parsing them again get the parsed form. A body that cannot be parsed is answered with the returned status
+func submittedCSRFToken(w http.ResponseWriter, r *http.Request) (string, int, *apperrors.AppError) {
+	if token := r.Header.Get(CSRFHeader); token != "" {
+		return token, 0, nil
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxUploadSize)
+		if err := r.ParseMultipartForm(MaxUploadSize); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return "", http.StatusRequestEntityTooLarge, apperrors.Wrap(err, apperrors.ErrInvalidInput, "File exceeds maximum allowed size of 20MB.")
+			}
+			return "", http.StatusBadRequest, apperrors.Wrap(err, apperrors.ErrInvalidInput, "Error parsing multipart form.")
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return "", http.StatusBadRequest, apperrors.Wrap(err, apperrors.ErrInvalidInput, "Error parsing form data.")
+	}
+	return r.PostFormValue(CSRFField), 0, nil
+}
+
+// validCSRFToken reports whether a submitted token matches the cookie's, in constant time
+func validCSRFToken(token, submitted string) bool {
+	return submitted != "" && subtle.ConstantTimeCompare([]byte(token), []byte(submitted)) == 1
+}
+
+// CSRFToken returns the CSRF token of the browser session that made a request, for rendering into forms
+func CSRFToken(r *http.Request) string {
+	token, _ := r.Context().Value(csrfContextKey{}).(string)
+	return token
+}
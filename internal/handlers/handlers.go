@@ -1,11 +1,16 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/chiltom/SheetBridge/internal/apperrors"
 	"github.com/chiltom/SheetBridge/internal/logger"
@@ -32,15 +37,23 @@ type Renderer interface {
 type AppHandlers struct {
 	logger     *logger.Logger
 	csvService *services.CSVService
+	uploads    *services.UploadStore
+	importer   *services.ImportService
+	jobs       *services.JobQueue
+	auth       *services.AuthService
 	repo       *repositories.DBRepository
 	renderer   Renderer
 }
 
 // NewAppHandlers creates a new application handler struct
-func NewAppHandlers(l *logger.Logger, csv *services.CSVService, r *repositories.DBRepository, renderer Renderer) *AppHandlers {
+func NewAppHandlers(l *logger.Logger, csv *services.CSVService, uploads *services.UploadStore, importer *services.ImportService, jobs *services.JobQueue, auth *services.AuthService, r *repositories.DBRepository, renderer Renderer) *AppHandlers {
 	return &AppHandlers{
 		logger:     l,
 		csvService: csv,
+		uploads:    uploads,
+		importer:   importer,
+		jobs:       jobs,
+		auth:       auth,
 		repo:       r,
 		renderer:   renderer,
 	}
@@ -60,14 +73,15 @@ func (h *AppHandlers) Home(w http.ResponseWriter, r *http.Request) {
 	flash := r.URL.Query().Get("flash")
 	ctx := r.Context()
 
-	existingTables, err := h.repo.GetTableNames(ctx)
+	schema := h.importer.DefaultSchema()
+	existingTables, err := h.repo.GetTableNames(ctx, schema)
 	if err != nil {
 		h.logger.Error(err) // Log, but page can still render
 	}
 
 	data := h.renderer.NewTemplateData(r)
 	data.Flash = flash
-	data.Preview = &models.CSVPreview{ExistingTables: existingTables}
+	data.Preview = &models.CSVPreview{Schema: schema, ExistingTables: existingTables}
 
 	h.renderer.Render(w, r, http.StatusOK, "home.page.tmpl", data)
 }
@@ -98,71 +112,239 @@ func (h *AppHandlers) UploadCSV(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	if !strings.HasSuffix(strings.ToLower(handler.Filename), ".csv") {
-		redirectWithFlash(w, r, "/", "Error: Invalid file type. Please upload a .csv file.", true)
+	if _, ok := h.csvService.DetectFormat(handler.Filename); !ok {
+		redirectWithFlash(w, r, "/", "Error: Invalid file type. Please upload a .csv or .xlsx file.", true)
 		return
 	}
 
-	csvHeaders, previewRows, tempFilePath, appErr := h.csvService.ParseUploadedCSV(handler)
+	preview, appErr := h.stageUpload(ctx, handler, h.dialectFromValues(r.Form), r.FormValue("schema"))
 	if appErr != nil {
 		h.logger.Error(appErr)
-		if tempFilePath != "" {
-			os.Remove(tempFilePath)
+		redirectWithFlash(w, r, "/", fmt.Sprintf("Error parsing file: %s", appErr.Message), true)
+		return
+	}
+
+	h.renderPreview(w, r, preview)
+}
+
+// PreviewUpload re-renders the preview page for a pending upload, optionally switching the worksheet, CSV dialect or
+// target schema
+func (h *AppHandlers) PreviewUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	query := r.URL.Query()
+	preview, appErr := h.repreviewUpload(r.Context(), query.Get("upload"), query.Get("sheet"), h.dialectOverride(query), query.Get("schema"))
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) {
+			h.logger.Error(appErr)
 		}
-		redirectWithFlash(w, r, "/", fmt.Sprintf("Error parsing CSV: %s", appErr.Message), true)
+		redirectWithFlash(w, r, "/", fmt.Sprintf("Error previewing upload: %s", appErr.Message), true)
 		return
 	}
 
-	suggestedTableName := h.csvService.SanitizeTableName(handler.Filename)
+	h.renderPreview(w, r, preview)
+}
+
+// renderPreview renders the preview page with the default commit form for the preview
+func (h *AppHandlers) renderPreview(w http.ResponseWriter, r *http.Request, preview *models.CSVPreview) {
+	data := h.renderer.NewTemplateData(r)
+	data.Flash = r.URL.Query().Get("flash")
+	data.Preview = preview
+
+	defaultAction := models.ActionCreate
+	if preview.TableExists {
+		// Overwrite is a sensible default for existing tables, unless the user may only add to them
+		defaultAction = models.ActionOverwrite
+		for _, action := range []models.CommitAction{models.ActionOverwrite, models.ActionAppend, models.ActionUpsert} {
+			if preview.Allows(action) {
+				defaultAction = action
+				break
+			}
+		}
+	}
+	data.Form = &models.CommitRequest{TableName: preview.SuggestedTable, Action: defaultAction}
+
+	h.renderer.Render(w, r, http.StatusOK, "preview.page.tmpl", data)
+}
+
+// stageUpload spools and parses an uploaded file, registers an upload session for it and builds its preview
+// It is shared by the HTML upload flow and the JSON API
+func (h *AppHandlers) stageUpload(ctx context.Context, fileHeader *multipart.FileHeader, dialect models.CSVDialect, schema string) (*models.CSVPreview, *apperrors.AppError) {
+	upload, appErr := h.csvService.SpoolUpload(fileHeader, dialect)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	headers, previewRows, appErr := h.csvService.PreviewUpload(upload)
+	if appErr == nil {
+		upload.InferredColumnDefs, upload.Inference, appErr = h.csvService.InferSchema(upload)
+	}
+	if appErr != nil {
+		os.Remove(upload.TempFilePath)
+		return nil, appErr
+	}
+	upload.Headers = headers
+
+	if appErr := h.uploads.Add(ctx, upload); appErr != nil {
+		os.Remove(upload.TempFilePath)
+		return nil, appErr
+	}
+
+	preview, appErr := h.buildPreview(ctx, upload, previewRows, schema)
+	if appErr != nil {
+		h.uploads.Remove(upload.ID)
+		return nil, appErr
+	}
+	return preview, nil
+}
+
+// repreviewUpload rebuilds the preview of a pending upload against the given schema, switching to another worksheet
+// when sheet is set and re-parsing with another dialect when dialect is non-nil
+func (h *AppHandlers) repreviewUpload(ctx context.Context, uploadID, sheet string, dialect *models.CSVDialect, schema string) (*models.CSVPreview, *apperrors.AppError) {
+	upload, appErr := h.uploads.Get(ctx, uploadID)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if sheet != "" && sheet != upload.Sheet {
+		if !slices.Contains(upload.Sheets, sheet) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Sheet '%s' does not exist in the uploaded workbook.", sheet))
+		}
+		upload.Sheet = sheet
+	}
+	if dialect != nil {
+		if appErr := h.csvService.ResolveDialect(upload, *dialect); appErr != nil {
+			return nil, appErr
+		}
+	}
+
+	headers, previewRows, appErr := h.csvService.PreviewUpload(upload)
+	if appErr != nil {
+		return nil, appErr
+	}
+	inferredDefs, inference, appErr := h.csvService.InferSchema(upload)
+	if appErr != nil {
+		return nil, appErr
+	}
 
-	tableExists, appErrExists := h.repo.TableExists(ctx, suggestedTableName)
+	upload, appErr = h.uploads.Update(ctx, uploadID, func(session *models.UploadSession) {
+		session.Sheet = upload.Sheet
+		session.Dialect = upload.Dialect
+		session.Headers = headers
+		session.InferredColumnDefs = inferredDefs
+		session.Inference = inference
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	return h.buildPreview(ctx, upload, previewRows, schema)
+}
+
+// buildPreview assembles the preview of an upload session, looking up whether its suggested table already exists in
+// the target schema, which is the default schema when schema is empty
+func (h *AppHandlers) buildPreview(ctx context.Context, upload *models.UploadSession, previewRows [][]string, schema string) (*models.CSVPreview, *apperrors.AppError) {
+	schema, appErr := h.importer.ResolveSchema(ctx, schema)
+	if appErr != nil {
+		return nil, appErr
+	}
+	schemas, appErr := h.importer.Schemas(ctx)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	suggestedTableName := h.csvService.SanitizeTableName(upload.OriginalFilename)
+	suggestedTable := models.TableRef{Schema: schema, Name: suggestedTableName}
+
+	tableExists, appErrExists := h.repo.TableExists(ctx, suggestedTable)
 	if appErrExists != nil {
 		h.logger.Error(appErrExists)
 	}
 
-	var inferredDefs []models.ColumnDefinition
 	var actualDefs []models.ColumnDefinition
-
+	var mapping []models.ColumnMapping
+	var changes []models.SchemaChange
 	if tableExists {
 		var fetchErr *apperrors.AppError
-		actualDefs, fetchErr = h.repo.GetTableSchema(ctx, suggestedTableName)
+		actualDefs, fetchErr = h.repo.GetTableSchema(ctx, suggestedTable)
 		if fetchErr != nil {
-			h.logger.Error(fetchErr)
-			redirectWithFlash(w, r, "/", fmt.Sprintf("Error fetching schema for existing table '%s': %s", suggestedTableName, fetchErr.Message), true)
-			return
+			return nil, apperrors.Wrap(fetchErr, fetchErr, fmt.Sprintf("Error fetching schema for existing table '%s': %s", suggestedTable, fetchErr.Message))
 		}
-	} else {
-		inferredDefs = h.csvService.InferSchemaFromPreview(csvHeaders, previewRows)
+		mapping = h.csvService.AutoMapColumns(upload.Headers, actualDefs)
+		changes, _ = h.csvService.PlanSchemaEvolution(suggestedTable, upload.Headers, upload.InferredColumnDefs, upload.Inference, actualDefs, mapping)
 	}
 
-	allExistingTables, dbAppErr := h.repo.GetTableNames(ctx)
+	allExistingTables, dbAppErr := h.repo.GetTableNames(ctx, schema)
 	if dbAppErr != nil {
 		h.logger.Error(dbAppErr)
 	}
 
-	data := h.renderer.NewTemplateData(r)
-	data.Preview = &models.CSVPreview{
-		OriginalFilename:   handler.Filename,
-		TempFilePath:       tempFilePath,
-		Headers:            csvHeaders,
+	return &models.CSVPreview{
+		UploadID:           upload.ID,
+		OriginalFilename:   upload.OriginalFilename,
+		Format:             upload.Format,
+		Sheets:             upload.Sheets,
+		Sheet:              upload.Sheet,
+		Dialect:            upload.Dialect,
+		FileSize:           upload.FileSize,
+		FileChecksum:       upload.FileChecksum,
+		Headers:            upload.Headers,
 		PreviewRows:        previewRows,
+		Schema:             schema,
+		Schemas:            schemas,
 		SuggestedTable:     suggestedTableName,
 		ExistingTables:     allExistingTables,
 		TableExists:        tableExists,
-		InferredColumnDefs: inferredDefs,
+		InferredColumnDefs: upload.InferredColumnDefs,
+		Inference:          upload.Inference,
 		ActualColumnDefs:   actualDefs,
-	}
+		ColumnMapping:      mapping,
+		SchemaChanges:      changes,
+		AllowedActions:     services.AllowedActions(ctx, suggestedTable),
+	}, nil
+}
 
-	defaultAction := "create"
-	if tableExists {
-		defaultAction = "overwrite" // Sensible default for existing tables
+// dialectFromValues reads CSV dialect options from form or query values
+// Missing options default to a detected encoding, a sniffed delimiter and a header row
+func (h *AppHandlers) dialectFromValues(values url.Values) models.CSVDialect {
+	dialect := models.DefaultCSVDialect()
+	dialect.Encoding = values.Get("encoding")
+	dialect.Delimiter = values.Get("delimiter")
+	dialect.Comment = values.Get("comment")
+	dialect.LazyQuotes = formBool(values, "lazyQuotes", dialect.LazyQuotes)
+	dialect.TrimLeadingSpace = formBool(values, "trimLeadingSpace", dialect.TrimLeadingSpace)
+	dialect.HasHeader = formBool(values, "hasHeader", dialect.HasHeader)
+	return h.csvService.NormalizeDialect(dialect)
+}
+
+// dialectOverride returns the dialect options in values, or nil when none were given
+func (h *AppHandlers) dialectOverride(values url.Values) *models.CSVDialect {
+	for _, key := range []string{"encoding", "delimiter", "comment", "lazyQuotes", "trimLeadingSpace", "hasHeader"} {
+		if values.Has(key) {
+			dialect := h.dialectFromValues(values)
+			return &dialect
+		}
 	}
-	data.Form = &models.CommitRequest{TableName: suggestedTableName, Action: models.CommitAction(defaultAction)}
+	return nil
+}
 
-	h.renderer.Render(w, r, http.StatusOK, "preview.page.tmpl", data)
+// formBool parses a boolean form value such as a checkbox ("on"), returning def when it is missing or malformed
+// Only the first value counts, so a checkbox can be followed by a hidden "false" fallback for when it is unchecked
+func formBool(values url.Values, key string, def bool) bool {
+	switch strings.ToLower(values.Get(key)) {
+	case "on", "true", "1", "yes":
+		return true
+	case "off", "false", "0", "no":
+		return false
+	default:
+		return def
+	}
 }
 
-// CommitCSV handles committing the parsed spreadsheet
+// CommitCSV queues the commit of the parsed spreadsheet as a background job and sends the user to its status page
 func (h *AppHandlers) CommitCSV(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		h.renderer.MethodNotAllowed(w, r, http.MethodPost)
@@ -176,146 +358,154 @@ func (h *AppHandlers) CommitCSV(w http.ResponseWriter, r *http.Request) {
 	}
 
 	req := models.CommitRequest{
-		TempFilePath:     r.PostFormValue("tempFilePath"),
-		TableName:        h.csvService.SanitizeTableName(r.PostFormValue("tableName")),
-		Action:           models.CommitAction(r.PostFormValue("action")),
-		ColumnNames:      r.Form["columnNames"],
-		ColumnTypes:      r.Form["columnTypes"],
-		OriginalFilename: r.PostFormValue("originalFilename"),
+		UploadID:        r.PostFormValue("uploadId"),
+		Schema:          r.PostFormValue("schema"),
+		TableName:       h.csvService.SanitizeTableName(r.PostFormValue("tableName")),
+		Action:          models.CommitAction(r.PostFormValue("action")),
+		ColumnNames:     r.Form["columnNames"],
+		ColumnTypes:     r.Form["columnTypes"],
+		Sheet:           r.PostFormValue("sheet"),
+		EvolveSchema:    formBool(r.PostForm, "evolveSchema", false),
+		ValidateOnly:    formBool(r.PostForm, "validateOnly", false),
+		KeyColumns:      r.PostForm["keyColumns"],
+		SkipInvalidRows: formBool(r.PostForm, "skipInvalidRows", false),
+	}
+
+	var convErr error
+	req.Mapping, convErr = mappingFromForm(r.PostForm["mappingColumns"], r.PostForm["mappingSources"])
+	if v := r.PostFormValue("maxRejectedRows"); v != "" && convErr == nil {
+		req.MaxRejectedRows, convErr = strconv.ParseInt(v, 10, 64)
+	}
+	if v := r.PostFormValue("maxRejectedPercent"); v != "" && convErr == nil {
+		req.MaxRejectedPercent, convErr = strconv.ParseFloat(v, 64)
 	}
 
-	if req.TableName == "" || req.TempFilePath == "" {
+	if req.TableName == "" || req.UploadID == "" || convErr != nil {
 		h.logger.Errorf("Commit validation failed: %+v", req)
 		redirectWithFlash(w, r, "/", "Error: Invalid commit data. Missing fields or mismatched columns/types.", true)
 		return
 	}
-	defer os.Remove(req.TempFilePath)
 
-	var finalColumnDefs []models.ColumnDefinition
-	tableCurrentlyExists, appErrExists := h.repo.TableExists(ctx, req.TableName)
-	if appErrExists != nil {
-		h.logger.Error(appErrExists)
+	// Checked before the upload is claimed, so the user can go back to the preview and pick something they may do
+	if appErr := h.importer.AuthorizeCommit(ctx, req); appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrForbidden) && !apperrors.Is(appErr, apperrors.ErrInvalidInput) {
+			h.logger.Error(appErr)
+		}
+		redirectToPreview(w, r, req, appErr.Message)
+		return
 	}
 
-	if (req.Action == "overwrite" || req.Action == "append") && tableCurrentlyExists {
-		// For overwrite/append, always use the schema from the database
-		dbSchema, appErrSchema := h.repo.GetTableSchema(ctx, req.TableName)
-		if appErrSchema != nil {
-			h.logger.Error(appErrSchema)
-			redirectWithFlash(w, r, "/", fmt.Sprintf("Error: Could not retrieve schema for table '%s' to %s", req.TableName, req.Action), true)
-			return
-		}
-		finalColumnDefs = dbSchema
-	} else if req.Action == "create" {
-		if tableCurrentlyExists { // Trying to "create" a table that now exists (e.g., race or user error)
-			redirectWithFlash(w, r, "/", fmt.Sprintf("Error: Table '%s' already exists. Cannot 'Create'. Choose 'Overwrite' or 'Append'.", req.TableName), true)
-			return
-		}
-		if len(req.ColumnNames) == 0 || len(req.ColumnNames) != len(req.ColumnTypes) {
-			redirectWithFlash(w, r, "/", "Error: Column names and types mismatch or missing for create action.", true)
+	job, appErr := h.jobs.Submit(ctx, req)
+	if appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrNotFound) {
+			redirectWithFlash(w, r, "/", "Error: This upload was not found or has expired. Please upload the file again.", true)
 			return
 		}
-		finalColumnDefs = make([]models.ColumnDefinition, len(req.ColumnNames))
-		for i, rawColName := range req.ColumnNames {
-			sanitizedColName := h.csvService.SanitizeSQLName(rawColName)
-			if sanitizedColName == "" {
-				sanitizedColName = fmt.Sprintf("column_%d", i+1)
-			}
-			finalColumnDefs[i] = models.ColumnDefinition{Name: sanitizedColName, Type: req.ColumnTypes[i]}
-		}
-	} else {
-		// Handle invalid action/state combinations
-		errMsg := fmt.Sprintf("Error: Invalid action '%s' for table '%s'. Table existence: %t.", req.Action, req.TableName, tableCurrentlyExists)
-		if req.Action == "append" && !tableCurrentlyExists {
-			errMsg = fmt.Sprintf("Error: Cannot append to table '%s' because it does not exist. Choose 'Create'.", req.TableName)
+		if !apperrors.Is(appErr, apperrors.ErrUnavailable) {
+			h.logger.Error(appErr)
 		}
-		redirectWithFlash(w, r, "/", errMsg, true)
+		redirectToPreview(w, r, req, appErr.Message)
 		return
 	}
-
-	_, allRecords, appErr := h.csvService.ReadFullCSV(req.TempFilePath)
-	if appErr != nil {
-		h.logger.Error(appErr)
-		redirectWithFlash(w, r, "/", fmt.Sprintf("Error reading full CSV data: %s", appErr.Message), true)
+	if wantsJSON(r) {
+		// The preview page submits the form itself to follow the job's progress in place
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
 		return
 	}
+	http.Redirect(w, r, "/jobs/"+job.ID, http.StatusSeeOther)
+}
 
-	tx, err := h.repo.Beginx()
-	if err != nil {
-		h.renderer.ServerError(w, r, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to begin transaction"))
-		return
+// wantsJSON reports whether a page request asks for a JSON response rather than HTML
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// redirectToPreview sends the user back to the preview of a commit request's upload with an error message
+func redirectToPreview(w http.ResponseWriter, r *http.Request, req models.CommitRequest, message string) {
+	query := url.Values{"upload": {req.UploadID}, "schema": {req.Schema}, "sheet": {req.Sheet}, "flash": {"Error: " + message}}
+	http.Redirect(w, r, "/preview?"+query.Encode(), http.StatusSeeOther)
+}
+
+// mappingFromForm builds a column mapping from the preview form's parallel lists of table columns and sources
+// Each source is "source:<header>", "fill:null" or "fill:default"
+func mappingFromForm(columns, sources []string) ([]models.ColumnMapping, error) {
+	if len(columns) != len(sources) {
+		return nil, fmt.Errorf("got %d mapped columns but %d sources", len(columns), len(sources))
 	}
-	// Defer rollback. If Commit() is called, this is a no-op.
-	defer func() {
-		if p := recover(); p != nil {
-			tx.Rollback()
-			panic(p)
-		} else if err != nil { // Check if 'err' was set by operations below
-			tx.Rollback()
+	mapping := make([]models.ColumnMapping, len(columns))
+	for i, column := range columns {
+		mapping[i].Column = column
+		switch kind, value, _ := strings.Cut(sources[i], ":"); kind {
+		case "source":
+			mapping[i].Source = value
+		case "fill":
+			mapping[i].Fill = models.MappingFill(value)
+		default:
+			return nil, fmt.Errorf("invalid source '%s' for column '%s'", sources[i], column)
 		}
-	}()
+	}
+	return mapping, nil
+}
+
+// ImportResult renders the summary page of a commit that rejected rows, or of a validation
+// GET /results/{id}
+func (h *AppHandlers) ImportResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
 
-	tableExists, appErr := h.repo.TableExists(ctx, req.TableName)
+	result, appErr := h.uploads.GetResult(r.Context(), r.PathValue("id"))
 	if appErr != nil {
-		err = appErr // Set outer err for rollback
-		h.renderer.ServerError(w, r, appErr)
+		h.renderer.NotFound(w, r)
 		return
 	}
 
-	flashMessage := ""
-	var operationErr *apperrors.AppError
+	data := h.renderer.NewTemplateData(r)
+	data.Result = result
+	h.renderer.Render(w, r, http.StatusOK, "result.page.tmpl", data)
+}
 
-	if tableExists {
-		switch req.Action {
-		case "overwrite":
-			if operationErr = h.repo.DropTable(ctx, tx, req.TableName); operationErr == nil {
-				operationErr = h.repo.CreateTable(ctx, tx, req.TableName, finalColumnDefs)
-			}
-			if operationErr == nil {
-				flashMessage = fmt.Sprintf("Success: Table '%s' overwritten.", req.TableName)
-			}
-		case "append":
-			flashMessage = fmt.Sprintf("Success: Data appended to table '%s'.", req.TableName)
-		case "create":
-			operationErr = apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Table '%s' already exists. Choose 'Overwrite' or 'Append'.", req.TableName))
-		default:
-			operationErr = apperrors.New("invalid_action", "Invalid action specified.")
-		}
-	} else { // Table does not exist
-		if req.Action == "append" {
-			operationErr = apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Cannot append. Table '%s' does not exist. Choose 'Create'.", req.TableName))
-		} else { // create or overwrite (implies create due to table not existing already)
-			operationErr = h.repo.CreateTable(ctx, tx, req.TableName, finalColumnDefs)
-			if operationErr == nil {
-				flashMessage = fmt.Sprintf("Success: Table '%s' created.", req.TableName)
-			}
-		}
+// DownloadRejects serves the rejected rows of a commit as a CSV attachment
+// GET /results/{id}/rejects.csv
+func (h *AppHandlers) DownloadRejects(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
 	}
 
-	if operationErr != nil {
-		err = operationErr // Set outer err for rollback
-		if apperrors.Is(operationErr, apperrors.ErrDataConflict) || operationErr.Code == "invalid_action" {
-			redirectWithFlash(w, r, "/", "Error: "+operationErr.Message, true)
-		} else {
-			h.renderer.ServerError(w, r, operationErr)
-		}
+	result, appErr := h.uploads.GetResult(r.Context(), r.PathValue("id"))
+	if appErr != nil || result.RejectFile == "" {
+		h.renderer.NotFound(w, r)
 		return
 	}
+	if err := serveRejectFile(w, r, result); err != nil {
+		h.renderer.ServerError(w, r, err)
+	}
+}
 
-	if operationErr = h.repo.InsertData(ctx, tx, req.TableName, finalColumnDefs, allRecords); operationErr != nil {
-		err = operationErr // Set outer err for rollback
-		h.logger.Error(operationErr)
-		detailedMsg := fmt.Sprintf("Error inserting data into '%s': %s", req.TableName, operationErr.Message)
-		redirectWithFlash(w, r, "/", detailedMsg, true)
-		return
+// serveRejectFile streams a result's reject file as a CSV attachment named after the target table
+// An error is only returned before anything has been written to w
+// Large reject files can take longer to send than the server's write timeout, so the deadline is cleared when the
+// response writer allows it
+func serveRejectFile(w http.ResponseWriter, r *http.Request, result *models.CommitResult) error {
+	file, err := os.Open(result.RejectFile)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	if err = tx.Commit(); err != nil { // This is the final commit error
-		h.renderer.ServerError(w, r, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to commit transaction"))
-		return
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
 
-	redirectWithFlash(w, r, "/", flashMessage, false)
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s_rejects.csv"`, result.TableName))
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
 }
 
 // HealthCheckHandler provides a route for services to check the state of the server
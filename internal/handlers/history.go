@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// Page sizes of the import history
+const (
+	DefaultHistoryLimit = 50
+	MaxHistoryLimit     = 500
+)
+
+// History renders the import history, filtered by the query parameters accepted by historyFilterFromQuery
+// GET /history
+func (h *AppHandlers) History(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	data := h.renderer.NewTemplateData(r)
+	filter, appErr := historyFilterFromQuery(r.URL.Query())
+	if appErr == nil {
+		data.History, appErr = h.historyPage(r, filter)
+	}
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrInvalidInput) {
+			h.logger.Error(appErr)
+		}
+		data.Flash = "Error: " + appErr.Message
+		data.History = &models.HistoryPage{Records: []models.ImportRecord{}, Limit: filter.Limit, Filter: filter}
+	}
+
+	h.renderer.Render(w, r, http.StatusOK, "history.page.tmpl", data)
+}
+
+// APIHistory lists the import history, newest first, filtered by the query parameters accepted by
+// historyFilterFromQuery
+// GET /api/v1/history
+func (h *AppHandlers) APIHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	filter, appErr := historyFilterFromQuery(r.URL.Query())
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	page, appErr := h.historyPage(r, filter)
+	if appErr != nil {
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+// UndoImport undoes an import from the import history and returns to the history page
+// POST /history/{id}/undo
+func (h *AppHandlers) UndoImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderer.MethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		h.renderer.NotFound(w, r)
+		return
+	}
+
+	result, appErr := h.importer.Undo(r.Context(), id, currentUsername(r))
+	if appErr != nil {
+		h.logger.Error(appErr)
+		redirectWithFlash(w, r, "/history", appErr.Message, true)
+		return
+	}
+	redirectWithFlash(w, r, "/history", result.Message, false)
+}
+
+// APIUndoImport undoes an import from the import history: an overwrite is restored from its backup table and the rows
+// loaded by an append are deleted
+// POST /api/v1/history/{id}/undo
+func (h *AppHandlers) APIUndoImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, apperrors.Wrap(err, apperrors.ErrNotFound, fmt.Sprintf("Import '%s' does not exist.", r.PathValue("id"))))
+		return
+	}
+
+	result, appErr := h.importer.Undo(r.Context(), id, currentUsername(r))
+	if appErr != nil {
+		h.logger.Error(appErr)
+		writeAPIAppError(w, appErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// historyPage fetches the page of the import history selected by the filter
+func (h *AppHandlers) historyPage(r *http.Request, filter models.HistoryFilter) (*models.HistoryPage, *apperrors.AppError) {
+	records, total, appErr := h.repo.ListImportHistory(r.Context(), filter)
+	if appErr != nil {
+		return nil, apperrors.Wrap(appErr, appErr, fmt.Sprintf("Could not load the import history: %s", appErr.Message))
+	}
+	return &models.HistoryPage{Records: records, Total: total, Limit: filter.Limit, Offset: filter.Offset, Filter: filter}, nil
+}
+
+// historyFilterFromQuery reads an import history filter from the query parameters schema, table, action, status, user,
+// filename (matched as a substring), from and to (inclusive YYYY-MM-DD dates), limit and offset
+// The returned filter always carries a valid limit, even alongside an error
+func historyFilterFromQuery(query url.Values) (models.HistoryFilter, *apperrors.AppError) {
+	filter := models.HistoryFilter{
+		Schema:    strings.TrimSpace(query.Get("schema")),
+		TableName: strings.TrimSpace(query.Get("table")),
+		Action:    models.CommitAction(query.Get("action")),
+		Status:    models.ImportStatus(query.Get("status")),
+		User:      strings.TrimSpace(query.Get("user")),
+		Filename:  strings.TrimSpace(query.Get("filename")),
+		Limit:     DefaultHistoryLimit,
+	}
+
+	switch filter.Action {
+	case "", models.ActionCreate, models.ActionOverwrite, models.ActionAppend, models.ActionUpsert:
+	default:
+		return filter, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid action '%s'.", filter.Action))
+	}
+	switch filter.Status {
+	case "", models.ImportCommitted, models.ImportFailed:
+	default:
+		return filter, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid status '%s'; use '%s' or '%s'.", filter.Status, models.ImportCommitted, models.ImportFailed))
+	}
+
+	var err error
+	dates := []struct {
+		key  string
+		date *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}}
+	for _, d := range dates {
+		if v := query.Get(d.key); v != "" {
+			if *d.date, err = time.Parse(time.DateOnly, v); err != nil {
+				return filter, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid '%s' date '%s'; use YYYY-MM-DD.", d.key, v))
+			}
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 1 || filter.Limit > MaxHistoryLimit {
+			filter.Limit = DefaultHistoryLimit
+			return filter, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid limit '%s'; use 1 to %d.", v, MaxHistoryLimit))
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if filter.Offset, err = strconv.Atoi(v); err != nil || filter.Offset < 0 {
+			filter.Offset = 0
+			return filter, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid offset '%s'.", v))
+		}
+	}
+	return filter, nil
+}
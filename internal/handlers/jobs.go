@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// eventKeepAlive is how often an idle event stream is sent a comment, so proxies do not close it
+const eventKeepAlive = 15 * time.Second
+
+// ImportJob renders the status page of an import job: its phase, the rows processed so far, its rate, the rows it
+// rejected and, once finished, its outcome. The page reloads itself while the job runs
+// GET /jobs/{id}
+func (h *AppHandlers) ImportJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	job, appErr := h.jobs.Get(r.Context(), r.PathValue("id"))
+	if appErr != nil {
+		h.renderer.NotFound(w, r)
+		return
+	}
+
+	data := h.renderer.NewTemplateData(r)
+	data.Flash = r.URL.Query().Get("flash")
+	data.Job = job
+	h.renderer.Render(w, r, http.StatusOK, "job.page.tmpl", data)
+}
+
+// CancelJob cancels a queued or running import job, rolling its import back
+// POST /jobs/{id}/cancel
+func (h *AppHandlers) CancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		h.renderer.MethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	id := r.PathValue("id")
+	if _, appErr := h.jobs.Cancel(r.Context(), id); appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrNotFound) {
+			h.renderer.NotFound(w, r)
+			return
+		}
+		redirectWithFlash(w, r, "/jobs/"+id, appErr.Message, true)
+		return
+	}
+	redirectWithFlash(w, r, "/jobs/"+id, "Cancelling the import; it will be rolled back.", false)
+}
+
+// APIJob returns an import job: its status, phase, rows processed, rate, rejected rows and, once finished, its result
+// or error
+// GET /api/v1/jobs/{id}
+func (h *AppHandlers) APIJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	job, appErr := h.jobs.Get(r.Context(), r.PathValue("id"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// APIJobEvents streams the progress of an import job as Server-Sent Events until it finishes: "progress" events carry
+// the job without its row errors, "warning" events a rejected row, and a final "done" event the whole job
+// The current progress and the rows rejected so far are sent first
+// GET /api/v1/jobs/{id}/events
+func (h *AppHandlers) APIJobEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	job, events, unsubscribe, appErr := h.jobs.Subscribe(r.Context(), r.PathValue("id"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	defer unsubscribe()
+
+	// The stream lasts as long as the import, well past the server's write timeout
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Errorf("Failed to clear the write deadline of an event stream: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Stops nginx from buffering the stream
+	w.WriteHeader(http.StatusOK)
+
+	rowErrors := job.RowErrors
+	job.RowErrors = nil
+	if err := writeEvent(rc, w, models.JobEventProgress, job); err != nil {
+		return
+	}
+	for _, rowErr := range rowErrors {
+		if err := writeEvent(rc, w, models.JobEventWarning, rowErr); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case event, ok := <-events:
+			if !ok {
+				if job, appErr := h.jobs.Get(r.Context(), job.ID); appErr == nil {
+					writeEvent(rc, w, models.JobEventDone, job)
+				}
+				return
+			}
+			var data any = event.Job
+			if event.Type == models.JobEventWarning {
+				data = event.Warning
+			}
+			if err := writeEvent(rc, w, event.Type, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes a Server-Sent Event with data encoded as JSON, and flushes it to the client
+func writeEvent(rc *http.ResponseController, w http.ResponseWriter, event models.JobEventType, data any) error {
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, body); err != nil {
+		return err
+	}
+	return rc.Flush()
+}
+
+// APICancelJob cancels a queued or running import job, rolling its import back, and returns the job
+// GET /api/v1/jobs/{id} tells when it has stopped
+// POST /api/v1/jobs/{id}/cancel
+func (h *AppHandlers) APICancelJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	job, appErr := h.jobs.Cancel(r.Context(), r.PathValue("id"))
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
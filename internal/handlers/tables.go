@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// Page sizes of the table browser
+const (
+	DefaultTableRowsLimit = 50
+	MaxTableRowsLimit     = 500
+)
+
+// TableBrowser renders the columns, row count and a page of rows of a table, selected by the query parameters
+// accepted by tableQueryFromQuery
+// GET /tables/{name}
+func (h *AppHandlers) TableBrowser(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	page, appErr := h.tablePage(r)
+	if appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrNotFound) {
+			h.renderer.NotFound(w, r)
+			return
+		}
+		if !apperrors.Is(appErr, apperrors.ErrInvalidInput) {
+			h.logger.Error(appErr)
+		}
+		redirectWithFlash(w, r, "/", appErr.Message, true)
+		return
+	}
+
+	data := h.renderer.NewTemplateData(r)
+	data.Table = page
+	h.renderer.Render(w, r, http.StatusOK, "table.page.tmpl", data)
+}
+
+// ExportTable downloads the rows of a table selected by the sort and filter query parameters as CSV
+// GET /tables/{name}/export.csv
+func (h *AppHandlers) ExportTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		h.renderer.MethodNotAllowed(w, r, http.MethodGet)
+		return
+	}
+
+	table, columns, q, appErr := h.browseRequest(r)
+	switch {
+	case appErr == nil:
+	case apperrors.Is(appErr, apperrors.ErrNotFound):
+		h.renderer.NotFound(w, r)
+		return
+	case apperrors.Is(appErr, apperrors.ErrInvalidInput):
+		h.renderer.ClientError(w, r, http.StatusBadRequest, appErr.Message)
+		return
+	default:
+		h.renderer.ServerError(w, r, appErr)
+		return
+	}
+	h.exportTable(w, r, table, columns, q)
+}
+
+// APITableRows returns the columns, row count and a page of rows of a table, selected by the query parameters
+// accepted by tableQueryFromQuery. Values are strings in PostgreSQL's text format, or null
+// GET /api/v1/tables/{name}/rows
+func (h *AppHandlers) APITableRows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	page, appErr := h.tablePage(r)
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) && !apperrors.Is(appErr, apperrors.ErrInvalidInput) {
+			h.logger.Error(appErr)
+		}
+		writeAPIAppError(w, appErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// APIExportTable downloads the rows of a table selected by the sort and filter query parameters as CSV
+// GET /api/v1/tables/{name}/export
+func (h *AppHandlers) APIExportTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	table, columns, q, appErr := h.browseRequest(r)
+	if appErr != nil {
+		writeAPIAppError(w, appErr)
+		return
+	}
+	h.exportTable(w, r, table, columns, q)
+}
+
+// tablePage fetches the page of a table's rows selected by the request
+func (h *AppHandlers) tablePage(r *http.Request) (*models.TablePage, *apperrors.AppError) {
+	table, columns, q, appErr := h.browseRequest(r)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	page := &models.TablePage{Table: table, Columns: columns, Limit: q.Limit, Offset: q.Offset, Query: q}
+	page.RowCount, page.Total, appErr = h.repo.CountTableRows(r.Context(), table, columns, q)
+	if appErr != nil {
+		return nil, appErr
+	}
+	page.Rows, appErr = h.repo.ListTableRows(r.Context(), table, columns, q)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return page, nil
+}
+
+// browseRequest reads the table a table browser request refers to, looks up its columns and checks the query's sort
+// and filter columns against them
+func (h *AppHandlers) browseRequest(r *http.Request) (models.TableRef, []models.ColumnDefinition, models.TableQuery, *apperrors.AppError) {
+	query := r.URL.Query()
+	q, appErr := tableQueryFromQuery(query)
+	if appErr != nil {
+		return models.TableRef{}, nil, q, appErr
+	}
+
+	schema, appErr := h.importer.ResolveSchema(r.Context(), query.Get("schema"))
+	if appErr != nil {
+		return models.TableRef{}, nil, q, appErr
+	}
+	table := models.TableRef{Schema: schema, Name: r.PathValue("name")}
+	columns, appErr := h.repo.GetTableSchema(r.Context(), table)
+	if appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrNotFound) {
+			return table, nil, q, apperrors.Wrap(appErr, apperrors.ErrNotFound, fmt.Sprintf("Table '%s' does not exist.", table))
+		}
+		return table, nil, q, appErr
+	}
+
+	hasColumn := func(name string) bool {
+		return slices.ContainsFunc(columns, func(col models.ColumnDefinition) bool { return col.Name == name })
+	}
+	if q.Sort != "" && !hasColumn(q.Sort) {
+		return table, columns, q, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Cannot sort by '%s': table '%s' has no such column.", q.Sort, table))
+	}
+	if q.FilterColumn != "" && !hasColumn(q.FilterColumn) {
+		return table, columns, q, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Cannot filter on '%s': table '%s' has no such column.", q.FilterColumn, table))
+	}
+	return table, columns, q, nil
+}
+
+// exportTable streams the rows of a table selected by the query to w as a CSV attachment with a header row
+// lib/pq cannot read COPY ... TO STDOUT, so the rows are streamed from a query instead; NULLs become empty fields
+// Once the first row is written an error can no longer change the response, so it is only logged
+func (h *AppHandlers) exportTable(w http.ResponseWriter, r *http.Request, table models.TableRef, columns []models.ColumnDefinition, q models.TableQuery) {
+	// Large tables take longer to stream than the server's write timeout allows, which would truncate the export
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+		h.logger.Errorf("Failed to clear the write deadline of the export of table '%s': %v", table, err)
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, table.Name))
+
+	writer := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Name
+	}
+	writer.Write(header)
+
+	record := make([]string, len(columns))
+	appErr := h.repo.StreamTableRows(r.Context(), table, columns, q, func(row []*string) error {
+		for i, value := range row {
+			record[i] = ""
+			if value != nil {
+				record[i] = *value
+			}
+		}
+		return writer.Write(record)
+	})
+	writer.Flush()
+	if appErr == nil && writer.Error() != nil {
+		appErr = apperrors.Wrap(writer.Error(), apperrors.ErrFileOperation, fmt.Sprintf("failed to write the export of table '%s'", table))
+	}
+	if appErr != nil {
+		h.logger.Error(appErr)
+	}
+}
+
+// tableQueryFromQuery reads the rows to show from the query parameters sort (a column), dir (asc or desc), q (matched
+// as a substring), column (the column q applies to; every column when empty), limit and offset
+// The returned query always carries a valid limit, even alongside an error
+func tableQueryFromQuery(query url.Values) (models.TableQuery, *apperrors.AppError) {
+	q := models.TableQuery{
+		Sort:         query.Get("sort"),
+		FilterColumn: query.Get("column"),
+		Filter:       strings.TrimSpace(query.Get("q")),
+		Limit:        DefaultTableRowsLimit,
+	}
+
+	switch dir := strings.ToLower(query.Get("dir")); dir {
+	case "", "asc":
+	case "desc":
+		q.Desc = true
+	default:
+		return q, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid sort direction '%s'; use 'asc' or 'desc'.", dir))
+	}
+
+	var err error
+	if v := query.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > MaxTableRowsLimit {
+			q.Limit = DefaultTableRowsLimit
+			return q, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid limit '%s'; use 1 to %d.", v, MaxTableRowsLimit))
+		}
+	}
+	if v := query.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			q.Offset = 0
+			return q, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid offset '%s'.", v))
+		}
+	}
+	return q, nil
+}
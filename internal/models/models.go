@@ -1,46 +1,672 @@
 package models
 
+import (
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// CommitAction is how an upload is applied to its target table
 type CommitAction string
 
 const (
-	create    CommitAction = "create"
-	overwrite CommitAction = "overwrite"
-	append    CommitAction = "append"
+	ActionCreate    CommitAction = "create"
+	ActionOverwrite CommitAction = "overwrite"
+	ActionAppend    CommitAction = "append"
+	ActionUpsert    CommitAction = "upsert" // Insert new rows and update rows whose key columns match an existing row
 )
 
+// CommitActions lists every commit action
+var CommitActions = []CommitAction{ActionCreate, ActionOverwrite, ActionAppend, ActionUpsert}
+
+// DefaultSchema is the schema tables are imported into unless another one is chosen
+const DefaultSchema = "public"
+
+// TableRef identifies a table by its schema and name
+type TableRef struct {
+	Schema string `json:"schema"`
+	Name   string `json:"name"`
+}
+
+// String returns the schema-qualified name of the table, unquoted, for messages
+func (t TableRef) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// URL returns the address of the table's page in the table browser
+func (t TableRef) URL() string {
+	return "/tables/" + url.PathEscape(t.Name) + "?" + url.Values{"schema": {t.Schema}}.Encode()
+}
+
 // ColumnDefinition describes a column in a table
 type ColumnDefinition struct {
 	Name string `db:"column_name" json:"name"`
 	Type string `db:"data_type" json:"type"`
 }
 
+// MappingFill is how a table column that has no source in the upload is filled
+type MappingFill string
+
+const (
+	FillNull    MappingFill = "null"    // Load NULL into the column
+	FillDefault MappingFill = "default" // Leave the column out of the load so PostgreSQL applies its default
+)
+
+// ColumnMapping maps a column of an existing table to the upload column its values are read from
+type ColumnMapping struct {
+	Column string      `json:"column"`           // Target table column
+	Source string      `json:"source,omitempty"` // Upload header the values are read from
+	Fill   MappingFill `json:"fill,omitempty"`   // How the column is filled when it has no source
+}
+
+// SchemaChangeAction is the kind of change schema evolution makes to an existing table
+type SchemaChangeAction string
+
+const (
+	SchemaAddColumn SchemaChangeAction = "add_column" // A file column the table does not have
+	SchemaAlterType SchemaChangeAction = "alter_type" // A column whose new values need a wider type
+)
+
+// SchemaChange is one ALTER TABLE statement proposed by schema evolution
+type SchemaChange struct {
+	Action    SchemaChangeAction `json:"action"`
+	Column    string             `json:"column"`
+	Source    string             `json:"source,omitempty"`   // File column the change was derived from
+	FromType  string             `json:"fromType,omitempty"` // Current type, for alter_type
+	ToType    string             `json:"toType"`
+	Statement string             `json:"statement"` // The SQL that is run
+}
+
+// ColumnTypeOption is a column type offered when defining a new table
+type ColumnTypeOption struct {
+	Value string // Application type, as stored in ColumnDefinition.Type
+	Label string
+}
+
+// ColumnTypes lists the application column types in the order they are offered
+// NUMERIC may also carry a precision and scale, e.g. "NUMERIC(12,2)"
+var ColumnTypes = []ColumnTypeOption{
+	{"TEXT", "TEXT"},
+	{"INTEGER", "INTEGER (32-bit)"},
+	{"BIGINT", "BIGINT (64-bit)"},
+	{"NUMERIC", "NUMERIC (Exact Decimal)"},
+	{"REAL", "REAL (Floating Point)"},
+	{"BOOLEAN", "BOOLEAN (true/false, 1/0)"},
+	{"DATE", "DATE (YYYY-MM-DD)"},
+	{"TIMESTAMP", "TIMESTAMP"},
+	{"TIMESTAMPTZ", "TIMESTAMPTZ (With Time Zone)"},
+	{"TIME", "TIME (Time of Day)"},
+	{"INTERVAL", "INTERVAL (Duration)"},
+	{"UUID", "UUID"},
+	{"JSONB", "JSONB"},
+}
+
+// ColumnStats summarizes the values of one column of an upload
+type ColumnStats struct {
+	Name         string   `json:"name"`
+	NullCount    int64    `json:"nullCount"` // Empty values, which are loaded as NULL
+	NonNullCount int64    `json:"nonNullCount"`
+	Min          *float64 `json:"min,omitempty"` // Set only when every non-null value is numeric
+	Max          *float64 `json:"max,omitempty"`
+	MaxLength    int      `json:"maxLength"` // Longest value, in characters
+}
+
+// SchemaInference describes how an upload's column types were inferred
+type SchemaInference struct {
+	Stats       []ColumnStats `json:"stats"`             // Per-column statistics over every scanned row
+	RowsScanned int64         `json:"rowsScanned"`       // Data rows read from the file
+	RowsSampled int64         `json:"rowsSampled"`       // Data rows the column types were inferred from
+	Complete    bool          `json:"complete"`          // The whole file was scanned
+	Warning     string        `json:"warning,omitempty"` // Why the scan stopped early, if it was cut short by an error
+}
+
+// CSVDialect describes how a delimited text upload is parsed
+type CSVDialect struct {
+	Delimiter        string `json:"delimiter"`        // Single character; empty means sniff it from the file
+	LazyQuotes       bool   `json:"lazyQuotes"`       // Tolerate bare and unescaped quotes inside fields
+	Comment          string `json:"comment"`          // Lines starting with this character are skipped; empty disables comments
+	TrimLeadingSpace bool   `json:"trimLeadingSpace"` // Ignore leading white space in fields
+	HasHeader        bool   `json:"hasHeader"`        // First row holds the column names; otherwise names are generated
+	Detected         bool   `json:"detected"`         // Delimiter was sniffed from the file rather than chosen
+	Encoding         string `json:"encoding"`         // Text encoding transcoded to UTF-8 before parsing; empty means detect it
+	EncodingDetected bool   `json:"encodingDetected"` // Encoding was detected from the file rather than chosen
+}
+
+// DefaultCSVDialect is the dialect used when no options are given: a detected encoding, a sniffed delimiter and a header row
+func DefaultCSVDialect() CSVDialect {
+	return CSVDialect{HasHeader: true}
+}
+
+// DelimiterLabel returns a human-readable name for the dialect's delimiter
+func (d CSVDialect) DelimiterLabel() string {
+	switch d.Delimiter {
+	case "":
+		return "Auto-detect"
+	case ",":
+		return "Comma (,)"
+	case ";":
+		return "Semicolon (;)"
+	case "\t":
+		return "Tab"
+	case "|":
+		return "Pipe (|)"
+	case " ":
+		return "Space"
+	default:
+		return d.Delimiter
+	}
+}
+
 // CSVPreview holds data for the preview page
 type CSVPreview struct {
 	OriginalFilename   string             `json:"originalFilename"`
-	TempFilePath       string             `json:"tempFilePath"`
+	UploadID           string             `json:"uploadId"`
+	Format             string             `json:"format"`           // "csv" or "xlsx"
+	Sheets             []string           `json:"sheets,omitempty"` // Worksheet names, for workbooks only
+	Sheet              string             `json:"sheet,omitempty"`  // Worksheet the preview was read from
+	Schema             string             `json:"schema"`           // Schema the suggested table is looked up in
+	Schemas            []string           `json:"schemas"`          // Schemas that can be imported into
+	Dialect            CSVDialect         `json:"dialect"`          // Parsing options in effect; only the header toggle applies to workbooks
+	FileSize           int64              `json:"fileSize"`
+	FileChecksum       string             `json:"fileChecksum"` // Hex-encoded SHA-256 of the spooled upload
 	Headers            []string           `json:"headers"`
 	PreviewRows        [][]string         `json:"previewRows"`
 	ExistingTables     []string           `json:"existingTables"`
 	SuggestedTable     string             `json:"suggestedTable"`
 	TableExists        bool               `json:"tableExists"`
 	InferredColumnDefs []ColumnDefinition `json:"inferredColumnDefs"`
+	Inference          *SchemaInference   `json:"inference,omitempty"`
 	ActualColumnDefs   []ColumnDefinition `json:"actualColumnDefs"`
+	ColumnMapping      []ColumnMapping    `json:"columnMapping,omitempty"` // Suggested mapping onto the existing table
+	SchemaChanges      []SchemaChange     `json:"schemaChanges,omitempty"` // Changes an append with EvolveSchema would make
+	AllowedActions     []CommitAction     `json:"allowedActions"`          // Actions the user may run on the suggested table
+}
+
+// Allows reports whether the user may run action on the suggested table
+func (p *CSVPreview) Allows(action CommitAction) bool {
+	return slices.Contains(p.AllowedActions, action)
 }
 
 // CommitRequest is what's sent from the preview page to commit
 type CommitRequest struct {
-	TempFilePath     string       `form:"tempFilePath"`
-	TableName        string       `form:"tableName"`
-	Action           CommitAction `form:"action"`
-	ColumnNames      []string     `form:"columnNames"`
-	ColumnTypes      []string     `form:"columnTypes"`
-	OriginalFilename string       `form:"originalFilename"`
+	UploadID    string       `form:"uploadId" json:"uploadId"`
+	TableName   string       `form:"tableName" json:"tableName"`
+	Action      CommitAction `form:"action" json:"action"`
+	ColumnNames []string     `form:"columnNames" json:"columnNames"`
+	ColumnTypes []string     `form:"columnTypes" json:"columnTypes"`
+	Sheet       string       `form:"sheet" json:"sheet,omitempty"`   // Overrides the upload's selected worksheet
+	Schema      string       `form:"schema" json:"schema,omitempty"` // Schema of the table; defaults to the configured default schema
+
+	// For overwrite and append: where each table column's values come from. Table columns left out of the mapping
+	// are filled with their default. When empty, headers are matched to table columns by name
+	Mapping []ColumnMapping `json:"mapping,omitempty"`
+
+	// For append: add file columns the table does not have and widen column types that cannot hold the new values,
+	// in the same transaction as the insert. File columns that no table column is mapped from become new columns
+	EvolveSchema bool `form:"evolveSchema" json:"evolveSchema,omitempty"`
+
+	// Run the whole import, including its DDL and every conversion, in a transaction that is always rolled back,
+	// and report what would happen. Every row that would be rejected is reported, whatever the limits below
+	ValidateOnly bool `form:"validateOnly" json:"validateOnly,omitempty"`
+
+	// For upsert: the table columns identifying a row. A unique index on them is created if the table has none
+	KeyColumns []string `form:"keyColumns" json:"keyColumns,omitempty"`
+
+	// Error tolerance: when SkipInvalidRows is set, rows that fail conversion are skipped and reported instead of
+	// aborting the import. The import is still rolled back if more rows than either limit are rejected (0 = no limit)
+	SkipInvalidRows    bool    `form:"skipInvalidRows" json:"skipInvalidRows,omitempty"`
+	MaxRejectedRows    int64   `form:"maxRejectedRows" json:"maxRejectedRows,omitempty"`
+	MaxRejectedPercent float64 `form:"maxRejectedPercent" json:"maxRejectedPercent,omitempty"`
+}
+
+// WatchRule routes the files dropped into the watched directory whose names match Pattern to a table
+type WatchRule struct {
+	Pattern     string            `json:"pattern"`               // Glob matched against the file name, as by filepath.Match
+	TableName   string            `json:"tableName,omitempty"`   // Defaults to a name derived from the file name
+	Schema      string            `json:"schema,omitempty"`      // Defaults to the configured default schema
+	Action      CommitAction      `json:"action"`                // create, overwrite, append or upsert
+	Sheet       string            `json:"sheet,omitempty"`       // Worksheet of .xlsx files; defaults to the first one
+	ColumnTypes map[string]string `json:"columnTypes,omitempty"` // Overrides inferred types, by header or column name
+
+	// CSV dialect; unset fields are detected from the file
+	Encoding         string `json:"encoding,omitempty"`
+	Delimiter        string `json:"delimiter,omitempty"`
+	Comment          string `json:"comment,omitempty"`
+	LazyQuotes       bool   `json:"lazyQuotes,omitempty"`
+	TrimLeadingSpace bool   `json:"trimLeadingSpace,omitempty"`
+	NoHeader         bool   `json:"noHeader,omitempty"`
+
+	// As in CommitRequest
+	KeyColumns         []string `json:"keyColumns,omitempty"`
+	EvolveSchema       bool     `json:"evolveSchema,omitempty"`
+	SkipInvalidRows    bool     `json:"skipInvalidRows,omitempty"`
+	MaxRejectedRows    int64    `json:"maxRejectedRows,omitempty"`
+	MaxRejectedPercent float64  `json:"maxRejectedPercent,omitempty"`
+}
+
+// WatchOutcome is the result of importing a file from the watched directory, written next to the file once it is
+// moved out of the way
+type WatchOutcome struct {
+	File       string        `json:"file"`               // Name the file was dropped with
+	Rule       string        `json:"rule"`               // Pattern of the rule it matched
+	Checksum   string        `json:"checksum,omitempty"` // SHA-256 of the file
+	Succeeded  bool          `json:"succeeded"`          // Whether it was moved to processed/ rather than failed/
+	StartedAt  time.Time     `json:"startedAt"`
+	FinishedAt time.Time     `json:"finishedAt"`
+	Result     *CommitResult `json:"result,omitempty"`
+	RejectFile string        `json:"rejectFile,omitempty"` // Name of the CSV of rejected rows kept next to the file
+	Error      string        `json:"error,omitempty"`
+	ErrorCode  string        `json:"errorCode,omitempty"`
+}
+
+// RowError describes a row that was rejected during an import
+type RowError struct {
+	Row    int64  `json:"row"`              // 1-indexed data row number, not counting the header row
+	Column string `json:"column,omitempty"` // Column whose value failed, if the error is about a single value
+	Value  string `json:"value,omitempty"`  // Raw value that failed
+	Reason string `json:"reason"`
+}
+
+// ColumnErrorCount is how many rows were rejected because of one column
+type ColumnErrorCount struct {
+	Column string `json:"column"` // Empty for rows rejected as a whole, e.g. for having the wrong number of values
+	Count  int64  `json:"count"`
+}
+
+// CommitResult summarizes a completed import
+type CommitResult struct {
+	ID            string             `json:"id,omitempty"` // Set when the result is kept for its summary page and reject file
+	Schema        string             `json:"schema"`
+	TableName     string             `json:"tableName"`
+	Action        CommitAction       `json:"action"`
+	Committed     bool               `json:"committed"`
+	RowsImported  int64              `json:"rowsImported"`
+	RowsInserted  int64              `json:"rowsInserted"` // Equal to RowsImported, except for upserts
+	RowsUpdated   int64              `json:"rowsUpdated"`  // Existing rows changed by an upsert
+	RowsRejected  int64              `json:"rowsRejected"`
+	RowErrors     []RowError         `json:"rowErrors,omitempty"`     // The first rejected rows; the reject file has all of them
+	ColumnErrors  []ColumnErrorCount `json:"columnErrors,omitempty"`  // Rejected rows per column
+	SchemaChanges []SchemaChange     `json:"schemaChanges,omitempty"` // Applied by schema evolution
+	Statements    []string           `json:"statements,omitempty"`    // DDL run by the import, or that would run when validating
+	ValidateOnly  bool               `json:"validateOnly,omitempty"`  // Nothing was committed; the result reports what would happen
+	UploadID      string             `json:"uploadId,omitempty"`      // Upload that was validated, which can still be committed
+	BatchID       string             `json:"batchId,omitempty"`       // Tags the appended rows so the append can be undone
+	BackupTable   string             `json:"backupTable,omitempty"`   // Where an overwrite kept the table it replaced
+	Message       string             `json:"message"`
+	RejectFile    string             `json:"-"` // Temp file holding the rejected rows as CSV
+	User          string             `json:"-"` // Who ran the import, when the result is kept; empty without authentication
+	ExpiresAt     time.Time          `json:"-"`
+}
+
+// ImportPhase is the step a running import is at
+type ImportPhase string
+
+const (
+	PhaseQueued     ImportPhase = "queued"     // Waiting for a free worker
+	PhasePreparing  ImportPhase = "preparing"  // Checking the file and the target table, and running DDL
+	PhaseLoading    ImportPhase = "loading"    // Streaming rows into the database
+	PhaseCommitting ImportPhase = "committing" // Merging upserted rows and committing the transaction
+	PhaseDone       ImportPhase = "done"
+)
+
+// ImportProgress is how far an import has got
+type ImportProgress struct {
+	Phase        ImportPhase `json:"phase"`
+	RowsRead     int64       `json:"rowsRead"`            // Data rows read from the file
+	RowsTotal    int64       `json:"rowsTotal,omitempty"` // Data rows in the file, when the preview scanned all of them
+	RowsLoaded   int64       `json:"rowsLoaded"`          // Rows sent to the database, only kept if the import commits
+	RowsRejected int64       `json:"rowsRejected"`
+	Batch        int64       `json:"batch"` // Batches of rows read so far, the last one possibly partial
+}
+
+// JobStatus is the state of an import job
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// ImportJob is a commit run in the background, with its progress and, once finished, its outcome
+type ImportJob struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	ImportProgress
+	Filename      string        `json:"filename"`
+	Table         TableRef      `json:"table"`
+	Action        CommitAction  `json:"action"`
+	ValidateOnly  bool          `json:"validateOnly,omitempty"`
+	User          string        `json:"user,omitempty"`
+	RowErrors     []RowError    `json:"rowErrors,omitempty"` // The first rows rejected so far
+	RowsPerSecond float64       `json:"rowsPerSecond"`       // Rows read per second since the job started
+	Result        *CommitResult `json:"result,omitempty"`    // Set once finished, unless the import failed before loading rows
+	Error         string        `json:"error,omitempty"`     // Why the job failed
+	ErrorCode     string        `json:"errorCode,omitempty"`
+	SubmittedAt   time.Time     `json:"submittedAt"`
+	StartedAt     *time.Time    `json:"startedAt,omitempty"`
+	FinishedAt    *time.Time    `json:"finishedAt,omitempty"`
+	ExpiresAt     time.Time     `json:"-"`
+}
+
+// JobEventType is the kind of event streamed to the subscribers of an import job
+type JobEventType string
+
+const (
+	JobEventProgress JobEventType = "progress" // The job's status or progress changed; carries the job without its row errors
+	JobEventWarning  JobEventType = "warning"  // A row was rejected; carries the row error
+	JobEventDone     JobEventType = "done"     // The job finished; carries the whole job
+)
+
+// JobEvent is something that happened to an import job
+type JobEvent struct {
+	Type    JobEventType
+	Job     *ImportJob
+	Warning *RowError
+}
+
+// Finished reports whether the job has stopped, whatever its outcome
+func (j *ImportJob) Finished() bool {
+	return j.FinishedAt != nil
+}
+
+// Elapsed returns how long the job has been running, or ran for once finished
+func (j *ImportJob) Elapsed() time.Duration {
+	switch {
+	case j.StartedAt == nil:
+		return 0
+	case j.FinishedAt != nil:
+		return j.FinishedAt.Sub(*j.StartedAt)
+	default:
+		return time.Since(*j.StartedAt)
+	}
+}
+
+// ImportStatus is the outcome of an import recorded in the import history
+type ImportStatus string
+
+const (
+	ImportCommitted ImportStatus = "committed"
+	ImportFailed    ImportStatus = "failed" // Nothing was kept
+)
+
+// ImportRecord is an entry of the import history, which records every import that was run
+type ImportRecord struct {
+	ID               int64        `db:"id" json:"id"`
+	OriginalFilename string       `db:"original_filename" json:"originalFilename"`
+	FileChecksum     string       `db:"file_checksum" json:"fileChecksum"` // Hex-encoded SHA-256 of the uploaded file
+	FileSize         int64        `db:"file_size" json:"fileSize"`
+	Sheet            string       `db:"sheet" json:"sheet,omitempty"` // Worksheet imported, for workbooks only
+	TableSchema      string       `db:"table_schema" json:"tableSchema"`
+	TableName        string       `db:"table_name" json:"tableName"`
+	Action           CommitAction `db:"action" json:"action"`
+	Status           ImportStatus `db:"status" json:"status"`
+	RowsImported     int64        `db:"rows_imported" json:"rowsImported"`
+	RowsInserted     int64        `db:"rows_inserted" json:"rowsInserted"`
+	RowsUpdated      int64        `db:"rows_updated" json:"rowsUpdated"`
+	RowsRejected     int64        `db:"rows_rejected" json:"rowsRejected"`
+	ErrorMessage     string       `db:"error_message" json:"errorMessage,omitempty"` // Why a failed import was rolled back
+	DurationMS       int64        `db:"duration_ms" json:"durationMs"`
+	ImportedBy       string       `db:"imported_by" json:"importedBy,omitempty"`
+	ImportedAt       time.Time    `db:"imported_at" json:"importedAt"`
+	BatchID          string       `db:"batch_id" json:"batchId,omitempty"`         // Tags the rows loaded by an append
+	BackupTable      string       `db:"backup_table" json:"backupTable,omitempty"` // Table replaced by an overwrite, until it expires
+	UndoneAt         *time.Time   `db:"undone_at" json:"undoneAt,omitempty"`
+	UndoneBy         string       `db:"undone_by" json:"undoneBy,omitempty"`
+}
+
+// Table returns the table the import was loaded into
+func (r ImportRecord) Table() TableRef {
+	return TableRef{Schema: r.TableSchema, Name: r.TableName}
+}
+
+// Undoable reports whether the import left what is needed to undo it: the rows of an append carry its batch ID,
+// and an overwrite kept the table it replaced
+func (r ImportRecord) Undoable() bool {
+	if r.Status != ImportCommitted || r.UndoneAt != nil {
+		return false
+	}
+	return (r.Action == ActionAppend && r.BatchID != "") || (r.Action == ActionOverwrite && r.BackupTable != "")
+}
+
+// Duration returns how long the import took
+func (r ImportRecord) Duration() time.Duration {
+	return time.Duration(r.DurationMS) * time.Millisecond
+}
+
+// ShortChecksum returns the first characters of the file checksum, enough to tell files apart at a glance
+func (r ImportRecord) ShortChecksum() string {
+	if len(r.FileChecksum) > 12 {
+		return r.FileChecksum[:12]
+	}
+	return r.FileChecksum
+}
+
+// UndoResult summarizes an import that was undone
+type UndoResult struct {
+	Import      ImportRecord `json:"import"`
+	RowsDeleted int64        `json:"rowsDeleted"` // Rows of an append that were deleted
+	Statements  []string     `json:"statements,omitempty"`
+	Message     string       `json:"message"`
+}
+
+// HistoryFilter selects entries of the import history; empty fields match every entry
+type HistoryFilter struct {
+	Schema    string
+	TableName string
+	Action    CommitAction
+	Status    ImportStatus
+	User      string
+	Filename  string    // Matches filenames containing it, ignoring case
+	From      time.Time // First day included
+	To        time.Time // Last day included
+	Limit     int
+	Offset    int
+}
+
+// URL returns the address of the history page listing the filtered entries from offset
+func (f HistoryFilter) URL(offset int) string {
+	values := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	set("schema", f.Schema)
+	set("table", f.TableName)
+	set("action", string(f.Action))
+	set("status", string(f.Status))
+	set("user", f.User)
+	set("filename", f.Filename)
+	if !f.From.IsZero() {
+		values.Set("from", f.From.Format(time.DateOnly))
+	}
+	if !f.To.IsZero() {
+		values.Set("to", f.To.Format(time.DateOnly))
+	}
+	values.Set("limit", strconv.Itoa(f.Limit))
+	if offset > 0 {
+		values.Set("offset", strconv.Itoa(offset))
+	}
+	return "/history?" + values.Encode()
+}
+
+// HistoryPage is one page of the import history
+type HistoryPage struct {
+	Records []ImportRecord `json:"imports"`
+	Total   int64          `json:"total"` // Entries matching the filter, across every page
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+	Filter  HistoryFilter  `json:"-"`
+}
+
+// PrevOffset returns the offset of the previous page, or -1 on the first page
+func (p *HistoryPage) PrevOffset() int {
+	if p.Offset == 0 {
+		return -1
+	}
+	return max(p.Offset-p.Limit, 0)
+}
+
+// NextOffset returns the offset of the next page, or -1 on the last page
+func (p *HistoryPage) NextOffset() int {
+	if int64(p.Offset+p.Limit) >= p.Total {
+		return -1
+	}
+	return p.Offset + p.Limit
+}
+
+// TableQuery selects, orders and filters the rows of a table shown by the table browser
+type TableQuery struct {
+	Sort         string // Column to order by; empty keeps the order the rows are stored in
+	Desc         bool
+	FilterColumn string // Column the filter applies to; empty applies it to every column
+	Filter       string // Matches values containing it, ignoring case
+	Limit        int
+	Offset       int
+}
+
+// TablePage is one page of the rows of a table
+type TablePage struct {
+	Table    TableRef           `json:"table"`
+	Columns  []ColumnDefinition `json:"columns"`
+	Rows     [][]*string        `json:"rows"`     // Values in PostgreSQL's text format, nil for NULL
+	RowCount int64              `json:"rowCount"` // Rows in the table
+	Total    int64              `json:"total"`    // Rows matching the filter, across every page
+	Limit    int                `json:"limit"`
+	Offset   int                `json:"offset"`
+	Query    TableQuery         `json:"-"`
+}
+
+// values returns the query parameters selecting the page's rows from offset, sorted by column
+func (p *TablePage) values(offset int, sort string, desc bool) url.Values {
+	values := url.Values{"schema": {p.Table.Schema}}
+	if sort != "" {
+		values.Set("sort", sort)
+		if desc {
+			values.Set("dir", "desc")
+		}
+	}
+	if p.Query.Filter != "" {
+		values.Set("q", p.Query.Filter)
+		if p.Query.FilterColumn != "" {
+			values.Set("column", p.Query.FilterColumn)
+		}
+	}
+	values.Set("limit", strconv.Itoa(p.Limit))
+	if offset > 0 {
+		values.Set("offset", strconv.Itoa(offset))
+	}
+	return values
+}
+
+// URL returns the address of the table browser showing the filtered rows from offset
+func (p *TablePage) URL(offset int) string {
+	return "/tables/" + url.PathEscape(p.Table.Name) + "?" + p.values(offset, p.Query.Sort, p.Query.Desc).Encode()
+}
+
+// SortURL returns the address of the first page sorted by column, descending when it is already sorted ascending
+func (p *TablePage) SortURL(column string) string {
+	desc := p.Query.Sort == column && !p.Query.Desc
+	return "/tables/" + url.PathEscape(p.Table.Name) + "?" + p.values(0, column, desc).Encode()
+}
+
+// ExportURL returns the address of the CSV export of the filtered and sorted rows, on every page
+func (p *TablePage) ExportURL() string {
+	values := p.values(0, p.Query.Sort, p.Query.Desc)
+	values.Del("limit")
+	return "/tables/" + url.PathEscape(p.Table.Name) + "/export.csv?" + values.Encode()
+}
+
+// PrevOffset returns the offset of the previous page, or -1 on the first page
+func (p *TablePage) PrevOffset() int {
+	if p.Offset == 0 {
+		return -1
+	}
+	return max(p.Offset-p.Limit, 0)
+}
+
+// NextOffset returns the offset of the next page, or -1 on the last page
+func (p *TablePage) NextOffset() int {
+	if int64(p.Offset+p.Limit) >= p.Total {
+		return -1
+	}
+	return p.Offset + p.Limit
+}
+
+// User is a person who can sign in to SheetBridge
+type User struct {
+	ID           int64        `db:"id" json:"id"`
+	Username     string       `db:"username" json:"username"`
+	PasswordHash string       `db:"password_hash" json:"-"` // bcrypt; empty for users who only sign in through the proxy header
+	CreatedAt    time.Time    `db:"created_at" json:"createdAt"`
+	Permissions  []Permission `db:"-" json:"permissions"` // Granted through the user's roles
+}
+
+// Can reports whether the user holds a permission to run action on table
+func (u *User) Can(table TableRef, action CommitAction) bool {
+	return slices.ContainsFunc(u.Permissions, func(p Permission) bool { return p.Allows(table, action) })
+}
+
+// Permission lets the users holding a role run an action on the tables matching its schema and table patterns
+// Patterns are globs as understood by path.Match, so "*" matches every schema or table and "staging_*" a prefix
+type Permission struct {
+	Role          string       `db:"role" json:"role"`
+	SchemaPattern string       `db:"schema_pattern" json:"schema"`
+	TablePattern  string       `db:"table_pattern" json:"table"`
+	Action        CommitAction `db:"action" json:"action"` // AnyAction allows every action
+}
+
+// AnyAction is the action of a permission that allows every action
+const AnyAction CommitAction = "*"
+
+// Allows reports whether the permission covers running action on table; malformed patterns match nothing
+func (p Permission) Allows(table TableRef, action CommitAction) bool {
+	if p.Action != AnyAction && p.Action != action {
+		return false
+	}
+	schemaMatch, err := path.Match(p.SchemaPattern, table.Schema)
+	if err != nil || !schemaMatch {
+		return false
+	}
+	tableMatch, err := path.Match(p.TablePattern, table.Name)
+	return err == nil && tableMatch
+}
+
+// UploadSession is the server-side record of a spooled upload awaiting commit
+// Clients only ever see the opaque ID
+type UploadSession struct {
+	ID                 string
+	TempFilePath       string
+	OriginalFilename   string
+	Format             string
+	Sheets             []string
+	Sheet              string
+	Dialect            CSVDialect
+	FileSize           int64
+	FileChecksum       string
+	Headers            []string
+	InferredColumnDefs []ColumnDefinition
+	Inference          *SchemaInference
+	User               string // Who uploaded the file; empty when authentication is disabled
+	ExpiresAt          time.Time
 }
 
 // TemplateData is the base data structure for HTML templates
 type TemplateData struct {
-	Form    any    // To hold form data and errors (e.g., CommitRequest)
-	Flash   string // Success/error messages
-	Preview *CSVPreview
-	// Add other common fields like CSRFToken string
+	Form      any    // To hold form data and errors (e.g., CommitRequest)
+	Flash     string // Success/error messages
+	Preview   *CSVPreview
+	Result    *CommitResult
+	History   *HistoryPage
+	Table     *TablePage
+	Job       *ImportJob
+	User      *User  // Signed-in user, nil when authentication is disabled
+	SignOut   bool   // Whether the user signed in with a password, and so can sign out
+	CSRFToken string // Sent back by every state-changing form
+	// Add other common fields here
 }
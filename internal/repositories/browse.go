@@ -0,0 +1,111 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/lib/pq"
+)
+
+// tableRowsSQL builds the SELECT of the given columns of a table, every value cast to text, along with the WHERE
+// and ORDER BY clauses selecting the rows that match the query
+// The query's sort and filter columns must be among the columns
+func tableRowsSQL(table models.TableRef, columns []models.ColumnDefinition, q models.TableQuery) (selectClause, whereClause, orderClause string, args []any) {
+	selected := make([]string, len(columns))
+	var filtered []string
+	for i, col := range columns {
+		selected[i] = pq.QuoteIdentifier(col.Name) + "::text"
+		if q.FilterColumn == "" || q.FilterColumn == col.Name {
+			filtered = append(filtered, selected[i]+` ILIKE '%' || $1 || '%'`)
+		}
+	}
+	selectClause = fmt.Sprintf("SELECT %s FROM %s", strings.Join(selected, ", "), quoteTable(table))
+
+	if q.Filter != "" && len(filtered) > 0 {
+		whereClause = "WHERE " + strings.Join(filtered, " OR ")
+		args = append(args, escapeLike(q.Filter))
+	}
+	if q.Sort != "" {
+		direction := "ASC"
+		if q.Desc {
+			direction = "DESC"
+		}
+		orderClause = fmt.Sprintf("ORDER BY %s %s", pq.QuoteIdentifier(q.Sort), direction)
+	}
+	return selectClause, whereClause, orderClause, args
+}
+
+// CountTableRows returns how many rows a table holds and how many of them match the query's filter
+func (r *DBRepository) CountTableRows(ctx context.Context, table models.TableRef, columns []models.ColumnDefinition, q models.TableQuery) (int64, int64, *apperrors.AppError) {
+	_, whereClause, _, args := tableRowsSQL(table, columns, q)
+	matching := "COUNT(*)"
+	if whereClause != "" {
+		matching = fmt.Sprintf("COUNT(*) FILTER (%s)", whereClause)
+	}
+
+	var counts struct {
+		RowCount int64 `db:"row_count"`
+		Total    int64 `db:"total"`
+	}
+	query := fmt.Sprintf("SELECT COUNT(*) AS row_count, %s AS total FROM %s;", matching, quoteTable(table))
+	if err := r.db.GetContext(ctx, &counts, query, args...); err != nil {
+		return 0, 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to count the rows of table '%s'", table))
+	}
+	return counts.RowCount, counts.Total, nil
+}
+
+// ListTableRows returns the page of rows of a table selected by the query, with values in PostgreSQL's text format
+// and nil for NULL
+func (r *DBRepository) ListTableRows(ctx context.Context, table models.TableRef, columns []models.ColumnDefinition, q models.TableQuery) ([][]*string, *apperrors.AppError) {
+	selectClause, whereClause, orderClause, args := tableRowsSQL(table, columns, q)
+	query := fmt.Sprintf("%s %s %s LIMIT $%d OFFSET $%d;", selectClause, whereClause, orderClause, len(args)+1, len(args)+2)
+
+	rows := [][]*string{}
+	appErr := r.streamRows(ctx, table, len(columns), query, append(args, q.Limit, q.Offset), func(row []*string) error {
+		rows = append(rows, row)
+		return nil
+	})
+	if appErr != nil {
+		return nil, appErr
+	}
+	return rows, nil
+}
+
+// StreamTableRows passes every row of a table selected by the query, ignoring its limit and offset, to fn as it is
+// read from the database, so the rows are never all held in memory
+// Values are in PostgreSQL's text format and nil for NULL. An error returned by fn stops the query
+func (r *DBRepository) StreamTableRows(ctx context.Context, table models.TableRef, columns []models.ColumnDefinition, q models.TableQuery, fn func(row []*string) error) *apperrors.AppError {
+	selectClause, whereClause, orderClause, args := tableRowsSQL(table, columns, q)
+	query := fmt.Sprintf("%s %s %s;", selectClause, whereClause, orderClause)
+	return r.streamRows(ctx, table, len(columns), query, args, fn)
+}
+
+// streamRows runs a query selecting width text columns and passes each row to fn in a new slice
+func (r *DBRepository) streamRows(ctx context.Context, table models.TableRef, width int, query string, args []any, fn func(row []*string) error) *apperrors.AppError {
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to query the rows of table '%s'", table))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		row := make([]*string, width)
+		dest := make([]any, width)
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to read a row of table '%s'", table))
+		}
+		if err := fn(row); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to write a row of table '%s'", table))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to read the rows of table '%s'", table))
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package repositories
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/utils"
+)
+
+// timestampTZLayouts are the layouts accepted for TIMESTAMPTZ values
+// Values without an offset are taken to be in UTC
+var timestampTZLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z07",
+	"2006-01-02T15:04:05.999999999Z07",
+	"2006-01-02 15:04:05.999999999 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"01/02/2006 15:04:05",
+	"Jan 2, 2006 15:04:05",
+}
+
+// convertValue converts a raw CSV value into the Go value that is sent to PostgreSQL for the given application type
+// Empty values are always converted to NULL
+func convertValue(colType, valStr string) (any, error) {
+	cleanValStr := strings.TrimSpace(valStr)
+	if cleanValStr == "" {
+		return nil, nil
+	}
+
+	switch baseType(colType) {
+	case "INT", "INTEGER":
+		return strconv.ParseInt(cleanValStr, 10, 32)
+	case "BIGINT":
+		return strconv.ParseInt(cleanValStr, 10, 64)
+	case "DECIMAL", "NUMERIC":
+		return convertNumeric(colType, cleanValStr)
+	case "REAL", "FLOAT", "DOUBLE":
+		return strconv.ParseFloat(cleanValStr, 64)
+	case "DATE":
+		layouts := []string{
+			"2006-01-02",
+			"01/02/2006",
+			"2006/01/02",
+			"Jan 2, 2006",
+			"2-Jan-2006",
+			time.RFC3339[:10],
+		}
+		for _, layout := range layouts {
+			if t, perr := time.Parse(layout, cleanValStr); perr == nil {
+				return t.Format("2006-01-02"), nil
+			}
+		}
+		return cleanValStr, nil
+	case "TIMESTAMP", "DATETIME":
+		layouts := []string{
+			time.RFC3339,
+			time.RFC3339Nano,
+			"2006-01-02 15:04:05",
+			"2006-01-02T15:04:05Z07:00",
+			"2006-01-02T15:04:05",
+			"01/02/2006 15:04:05",
+			"Jan 2, 2006 15:04:05",
+		}
+		for _, layout := range layouts {
+			if t, perr := time.Parse(layout, cleanValStr); perr == nil {
+				return t.Format("2006-01-02 15:04:05.999999"), nil
+			}
+		}
+		return cleanValStr, nil
+	case "TIMESTAMPTZ":
+		for _, layout := range timestampTZLayouts {
+			if t, perr := time.Parse(layout, cleanValStr); perr == nil {
+				return t.Format("2006-01-02 15:04:05.999999-07:00"), nil
+			}
+		}
+		return nil, fmt.Errorf("unrecognized timestamp with time zone '%s'", valStr)
+	case "TIME":
+		if t, ok := utils.ParseTimeOfDay(cleanValStr); ok {
+			return t.Format("15:04:05.999999"), nil
+		}
+		return nil, fmt.Errorf("unrecognized time of day '%s'", valStr)
+	case "INTERVAL":
+		if utils.IsInterval(cleanValStr) {
+			return cleanValStr, nil
+		}
+		return nil, fmt.Errorf("unrecognized interval '%s'", valStr)
+	case "UUID":
+		if utils.IsUUID(cleanValStr) {
+			return cleanValStr, nil
+		}
+		return nil, fmt.Errorf("invalid UUID '%s'", valStr)
+	case "JSON", "JSONB":
+		if json.Valid([]byte(cleanValStr)) {
+			return cleanValStr, nil
+		}
+		return nil, fmt.Errorf("invalid JSON '%s'", valStr)
+	case "BOOLEAN":
+		lowerVal := strings.ToLower(cleanValStr)
+		if lowerVal == "true" || lowerVal == "1" || lowerVal == "yes" || lowerVal == "t" {
+			return true, nil
+		} else if lowerVal == "false" || lowerVal == "0" || lowerVal == "no" || lowerVal == "f" {
+			return false, nil
+		}
+		return nil, fmt.Errorf("unrecognized boolean value '%s'", valStr)
+	default: // TEXT
+		return valStr, nil
+	}
+}
+
+// convertNumeric validates a NUMERIC value and returns it as a string so no precision is lost on the way to PostgreSQL
+// For NUMERIC(p,s), values with more than p-s integer digits are rejected; extra fractional digits are rounded by PostgreSQL
+func convertNumeric(colType, valStr string) (any, error) {
+	intDigits, _, ok := utils.ParseDecimal(valStr)
+	if !ok {
+		// Scientific notation such as "1.5e3"
+		f, err := strconv.ParseFloat(valStr, 64)
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, fmt.Errorf("invalid numeric value '%s'", valStr)
+		}
+		valStr = strconv.FormatFloat(f, 'f', -1, 64)
+		intDigits, _, _ = utils.ParseDecimal(valStr)
+	}
+
+	if precision, scale, ok := parseNumericType(colType); ok && intDigits > precision-scale {
+		return nil, fmt.Errorf("value '%s' has more than %d integer digits allowed by NUMERIC(%d,%d)", valStr, precision-scale, precision, scale)
+	}
+	return valStr, nil
+}
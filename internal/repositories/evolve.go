@@ -0,0 +1,144 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Minimum integer digits a NUMERIC needs to hold every INTEGER and BIGINT value
+const (
+	integerDigits = 10
+	bigintDigits  = 19
+)
+
+// WidenType returns the type a column of tableType must be changed to so it can hold values inferred as inferredType,
+// or an empty string when the column can already hold them. numericValues tells whether every value is a number, as
+// BOOLEAN values inferred from nothing but 0 and 1 fit numeric columns, unlike true, false, t, f, yes and no
+// Numbers widen along INTEGER, BIGINT, NUMERIC; DATE widens to TIMESTAMP; values of an unrelated type widen to TEXT
+func WidenType(tableType, inferredType string, numericValues bool) string {
+	tableBase, inferredBase := normalizedBaseType(tableType), normalizedBaseType(inferredType)
+	switch {
+	case tableBase == "TEXT" || mapToPostgresType(tableType) == mapToPostgresType(inferredType):
+		return ""
+	case isNumericType(tableBase) && (isNumericType(inferredBase) || inferredBase == "BOOLEAN" && numericValues):
+		return widenNumeric(tableType, inferredType)
+	case tableBase == "DATE" && (inferredBase == "TIMESTAMP" || inferredBase == "TIMESTAMPTZ"):
+		return inferredBase
+	case tableBase == "TIMESTAMP" && (inferredBase == "DATE" || inferredBase == "TIMESTAMPTZ"):
+		return ""
+	case tableBase == "TIMESTAMPTZ" && inferredBase == "TIMESTAMP":
+		return "" // Values without an offset are taken to be in UTC
+	default:
+		return "TEXT"
+	}
+}
+
+// normalizedBaseType returns the base application type, folding aliases such as INT and DECIMAL
+func normalizedBaseType(colType string) string {
+	switch base := baseType(colType); base {
+	case "INT":
+		return "INTEGER"
+	case "DECIMAL":
+		return "NUMERIC"
+	case "FLOAT", "DOUBLE":
+		return "REAL"
+	case "DATETIME":
+		return "TIMESTAMP"
+	case "JSON":
+		return "JSONB"
+	default:
+		return base
+	}
+}
+
+// isNumericType reports whether a normalized base type holds numbers
+func isNumericType(base string) bool {
+	return base == "INTEGER" || base == "BIGINT" || base == "NUMERIC" || base == "REAL"
+}
+
+// widenNumeric widens a numeric column type so it can hold values inferred as another numeric type
+// BOOLEAN values only get here when they are 0 and 1, which every numeric type holds
+func widenNumeric(tableType, inferredType string) string {
+	tableBase, inferredBase := normalizedBaseType(tableType), normalizedBaseType(inferredType)
+	if tableBase == "REAL" || inferredBase == "BOOLEAN" || inferredBase == "INTEGER" {
+		return ""
+	}
+
+	switch {
+	case inferredBase == "REAL":
+		if tableBase == "NUMERIC" {
+			if _, _, constrained := parseNumericType(tableType); !constrained {
+				return ""
+			}
+		}
+		return "NUMERIC" // Exact, and still takes values written in scientific notation
+	case inferredBase == "BIGINT":
+		if tableBase == "INTEGER" {
+			return "BIGINT"
+		}
+		return "" // A BIGINT or NUMERIC column; values too large for a NUMERIC(p,s) are rejected row by row
+	}
+
+	// NUMERIC values into an INTEGER, BIGINT or NUMERIC column
+	inferredPrecision, inferredScale, inferredConstrained := parseNumericType(inferredType)
+	if !inferredConstrained {
+		if tableBase == "NUMERIC" {
+			if _, _, constrained := parseNumericType(tableType); !constrained {
+				return ""
+			}
+		}
+		return "NUMERIC"
+	}
+
+	var tableIntDigits, tableScale int
+	switch tableBase {
+	case "INTEGER":
+		tableIntDigits = integerDigits
+	case "BIGINT":
+		tableIntDigits = bigintDigits
+	default:
+		precision, scale, constrained := parseNumericType(tableType)
+		if !constrained {
+			return ""
+		}
+		tableIntDigits, tableScale = precision-scale, scale
+	}
+
+	intDigits := max(tableIntDigits, inferredPrecision-inferredScale)
+	scale := max(tableScale, inferredScale)
+	if tableBase == "NUMERIC" && intDigits == tableIntDigits && scale == tableScale {
+		return ""
+	}
+	if intDigits+scale > maxNumericPrecision {
+		return "NUMERIC"
+	}
+	return fmt.Sprintf("NUMERIC(%d,%d)", intDigits+scale, scale)
+}
+
+// SchemaChangeSQL returns the ALTER TABLE statement that applies a schema change to a table
+func SchemaChangeSQL(table models.TableRef, change models.SchemaChange) string {
+	column := pq.QuoteIdentifier(change.Column)
+	pgType := mapToPostgresType(change.ToType)
+	if change.Action == models.SchemaAddColumn {
+		return fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", quoteTable(table), column, pgType)
+	}
+	return fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s;", quoteTable(table), column, pgType, column, pgType)
+}
+
+// ApplySchemaChanges runs the ALTER TABLE statements of the schema changes in order inside the transaction
+func (r *DBRepository) ApplySchemaChanges(ctx context.Context, tx *sqlx.Tx, table models.TableRef, changes []models.SchemaChange) *apperrors.AppError {
+	for _, change := range changes {
+		if _, err := tx.ExecContext(ctx, SchemaChangeSQL(table, change)); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok {
+				return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to change column '%s' of table '%s' to %s. DB Error: %s (Detail: %s, Code: %s)", change.Column, table, change.ToType, pqErr.Message, pqErr.Detail, pqErr.Code))
+			}
+			return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to change column '%s' of table '%s' to %s", change.Column, table, change.ToType))
+		}
+	}
+	return nil
+}
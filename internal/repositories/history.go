@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// historyColumns are the columns of sheetbridge.import_history, created by the import_history migration
+const historyColumns = `id, original_filename, file_checksum, file_size, sheet, table_schema, table_name, action, status,
+	rows_imported, rows_inserted, rows_updated, rows_rejected, error_message, duration_ms, imported_by, imported_at,
+	batch_id, backup_table, undone_at, undone_by`
+
+// RecordImport adds an entry to the import history, setting its ID and timestamp
+// It runs outside of the import's transaction so that failed imports are recorded too
+func (r *DBRepository) RecordImport(ctx context.Context, record *models.ImportRecord) *apperrors.AppError {
+	query := `
+		INSERT INTO sheetbridge.import_history (
+			original_filename, file_checksum, file_size, sheet, table_schema, table_name, action, status,
+			rows_imported, rows_inserted, rows_updated, rows_rejected, error_message, duration_ms, imported_by,
+			batch_id, backup_table
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING id, imported_at;
+	`
+	err := r.db.QueryRowxContext(ctx, query,
+		record.OriginalFilename, record.FileChecksum, record.FileSize, record.Sheet, record.TableSchema, record.TableName, record.Action, record.Status,
+		record.RowsImported, record.RowsInserted, record.RowsUpdated, record.RowsRejected, record.ErrorMessage, record.DurationMS, record.ImportedBy,
+		record.BatchID, record.BackupTable,
+	).Scan(&record.ID, &record.ImportedAt)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to record the import of '%s' into '%s' in the import history", record.OriginalFilename, record.Table()))
+	}
+	return nil
+}
+
+// ListImportHistory returns the entries of the import history matching the filter, newest first, along with how
+// many entries match it in total
+func (r *DBRepository) ListImportHistory(ctx context.Context, filter models.HistoryFilter) ([]models.ImportRecord, int64, *apperrors.AppError) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+	if filter.Schema != "" {
+		where("table_schema = $%d", filter.Schema)
+	}
+	if filter.TableName != "" {
+		where("table_name = $%d", filter.TableName)
+	}
+	if filter.Action != "" {
+		where("action = $%d", filter.Action)
+	}
+	if filter.Status != "" {
+		where("status = $%d", filter.Status)
+	}
+	if filter.User != "" {
+		where("imported_by = $%d", filter.User)
+	}
+	if filter.Filename != "" {
+		where(`original_filename ILIKE '%%' || $%d || '%%'`, escapeLike(filter.Filename))
+	}
+	if !filter.From.IsZero() {
+		where("imported_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("imported_at < $%d", filter.To.AddDate(0, 0, 1))
+	}
+	whereClause := ""
+	if len(conditions) > 0 {
+		whereClause = "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int64
+	if err := r.db.GetContext(ctx, &total, "SELECT COUNT(*) FROM sheetbridge.import_history "+whereClause, args...); err != nil {
+		return nil, 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to count import history entries")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM sheetbridge.import_history %s ORDER BY imported_at DESC, id DESC LIMIT $%d OFFSET $%d",
+		historyColumns, whereClause, len(args)+1, len(args)+2)
+	records := []models.ImportRecord{}
+	if err := r.db.SelectContext(ctx, &records, query, append(args, filter.Limit, filter.Offset)...); err != nil {
+		return nil, 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to query import history")
+	}
+	return records, total, nil
+}
+
+// GetImportRecord returns an entry of the import history, locking it until the transaction ends
+// It returns ErrNotFound when there is no entry with that ID
+func (r *DBRepository) GetImportRecord(ctx context.Context, tx *sqlx.Tx, id int64) (*models.ImportRecord, *apperrors.AppError) {
+	var record models.ImportRecord
+	query := fmt.Sprintf("SELECT %s FROM sheetbridge.import_history WHERE id = $1 FOR UPDATE;", historyColumns)
+	if err := tx.GetContext(ctx, &record, query, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperrors.Wrap(err, apperrors.ErrNotFound, fmt.Sprintf("Import %d does not exist.", id))
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to look up import %d", id))
+	}
+	return &record, nil
+}
+
+// HasLaterImport reports whether a later import into the same table was committed and has not been undone
+func (r *DBRepository) HasLaterImport(ctx context.Context, tx *sqlx.Tx, record *models.ImportRecord) (bool, *apperrors.AppError) {
+	query := `
+		SELECT EXISTS (
+			SELECT FROM sheetbridge.import_history
+			WHERE table_schema = $1 AND table_name = $2 AND id > $3 AND status = $4 AND undone_at IS NULL
+		);
+	`
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, query, record.TableSchema, record.TableName, record.ID, models.ImportCommitted); err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to look up later imports into table '%s'", record.Table()))
+	}
+	return exists, nil
+}
+
+// MarkImportUndone records that an import was undone, and by whom; the backup of an undone overwrite has been restored
+func (r *DBRepository) MarkImportUndone(ctx context.Context, tx *sqlx.Tx, record *models.ImportRecord, user string) *apperrors.AppError {
+	query := `
+		UPDATE sheetbridge.import_history
+		SET undone_at = now(), undone_by = $2, backup_table = ''
+		WHERE id = $1
+		RETURNING undone_at, undone_by, backup_table;
+	`
+	if err := tx.QueryRowxContext(ctx, query, record.ID, user).Scan(&record.UndoneAt, &record.UndoneBy, &record.BackupTable); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to mark import %d as undone", record.ID))
+	}
+	return nil
+}
+
+// ListExpiredBackups returns the imports whose backup table was kept since before the given time
+func (r *DBRepository) ListExpiredBackups(ctx context.Context, before time.Time) ([]models.ImportRecord, *apperrors.AppError) {
+	query := fmt.Sprintf("SELECT %s FROM sheetbridge.import_history WHERE backup_table <> '' AND imported_at < $1 ORDER BY id;", historyColumns)
+	var records []models.ImportRecord
+	if err := r.db.SelectContext(ctx, &records, query, before); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to query expired backups")
+	}
+	return records, nil
+}
+
+// ClearBackup records that the backup table of an import was dropped, so the import can no longer be undone
+func (r *DBRepository) ClearBackup(ctx context.Context, id int64) *apperrors.AppError {
+	if _, err := r.db.ExecContext(ctx, "UPDATE sheetbridge.import_history SET backup_table = '' WHERE id = $1;", id); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to clear the backup of import %d", id))
+	}
+	return nil
+}
+
+// escapeLike escapes the wildcard characters of a LIKE pattern so that s is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
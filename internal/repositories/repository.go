@@ -2,8 +2,9 @@ package repositories
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
-	"strconv"
+	"io"
 	"strings"
 	"time"
 
@@ -51,136 +52,111 @@ func (r *DBRepository) Beginx() (*sqlx.Tx, error) {
 	return r.db.Beginx()
 }
 
-// GetTableNames fetches all table names from the database
-func (r *DBRepository) GetTableNames(ctx context.Context) ([]string, *apperrors.AppError) {
+// BeginTxx starts a transaction that is rolled back if ctx is cancelled before it is committed
+func (r *DBRepository) BeginTxx(ctx context.Context) (*sqlx.Tx, error) {
+	return r.db.BeginTxx(ctx, nil)
+}
+
+// quoteTable returns the quoted, schema-qualified name of a table for use in SQL
+func quoteTable(table models.TableRef) string {
+	return pq.QuoteIdentifier(table.Schema) + "." + pq.QuoteIdentifier(table.Name)
+}
+
+// GetSchemaNames fetches the names of the schemas that can hold user tables, leaving out PostgreSQL's own schemas
+// and the schema SheetBridge keeps its metadata and backups in
+func (r *DBRepository) GetSchemaNames(ctx context.Context) ([]string, *apperrors.AppError) {
+	query := `
+		SELECT nspname
+		FROM pg_catalog.pg_namespace
+		WHERE nspname NOT LIKE 'pg\_%' AND nspname NOT IN ('information_schema', $1)
+		ORDER BY nspname;
+	`
+	var names []string
+	if err := r.db.SelectContext(ctx, &names, query, backupSchema); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to query schema names")
+	}
+	return names, nil
+}
+
+// GetTableNames fetches the names of all tables in a schema
+func (r *DBRepository) GetTableNames(ctx context.Context, schema string) ([]string, *apperrors.AppError) {
 	query := `
 		SELECT tablename
 		FROM pg_catalog.pg_tables
-		WHERE schemaname = 'public'
+		WHERE schemaname = $1
 		ORDER BY tablename;
 	`
 	var names []string
-	if err := r.db.SelectContext(ctx, &names, query); err != nil {
-		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to query table names")
+	if err := r.db.SelectContext(ctx, &names, query, schema); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to query table names of schema '%s'", schema))
 	}
 	return names, nil
 }
 
-// TableExists checks the existence of a table by name
-func (r *DBRepository) TableExists(ctx context.Context, tableName string) (bool, *apperrors.AppError) {
+// TableExists checks the existence of a table
+func (r *DBRepository) TableExists(ctx context.Context, table models.TableRef) (bool, *apperrors.AppError) {
 	query := `
 		SELECT EXISTS (
 			SELECT FROM information_schema.tables
-			WHERE table_schema = 'public' AND table_name = $1
+			WHERE table_schema = $1 AND table_name = $2
 		);
 	`
 	var exists bool
-	if err := r.db.GetContext(ctx, &exists, query, tableName); err != nil {
-		return false, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to check if table '%s' exists", tableName))
+	if err := r.db.GetContext(ctx, &exists, query, table.Schema, table.Name); err != nil {
+		return false, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to check if table '%s' exists", table))
 	}
 	return exists, nil
 }
 
-// mapToPostgresType maps similar datatypes to their PostgreSQL equivalent
-func mapToPostgresType(userType string) string {
-	switch strings.ToUpper(userType) {
-	case "INT", "INTEGER":
-		return "INTEGER"
-	case "BIGINT":
-		return "BIGINT"
-	case "DECIMAL", "NUMERIC":
-		return "NUMERIC"
-	case "REAL", "FLOAT", "DOUBLE":
-		return "REAL"
-	case "DATE":
-		return "DATE"
-	case "TIMESTAMP", "DATETIME":
-		return "TIMESTAMP WITHOUT TIME ZONE"
-	case "BOOLEAN":
-		return "BOOLEAN"
-	default:
-		return "TEXT"
-	}
-}
-
-// mapToAppType maps similar datatypes from Postgres to their application equivalent
-func mapToAppType(pgType string) string {
-	pgType = strings.ToLower(strings.TrimSpace(pgType))
-
-	switch {
-	case pgType == "integer" || pgType == "smallint" || pgType == "serial" || pgType == "smallserial":
-		return "INTEGER"
-	case pgType == "bigint" || pgType == "bigserial":
-		return "BIGINT"
-	case pgType == "numeric" || pgType == "decimal":
-		return "NUMERIC"
-	case pgType == "real" || pgType == "double precision":
-		return "REAL"
-	case pgType == "boolean":
-		return "BOOLEAN"
-	case pgType == "date":
-		return "DATE"
-	case strings.HasPrefix(pgType, "timestamp"): // "timestamp without time zone", "timestamp with time zone"
-		return "TIMESTAMP"
-	case pgType == "text":
-		return "TEXT"
-	case strings.HasPrefix(pgType, "character varying"): // varchar(n)
-		return "TEXT"
-	case strings.HasPrefix(pgType, "char"): // char(n)
-		return "TEXT"
-	case pgType == "json" || pgType == "jsonb":
-		return "TEXT"
-	case pgType == "uuid":
-		return "TEXT"
-	case pgType == "bytea":
-		return "TEXT"
-	default:
-		return "TEXT"
-	}
+// schemaColumn is a column as described by information_schema.columns
+type schemaColumn struct {
+	Name             string        `db:"column_name"`
+	Type             string        `db:"data_type"`
+	NumericPrecision sql.NullInt64 `db:"numeric_precision"`
+	NumericScale     sql.NullInt64 `db:"numeric_scale"`
 }
 
 // GetTableSchema retrieves the column names and mapped application types for a given table
-func (r *DBRepository) GetTableSchema(ctx context.Context, tableName string) ([]models.ColumnDefinition, *apperrors.AppError) {
+func (r *DBRepository) GetTableSchema(ctx context.Context, table models.TableRef) ([]models.ColumnDefinition, *apperrors.AppError) {
 	query := `
 		SELECT
 			column_name,
-			data_type
+			data_type,
+			numeric_precision,
+			numeric_scale
 		FROM information_schema.columns
-		WHERE table_schema = 'public' AND table_name = $1
+		WHERE table_schema = $1 AND table_name = $2 AND column_name <> $3
 		ORDER BY ordinal_position;
 	`
 
-	var rawDbColumns []models.ColumnDefinition
-	err := r.db.SelectContext(ctx, &rawDbColumns, query, tableName)
+	// The batch column is bookkeeping for undo, never a column data is loaded into
+	var rawDbColumns []schemaColumn
+	err := r.db.SelectContext(ctx, &rawDbColumns, query, table.Schema, table.Name, BatchColumn)
 	if err != nil {
-		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to query schema for table '%s'", tableName))
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to query schema for table '%s'", table))
 	}
 
 	if len(rawDbColumns) == 0 {
-		return nil, apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("no columns found for table '%s' in public schema, or table does not exist", tableName))
+		return nil, apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("no columns found for table '%s', or table does not exist", table))
 	}
 
 	appColDefinitions := make([]models.ColumnDefinition, len(rawDbColumns))
 	for i, col := range rawDbColumns {
 		appColDefinitions[i] = models.ColumnDefinition{
 			Name: col.Name,
-			Type: mapToAppType(col.Type),
+			Type: mapToAppType(col.Type, col.NumericPrecision, col.NumericScale),
 		}
 	}
 	return appColDefinitions, nil
 }
 
 // CreateTable creates a new table in the database using either the provided sqlx transaction or the repository database
-func (r *DBRepository) CreateTable(ctx context.Context, tx *sqlx.Tx, tableName string, columns []models.ColumnDefinition) *apperrors.AppError {
+func (r *DBRepository) CreateTable(ctx context.Context, tx *sqlx.Tx, table models.TableRef, columns []models.ColumnDefinition) *apperrors.AppError {
 	if len(columns) == 0 {
 		return apperrors.New("invalid_operation_create_table", "no columns defined for table creation")
 	}
 
-	var defs []string
-	for _, col := range columns {
-		defs = append(defs, fmt.Sprintf("%s %s", pq.QuoteIdentifier(col.Name), mapToPostgresType(col.Type)))
-	}
-	query := fmt.Sprintf("CREATE TABLE public.%s (%s);", pq.QuoteIdentifier(tableName), strings.Join(defs, ", "))
+	query := CreateTableSQL(table, columns)
 
 	var err error
 	if tx != nil {
@@ -190,14 +166,28 @@ func (r *DBRepository) CreateTable(ctx context.Context, tx *sqlx.Tx, tableName s
 	}
 
 	if err != nil {
-		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to create table '%s'", tableName))
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to create table '%s'", table))
 	}
 	return nil
 }
 
+// CreateTableSQL returns the CREATE TABLE statement CreateTable runs
+func CreateTableSQL(table models.TableRef, columns []models.ColumnDefinition) string {
+	defs := make([]string, len(columns))
+	for i, col := range columns {
+		defs[i] = fmt.Sprintf("%s %s", pq.QuoteIdentifier(col.Name), mapToPostgresType(col.Type))
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s);", quoteTable(table), strings.Join(defs, ", "))
+}
+
+// DropTableSQL returns the DROP TABLE statement DropTable runs
+func DropTableSQL(table models.TableRef) string {
+	return fmt.Sprintf("DROP TABLE IF EXISTS %s;", quoteTable(table))
+}
+
 // DropTable drops a table in the database using either the provided sqlx transaction or the repository database
-func (r *DBRepository) DropTable(ctx context.Context, tx *sqlx.Tx, tableName string) *apperrors.AppError {
-	query := fmt.Sprintf("DROP TABLE IF EXISTS public.%s;", pq.QuoteIdentifier(tableName))
+func (r *DBRepository) DropTable(ctx context.Context, tx *sqlx.Tx, table models.TableRef) *apperrors.AppError {
+	query := DropTableSQL(table)
 	var err error
 	if tx != nil {
 		_, err = tx.ExecContext(ctx, query)
@@ -206,135 +196,197 @@ func (r *DBRepository) DropTable(ctx context.Context, tx *sqlx.Tx, tableName str
 	}
 
 	if err != nil {
-		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to drop table '%s'", tableName))
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to drop table '%s'", table))
 	}
 	return nil
 }
 
-// InsertData inserts rows into the specified table in the database
-func (r *DBRepository) InsertData(ctx context.Context, tx *sqlx.Tx, tableName string, columnDefs []models.ColumnDefinition, records [][]string) *apperrors.AppError {
-	if len(records) == 0 {
-		return nil // No data to insert
-	}
+// RowReader supplies records one at a time. Read returns io.EOF once all records have been consumed
+type RowReader interface {
+	Read() (record []string, err error)
+}
+
+// InsertOptions tunes how InsertData treats rows that cannot be loaded
+type InsertOptions struct {
+	// OnReject, when set, is called for each row with the wrong number of values or a value that fails type conversion
+	// The row is skipped instead of aborting the insert; returning an AppError aborts the insert with that error
+	// Errors raised by PostgreSQL itself (e.g. constraint violations) cannot be skipped and always abort the COPY
+	OnReject func(rowErr models.RowError, record []string) *apperrors.AppError
+
+	// Sources, when set, holds for each column the index of the record value loaded into it, or -1 to load NULL
+	// Records are then expected to have RecordWidth values; otherwise they must have one value per column
+	Sources     []int
+	RecordWidth int
+
+	// BatchID, when set, is loaded into the table's BatchColumn on every row, so the rows can be removed together
+	// Only InsertData tags rows
+	BatchID string
+
+	// OnProgress, when set, is called every ProgressInterval rows and once all rows are read, with how many rows were
+	// read and how many were sent to the database so far
+	OnProgress func(rowsRead, rowsLoaded int64)
+}
+
+// ProgressInterval is how many rows are read between calls to InsertOptions.OnProgress, and between checks of
+// whether the insert's context was cancelled
+const ProgressInterval = 1000
+
+// InsertData streams rows from the reader into the specified table using the PostgreSQL COPY protocol
+// COPY is only allowed inside a transaction, so a transaction is started and committed here when tx is nil
+// It returns the number of rows written; opts may be nil
+func (r *DBRepository) InsertData(ctx context.Context, tx *sqlx.Tx, table models.TableRef, columnDefs []models.ColumnDefinition, rows RowReader, opts *InsertOptions) (int64, *apperrors.AppError) {
 	if len(columnDefs) == 0 {
-		return apperrors.New("invalid_operation_insert_data", "column definitions are required for data insertion")
+		return 0, apperrors.New("invalid_operation_insert_data", "column definitions are required for data insertion")
+	}
+	if opts == nil {
+		opts = &InsertOptions{}
+	}
+	if opts.Sources != nil && len(opts.Sources) != len(columnDefs) {
+		return 0, apperrors.New("invalid_operation_insert_data", "a source is required for every column")
 	}
 
-	var colNames []string
-	for _, cd := range columnDefs {
-		colNames = append(colNames, pq.QuoteIdentifier(cd.Name))
+	if tx == nil {
+		ownTx, err := r.db.BeginTxx(ctx, nil)
+		if err != nil {
+			return 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to begin transaction for data insertion")
+		}
+		rowCount, appErr := r.InsertData(ctx, ownTx, table, columnDefs, rows, opts)
+		if appErr != nil {
+			ownTx.Rollback()
+			return 0, appErr
+		}
+		if err := ownTx.Commit(); err != nil {
+			return 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to commit data insertion")
+		}
+		return rowCount, nil
 	}
 
-	placeholders := make([]string, len(colNames))
-	for i := range placeholders {
-		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	copyColumns := columnNames(columnDefs)
+	if opts.BatchID != "" {
+		copyColumns = append(copyColumns, BatchColumn)
 	}
+	return copyRows(ctx, tx, pq.CopyInSchema(table.Schema, table.Name, copyColumns...), table.String(), columnDefs, rows, opts, nil)
+}
 
-	stmtStr := fmt.Sprintf("INSERT INTO public.%s (%s) VALUES (%s);",
-		pq.QuoteIdentifier(tableName),
-		strings.Join(colNames, ","),
-		strings.Join(placeholders, ","))
+// columnNames returns the names of the columns; pq.CopyIn and pq.CopyInSchema quote identifiers themselves
+func columnNames(columnDefs []models.ColumnDefinition) []string {
+	names := make([]string, len(columnDefs))
+	for i, cd := range columnDefs {
+		names[i] = cd.Name
+	}
+	return names
+}
 
-	var stmt *sqlx.Stmt
-	var err error
-	if tx != nil {
-		stmt, err = tx.PreparexContext(ctx, stmtStr)
-	} else {
-		stmt, err = r.db.PreparexContext(ctx, stmtStr)
+// copyRows converts each record and streams it through the prepared COPY statement copySQL
+// Columns flagged in required reject rows whose value is empty; required may be nil
+// When opts.BatchID is set, copySQL must list BatchColumn after the columns
+func copyRows(ctx context.Context, tx *sqlx.Tx, copySQL, tableName string, columnDefs []models.ColumnDefinition, rows RowReader, opts *InsertOptions, required []bool) (int64, *apperrors.AppError) {
+	recordWidth := len(columnDefs)
+	if opts.Sources != nil {
+		recordWidth = opts.RecordWidth
 	}
 
+	stmt, err := tx.PrepareContext(ctx, copySQL)
 	if err != nil {
-		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to prepare insert statement for table '%s'", tableName))
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to prepare COPY statement for table '%s'", tableName))
 	}
 	defer stmt.Close()
 
-	for i, record := range records {
-		if len(record) != len(columnDefs) {
-			return apperrors.New("data_mismatch", fmt.Sprintf("row %d (1-indexed) has %d values, expected %d", i+1, len(record), len(columnDefs)))
+	var rowCount, rowNum int64
+	values := make([]any, len(columnDefs), len(columnDefs)+1)
+	if opts.BatchID != "" {
+		values = append(values, opts.BatchID)
+	}
+rowLoop:
+	for {
+		record, readErr := rows.Read()
+		if readErr == io.EOF {
+			break
+		}
+		rowNum++
+		if readErr != nil {
+			return rowCount, apperrors.Wrap(readErr, apperrors.ErrCSVProcessing, fmt.Sprintf("failed to read row %d (1-indexed)", rowNum))
+		}
+		if rowNum%ProgressInterval == 0 {
+			// Rows buffered by COPY never reach the server, so cancellation has to be noticed here
+			if err := ctx.Err(); err != nil {
+				return rowCount, apperrors.Wrap(err, apperrors.ErrCancelled)
+			}
+			if opts.OnProgress != nil {
+				opts.OnProgress(rowNum-1, rowCount)
+			}
 		}
 
-		values := make([]any, len(record))
-		for j, valStr := range record {
-			colType := strings.ToUpper(columnDefs[j].Type)
-			cleanValStr := strings.TrimSpace(valStr)
+		if len(record) != recordWidth {
+			rowErr := models.RowError{Row: rowNum, Reason: fmt.Sprintf("row has %d values, expected %d", len(record), recordWidth)}
+			if opts.OnReject == nil {
+				return rowCount, apperrors.New("data_mismatch", fmt.Sprintf("row %d (1-indexed) has %d values, expected %d", rowNum, len(record), recordWidth))
+			}
+			if appErr := opts.OnReject(rowErr, record); appErr != nil {
+				return rowCount, appErr
+			}
+			continue
+		}
 
-			if cleanValStr == "" {
+		for j := range columnDefs {
+			source := j
+			if opts.Sources != nil {
+				source = opts.Sources[j]
+			}
+			if source < 0 {
 				values[j] = nil
 				continue
 			}
-
-			var convErr error
-			switch colType {
-			case "INT", "INTEGER", "BIGINT":
-				values[j], convErr = strconv.ParseInt(cleanValStr, 10, 64)
-			case "DECIMAL", "NUMERIC", "REAL", "FLOAT", "DOUBLE":
-				values[j], convErr = strconv.ParseFloat(cleanValStr, 64)
-			case "DATE":
-				layouts := []string{
-					"2006-01-02",
-					"01/02/2006",
-					"2006/01/02",
-					"Jan 2, 2006",
-					"2-Jan-2006",
-					time.RFC3339[:10],
+			valStr := record[source]
+			value, convErr := convertValue(columnDefs[j].Type, valStr)
+			if convErr == nil && value == nil && required != nil && required[j] {
+				rowErr := models.RowError{Row: rowNum, Column: columnDefs[j].Name, Reason: "a value is required"}
+				if opts.OnReject == nil {
+					return rowCount, apperrors.New("data_mismatch", fmt.Sprintf("Row %d, Column '%s': a value is required", rowNum, columnDefs[j].Name))
 				}
-				parsed := false
-				for _, layout := range layouts {
-					if t, perr := time.Parse(layout, cleanValStr); perr == nil {
-						values[j] = t.Format("2006-01-02")
-						parsed = true
-						break
-					}
+				if appErr := opts.OnReject(rowErr, record); appErr != nil {
+					return rowCount, appErr
 				}
-				if !parsed {
-					values[j] = cleanValStr
-				}
-			case "TIMESTAMP", "DATETIME":
-				layouts := []string{
-					time.RFC3339,
-					time.RFC3339Nano,
-					"2006-01-02 15:04:05",
-					"2006-01-02T15:04:05Z07:00",
-					"2006-01-02T15:04:05",
-					"01/02/2006 15:04:05",
-					"Jan 2, 2006 15:04:05",
-				}
-				parsed := false
-				for _, layout := range layouts {
-					if t, perr := time.Parse(layout, cleanValStr); perr == nil {
-						values[j] = t.Format("2006-01-02 15:04:05.999999")
-						parsed = true
-						break
-					}
+				continue rowLoop
+			}
+			if convErr != nil {
+				if opts.OnReject == nil {
+					return rowCount, apperrors.Wrap(convErr, apperrors.ErrTypeConversion, fmt.Sprintf("Row %d, Column '%s': Failed to parse '%s' as %s", rowNum, columnDefs[j].Name, valStr, strings.ToUpper(columnDefs[j].Type)))
 				}
-				if !parsed {
-					values[j] = cleanValStr
+				rowErr := models.RowError{
+					Row:    rowNum,
+					Column: columnDefs[j].Name,
+					Value:  valStr,
+					Reason: fmt.Sprintf("failed to parse as %s", strings.ToUpper(columnDefs[j].Type)),
 				}
-			case "BOOLEAN":
-				lowerVal := strings.ToLower(cleanValStr)
-				if lowerVal == "true" || lowerVal == "1" || lowerVal == "yes" || lowerVal == "t" {
-					values[j] = true
-				} else if lowerVal == "false" || lowerVal == "0" || lowerVal == "no" || lowerVal == "f" {
-					values[j] = false
-				} else {
-					convErr = fmt.Errorf("unrecognized boolean value '%s'", valStr)
+				if appErr := opts.OnReject(rowErr, record); appErr != nil {
+					return rowCount, appErr
 				}
-			default: // TEXT
-				values[j] = valStr
-			}
-
-			if convErr != nil {
-				return apperrors.Wrap(convErr, apperrors.ErrTypeConversion, fmt.Sprintf("Row %d, Column '%s': Failed to parse '%s' as %s", i+1, columnDefs[j].Name, valStr, colType))
+				continue rowLoop
 			}
+			values[j] = value
 		}
 
-		_, err = stmt.ExecContext(ctx, values...)
-		if err != nil {
-			if pqErr, ok := err.(*pq.Error); ok {
-				return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to insert row %d into table '%s'. DB Error: %s (Detail: %s, Code: %s)", i+1, tableName, pqErr.Message, pqErr.Detail, pqErr.Code))
-			}
-			return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to insert row %d into table '%s'", i+1, tableName))
+		// With COPY, rows are buffered and flushed by the driver, so DB errors usually surface on the final flush below
+		if _, err = stmt.ExecContext(ctx, values...); err != nil {
+			return rowCount, wrapCopyError(err, tableName)
 		}
+		rowCount++
 	}
-	return nil
+
+	if _, err = stmt.ExecContext(ctx); err != nil { // Flush the remaining buffered rows
+		return rowCount, wrapCopyError(err, tableName)
+	}
+	if opts.OnProgress != nil {
+		opts.OnProgress(rowNum, rowCount)
+	}
+	return rowCount, nil
+}
+
+// wrapCopyError converts an error raised during COPY into an AppError, including PostgreSQL details when available
+func wrapCopyError(err error, tableName string) *apperrors.AppError {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to copy rows into table '%s'. DB Error: %s (Detail: %s, Where: %s, Code: %s)", tableName, pqErr.Message, pqErr.Detail, pqErr.Where, pqErr.Code))
+	}
+	return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to copy rows into table '%s'", tableName))
 }
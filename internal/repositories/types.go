@@ -0,0 +1,123 @@
+package repositories
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxNumericPrecision is the largest precision PostgreSQL accepts for NUMERIC(p,s)
+const maxNumericPrecision = 1000
+
+var numericTypeRegex = regexp.MustCompile(`^(?:NUMERIC|DECIMAL)\s*\(\s*(\d+)\s*(?:,\s*(\d+)\s*)?\)$`)
+
+// baseType returns the upper-cased name of an application type without its parameters, e.g. "NUMERIC" for "numeric(12,2)"
+func baseType(colType string) string {
+	colType = strings.ToUpper(strings.TrimSpace(colType))
+	if idx := strings.IndexByte(colType, '('); idx >= 0 {
+		colType = strings.TrimSpace(colType[:idx])
+	}
+	return colType
+}
+
+// parseNumericType extracts the precision and scale of a type such as "NUMERIC(12,2)"
+// ok is false for an unconstrained NUMERIC, or when the precision or scale is out of range
+func parseNumericType(colType string) (precision, scale int, ok bool) {
+	m := numericTypeRegex.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(colType)))
+	if m == nil {
+		return 0, 0, false
+	}
+	precision, err := strconv.Atoi(m[1])
+	if err != nil || precision < 1 || precision > maxNumericPrecision {
+		return 0, 0, false
+	}
+	if m[2] != "" {
+		if scale, err = strconv.Atoi(m[2]); err != nil || scale > precision {
+			return 0, 0, false
+		}
+	}
+	return precision, scale, true
+}
+
+// mapToPostgresType maps similar datatypes to their PostgreSQL equivalent
+func mapToPostgresType(userType string) string {
+	switch baseType(userType) {
+	case "INT", "INTEGER":
+		return "INTEGER"
+	case "BIGINT":
+		return "BIGINT"
+	case "DECIMAL", "NUMERIC":
+		if precision, scale, ok := parseNumericType(userType); ok {
+			return fmt.Sprintf("NUMERIC(%d,%d)", precision, scale)
+		}
+		return "NUMERIC"
+	case "REAL", "FLOAT", "DOUBLE":
+		return "REAL"
+	case "DATE":
+		return "DATE"
+	case "TIMESTAMP", "DATETIME":
+		return "TIMESTAMP WITHOUT TIME ZONE"
+	case "TIMESTAMPTZ":
+		return "TIMESTAMP WITH TIME ZONE"
+	case "TIME":
+		return "TIME WITHOUT TIME ZONE"
+	case "INTERVAL":
+		return "INTERVAL"
+	case "UUID":
+		return "UUID"
+	case "JSON", "JSONB":
+		return "JSONB"
+	case "BOOLEAN":
+		return "BOOLEAN"
+	default:
+		return "TEXT"
+	}
+}
+
+// mapToAppType maps similar datatypes from Postgres to their application equivalent
+// For numeric columns, the declared precision and scale are carried over when present
+func mapToAppType(pgType string, precision, scale sql.NullInt64) string {
+	pgType = strings.ToLower(strings.TrimSpace(pgType))
+
+	switch {
+	case pgType == "integer" || pgType == "smallint" || pgType == "serial" || pgType == "smallserial":
+		return "INTEGER"
+	case pgType == "bigint" || pgType == "bigserial":
+		return "BIGINT"
+	case pgType == "numeric" || pgType == "decimal":
+		if precision.Valid {
+			return fmt.Sprintf("NUMERIC(%d,%d)", precision.Int64, scale.Int64)
+		}
+		return "NUMERIC"
+	case pgType == "real" || pgType == "double precision":
+		return "REAL"
+	case pgType == "boolean":
+		return "BOOLEAN"
+	case pgType == "date":
+		return "DATE"
+	case pgType == "timestamp with time zone":
+		return "TIMESTAMPTZ"
+	case strings.HasPrefix(pgType, "timestamp"): // "timestamp without time zone"
+		return "TIMESTAMP"
+	case strings.HasPrefix(pgType, "time"): // "time without time zone", "time with time zone"
+		return "TIME"
+	case pgType == "interval":
+		return "INTERVAL"
+	case pgType == "uuid":
+		return "UUID"
+	case pgType == "json" || pgType == "jsonb":
+		return "JSONB"
+	case pgType == "text":
+		return "TEXT"
+	case strings.HasPrefix(pgType, "character varying"): // varchar(n)
+		return "TEXT"
+	case strings.HasPrefix(pgType, "char"): // char(n)
+		return "TEXT"
+	case pgType == "bytea":
+		return "TEXT"
+	default:
+		return "TEXT"
+	}
+}
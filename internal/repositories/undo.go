@@ -0,0 +1,120 @@
+package repositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// BatchColumn tags the rows loaded by an append with the ID of their import batch, so the append can be undone
+// GetTableSchema leaves it out, so it is never mapped, previewed or copied into a new table
+const BatchColumn = "_sheetbridge_batch"
+
+// backupSchema holds the tables replaced by overwrites until they are restored or expire
+const backupSchema = "sheetbridge"
+
+// BackupTableName returns the name a table is kept under once an overwrite replaces it at the given time
+// The table name is shortened so the backup name fits the 63 bytes PostgreSQL allows
+func BackupTableName(tableName string, at time.Time) string {
+	at = at.UTC()
+	suffix := fmt.Sprintf("_backup_%s%03d", at.Format("20060102150405"), at.Nanosecond()/int(time.Millisecond))
+	if maxLen := 63 - len(suffix); len(tableName) > maxLen {
+		tableName = tableName[:maxLen]
+	}
+	return tableName + suffix
+}
+
+// BackupTableSQL returns the statements BackupTable runs
+func BackupTableSQL(table models.TableRef, backupName string) []string {
+	backup := models.TableRef{Schema: table.Schema, Name: backupName}
+	return []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", quoteTable(table), pq.QuoteIdentifier(backupName)),
+		fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s;", quoteTable(backup), pq.QuoteIdentifier(backupSchema)),
+	}
+}
+
+// BackupTable moves a table into the backup schema under its backup name, along with its indexes and constraints,
+// instead of dropping it
+func (r *DBRepository) BackupTable(ctx context.Context, tx *sqlx.Tx, table models.TableRef, backupName string) *apperrors.AppError {
+	for _, query := range BackupTableSQL(table, backupName) {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to back up table '%s' as '%s'", table, backupName))
+		}
+	}
+	return nil
+}
+
+// RestoreBackupSQL returns the statements RestoreBackup runs
+func RestoreBackupSQL(table models.TableRef, backupName string) []string {
+	backup := models.TableRef{Schema: backupSchema, Name: backupName}
+	restored := models.TableRef{Schema: table.Schema, Name: backupName}
+	return []string{
+		DropTableSQL(table),
+		fmt.Sprintf("ALTER TABLE %s SET SCHEMA %s;", quoteTable(backup), pq.QuoteIdentifier(table.Schema)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", quoteTable(restored), pq.QuoteIdentifier(table.Name)),
+	}
+}
+
+// RestoreBackup replaces a table with its backup, returning ErrNotFound when the backup no longer exists
+func (r *DBRepository) RestoreBackup(ctx context.Context, tx *sqlx.Tx, table models.TableRef, backupName string) *apperrors.AppError {
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, "SELECT to_regclass($1) IS NOT NULL;", quoteTable(models.TableRef{Schema: backupSchema, Name: backupName})); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to look up backup table '%s'", backupName))
+	}
+	if !exists {
+		return apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("The backup '%s' of table '%s' no longer exists.", backupName, table))
+	}
+
+	for _, query := range RestoreBackupSQL(table, backupName) {
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok {
+				return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to restore table '%s' from backup '%s'. DB Error: %s (Detail: %s, Code: %s)", table, backupName, pqErr.Message, pqErr.Detail, pqErr.Code))
+			}
+			return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to restore table '%s' from backup '%s'", table, backupName))
+		}
+	}
+	return nil
+}
+
+// DropBackup drops a backup table once it is no longer needed
+func (r *DBRepository) DropBackup(ctx context.Context, backupName string) *apperrors.AppError {
+	if _, err := r.db.ExecContext(ctx, DropTableSQL(models.TableRef{Schema: backupSchema, Name: backupName})); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to drop backup table '%s'", backupName))
+	}
+	return nil
+}
+
+// BatchColumnSQL returns the statement EnsureBatchColumn runs
+func BatchColumnSQL(table models.TableRef) string {
+	return fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s UUID;", quoteTable(table), pq.QuoteIdentifier(BatchColumn))
+}
+
+// EnsureBatchColumn adds the batch column to a table that does not have it yet
+func (r *DBRepository) EnsureBatchColumn(ctx context.Context, tx *sqlx.Tx, table models.TableRef) *apperrors.AppError {
+	if _, err := tx.ExecContext(ctx, BatchColumnSQL(table)); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to add batch column to table '%s'", table))
+	}
+	return nil
+}
+
+// DeleteBatch deletes the rows of a table that were loaded by the given import batch and returns how many there were
+func (r *DBRepository) DeleteBatch(ctx context.Context, tx *sqlx.Tx, table models.TableRef, batchID string) (int64, *apperrors.AppError) {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1;", quoteTable(table), pq.QuoteIdentifier(BatchColumn))
+	res, err := tx.ExecContext(ctx, query, batchID)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && (pqErr.Code == "42P01" || pqErr.Code == "42703") { // undefined_table, undefined_column
+			return 0, apperrors.Wrap(err, apperrors.ErrNotFound, fmt.Sprintf("Table '%s' no longer holds the rows of this import.", table))
+		}
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to delete the rows of batch '%s' from table '%s'", batchID, table))
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to count the rows deleted from table '%s'", table))
+	}
+	return deleted, nil
+}
@@ -0,0 +1,167 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// stagingTable is the session-local temp table rows are copied into before they are merged into the target table
+const stagingTable = "sheetbridge_upsert_stage"
+
+// stagingRowColumn numbers the staged rows so the last row wins when the file repeats a key
+const stagingRowColumn = "_sheetbridge_row"
+
+// EnsureUniqueIndex checks that the table has a unique index on exactly the key columns, creating one when it does not
+// The index must exist for INSERT ... ON CONFLICT to use the key columns as its conflict target
+// It returns the CREATE INDEX statement it ran, or an empty string when a suitable index already existed
+func (r *DBRepository) EnsureUniqueIndex(ctx context.Context, tx *sqlx.Tx, table models.TableRef, keyColumns []string) (string, *apperrors.AppError) {
+	if len(keyColumns) == 0 {
+		return "", apperrors.New("invalid_operation_upsert", "key columns are required for an upsert")
+	}
+	sortedKeys := slices.Clone(keyColumns)
+	slices.Sort(sortedKeys)
+
+	// Partial and expression indexes cannot serve as a conflict target, and INCLUDE columns are not part of the key
+	query := `
+		SELECT EXISTS (
+			SELECT FROM pg_catalog.pg_index i
+			WHERE i.indrelid = $1::regclass
+				AND i.indisunique
+				AND i.indpred IS NULL
+				AND i.indexprs IS NULL
+				AND i.indnkeyatts = $2
+				AND ARRAY(
+					SELECT a.attname::text
+					FROM pg_catalog.pg_attribute a
+					WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey::int2[])
+					ORDER BY 1
+				) = $3::text[]
+		);
+	`
+	var exists bool
+	if err := tx.GetContext(ctx, &exists, query, quoteTable(table), len(sortedKeys), pq.Array(sortedKeys)); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to look up unique indexes of table '%s'", table))
+	}
+	if exists {
+		return "", nil
+	}
+
+	quotedKeys := make([]string, len(keyColumns))
+	for i, key := range keyColumns {
+		quotedKeys[i] = pq.QuoteIdentifier(key)
+	}
+	create := fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s);", pq.QuoteIdentifier(uniqueIndexName(table, keyColumns)), quoteTable(table), strings.Join(quotedKeys, ", "))
+	if _, err := tx.ExecContext(ctx, create); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+			return "", apperrors.Wrap(err, apperrors.ErrDataConflict, fmt.Sprintf("Cannot upsert on (%s): table '%s' already has rows sharing the same key. %s", strings.Join(keyColumns, ", "), table, pqErr.Detail))
+		}
+		return "", apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to create unique index on (%s) of table '%s'", strings.Join(keyColumns, ", "), table))
+	}
+	return create, nil
+}
+
+// maxIdentifierLength is the longest name PostgreSQL keeps; longer names are silently truncated
+const maxIdentifierLength = 63
+
+// uniqueIndexName returns the name of the unique index created for upserts on the key columns of a table
+// Joining the column names could collide, e.g. for keys "a_b" and "a, b", or be truncated into another index's name,
+// so the name ends with a hash of the table and its key columns and is kept within maxIdentifierLength
+func uniqueIndexName(table models.TableRef, keyColumns []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(append([]string{table.Schema, table.Name}, keyColumns...), "\x00")))
+	suffix := "_" + hex.EncodeToString(sum[:6]) + "_key"
+	prefix := table.Name
+	for len(prefix) > maxIdentifierLength-len(suffix) {
+		_, size := utf8.DecodeLastRuneInString(prefix)
+		prefix = prefix[:len(prefix)-size]
+	}
+	return prefix + suffix
+}
+
+// UpsertData streams rows into a temp staging table with COPY, then merges them into the table with
+// INSERT ... ON CONFLICT (keyColumns) DO UPDATE, so rows whose key already exists are updated in place
+// Rows with an empty key are rejected; when the file repeats a key, its last row wins
+// It returns how many rows were inserted and how many were updated; tx must not be nil
+func (r *DBRepository) UpsertData(ctx context.Context, tx *sqlx.Tx, table models.TableRef, columnDefs []models.ColumnDefinition, keyColumns []string, rows RowReader, opts *InsertOptions) (inserted, updated int64, appErr *apperrors.AppError) {
+	if len(columnDefs) == 0 || len(keyColumns) == 0 {
+		return 0, 0, apperrors.New("invalid_operation_upsert", "column definitions and key columns are required for an upsert")
+	}
+	if opts == nil {
+		opts = &InsertOptions{}
+	}
+	if opts.Sources != nil && len(opts.Sources) != len(columnDefs) {
+		return 0, 0, apperrors.New("invalid_operation_upsert", "a source is required for every column")
+	}
+	if opts.BatchID != "" {
+		return 0, 0, apperrors.New("invalid_operation_upsert", "upserted rows cannot be tagged with a batch")
+	}
+
+	quotedCols := make([]string, len(columnDefs))
+	required := make([]bool, len(columnDefs))
+	for i, cd := range columnDefs {
+		quotedCols[i] = pq.QuoteIdentifier(cd.Name)
+		required[i] = slices.Contains(keyColumns, cd.Name)
+	}
+	quotedKeys := make([]string, len(keyColumns))
+	for i, key := range keyColumns {
+		if !slices.Contains(columnNames(columnDefs), key) {
+			return 0, 0, apperrors.New("invalid_operation_upsert", fmt.Sprintf("key column '%s' is not loaded", key))
+		}
+		quotedKeys[i] = pq.QuoteIdentifier(key)
+	}
+
+	// The staging table copies the column types of the target table, but none of its constraints or defaults
+	stage := fmt.Sprintf(
+		"CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA; ALTER TABLE %s ADD COLUMN %s BIGSERIAL;",
+		stagingTable, strings.Join(quotedCols, ", "), quoteTable(table), stagingTable, stagingRowColumn,
+	)
+	if _, err := tx.ExecContext(ctx, stage); err != nil {
+		return 0, 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to create staging table for '%s'", table))
+	}
+
+	if _, appErr = copyRows(ctx, tx, pq.CopyIn(stagingTable, columnNames(columnDefs)...), table.String(), columnDefs, rows, opts, required); appErr != nil {
+		return 0, 0, appErr
+	}
+
+	conflict := "DO NOTHING" // Every loaded column is part of the key, so there is nothing to update
+	var updates []string
+	for _, col := range quotedCols {
+		if !slices.Contains(quotedKeys, col) {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+		}
+	}
+	if len(updates) > 0 {
+		conflict = "DO UPDATE SET " + strings.Join(updates, ", ")
+	}
+
+	// xmax is 0 for freshly inserted rows and set for rows that were updated by ON CONFLICT
+	merge := fmt.Sprintf(`
+		WITH merged AS (
+			INSERT INTO %s (%s)
+			SELECT DISTINCT ON (%s) %s FROM %s ORDER BY %s, %s DESC
+			ON CONFLICT (%s) %s
+			RETURNING (xmax = 0) AS inserted
+		)
+		SELECT COUNT(*) FILTER (WHERE inserted), COUNT(*) FILTER (WHERE NOT inserted) FROM merged;
+	`,
+		quoteTable(table), strings.Join(quotedCols, ", "),
+		strings.Join(quotedKeys, ", "), strings.Join(quotedCols, ", "), stagingTable, strings.Join(quotedKeys, ", "), stagingRowColumn,
+		strings.Join(quotedKeys, ", "), conflict,
+	)
+	if err := tx.QueryRowxContext(ctx, merge).Scan(&inserted, &updated); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok {
+			return 0, 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("Failed to merge rows into table '%s'. DB Error: %s (Detail: %s, Code: %s)", table, pqErr.Message, pqErr.Detail, pqErr.Code))
+		}
+		return 0, 0, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to merge rows into table '%s'", table))
+	}
+	return inserted, updated, nil
+}
@@ -0,0 +1,132 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/lib/pq"
+)
+
+// userColumns are the columns of sheetbridge.users, created by the users migration
+const userColumns = "id, username, password_hash, created_at"
+
+// CreateUser adds a user, setting its ID and creation time
+// It returns ErrDataConflict when the username is taken
+func (r *DBRepository) CreateUser(ctx context.Context, user *models.User) *apperrors.AppError {
+	query := `
+		INSERT INTO sheetbridge.users (username, password_hash)
+		VALUES ($1, $2)
+		RETURNING id, created_at;
+	`
+	if err := r.db.QueryRowxContext(ctx, query, user.Username, user.PasswordHash).Scan(&user.ID, &user.CreatedAt); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" { // unique_violation
+			return apperrors.Wrap(err, apperrors.ErrDataConflict, fmt.Sprintf("User '%s' already exists.", user.Username))
+		}
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to create user '%s'", user.Username))
+	}
+	return nil
+}
+
+// GetUserByName returns a user, or ErrNotFound when there is no user with that name
+func (r *DBRepository) GetUserByName(ctx context.Context, username string) (*models.User, *apperrors.AppError) {
+	var user models.User
+	query := fmt.Sprintf("SELECT %s FROM sheetbridge.users WHERE username = $1;", userColumns)
+	if err := r.db.GetContext(ctx, &user, query, username); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperrors.Wrap(err, apperrors.ErrNotFound, fmt.Sprintf("User '%s' does not exist.", username))
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to look up user '%s'", username))
+	}
+	return &user, nil
+}
+
+// CountUsers returns how many users exist
+func (r *DBRepository) CountUsers(ctx context.Context) (int64, *apperrors.AppError) {
+	var count int64
+	if err := r.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM sheetbridge.users;"); err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to count users")
+	}
+	return count, nil
+}
+
+// CreateSession stores a session of a user under the hash of its token
+func (r *DBRepository) CreateSession(ctx context.Context, tokenHash string, userID int64, expiresAt time.Time) *apperrors.AppError {
+	query := "INSERT INTO sheetbridge.sessions (token_hash, user_id, expires_at) VALUES ($1, $2, $3);"
+	if _, err := r.db.ExecContext(ctx, query, tokenHash, userID, expiresAt); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, "failed to create session")
+	}
+	return nil
+}
+
+// GetSessionUser returns the user of an unexpired session, or ErrNotFound when there is no such session
+func (r *DBRepository) GetSessionUser(ctx context.Context, tokenHash string) (*models.User, *apperrors.AppError) {
+	var user models.User
+	query := `
+		SELECT u.id, u.username, u.password_hash, u.created_at
+		FROM sheetbridge.sessions s
+		JOIN sheetbridge.users u ON u.id = s.user_id
+		WHERE s.token_hash = $1 AND s.expires_at > now();
+	`
+	if err := r.db.GetContext(ctx, &user, query, tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, apperrors.Wrap(err, apperrors.ErrNotFound, "session does not exist or has expired")
+		}
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to look up session")
+	}
+	return &user, nil
+}
+
+// DeleteSession removes a session, signing its user out
+func (r *DBRepository) DeleteSession(ctx context.Context, tokenHash string) *apperrors.AppError {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM sheetbridge.sessions WHERE token_hash = $1;", tokenHash); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrDatabase, "failed to delete session")
+	}
+	return nil
+}
+
+// DeleteExpiredSessions removes the sessions that expired before now and returns how many there were
+func (r *DBRepository) DeleteExpiredSessions(ctx context.Context) (int64, *apperrors.AppError) {
+	res, err := r.db.ExecContext(ctx, "DELETE FROM sheetbridge.sessions WHERE expires_at <= now();")
+	if err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to delete expired sessions")
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to count expired sessions")
+	}
+	return deleted, nil
+}
+
+// GetUserPermissions returns the permissions granted to a user through their roles
+func (r *DBRepository) GetUserPermissions(ctx context.Context, userID int64) ([]models.Permission, *apperrors.AppError) {
+	var permissions []models.Permission
+	query := `
+		SELECT p.role, p.schema_pattern, p.table_pattern, p.action
+		FROM sheetbridge.user_roles ur
+		JOIN sheetbridge.role_permissions p ON p.role = ur.role
+		WHERE ur.user_id = $1
+		ORDER BY p.role, p.id;
+	`
+	if err := r.db.SelectContext(ctx, &permissions, query, userID); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to look up user permissions")
+	}
+	return permissions, nil
+}
+
+// GrantRole gives a user a role, doing nothing when they already hold it
+// It returns ErrNotFound when the role does not exist
+func (r *DBRepository) GrantRole(ctx context.Context, userID int64, role string) *apperrors.AppError {
+	query := "INSERT INTO sheetbridge.user_roles (user_id, role) VALUES ($1, $2) ON CONFLICT DO NOTHING;"
+	if _, err := r.db.ExecContext(ctx, query, userID, role); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" { // foreign_key_violation
+			return apperrors.Wrap(err, apperrors.ErrNotFound, fmt.Sprintf("Role '%s' does not exist.", role))
+		}
+		return apperrors.Wrap(err, apperrors.ErrDatabase, fmt.Sprintf("failed to grant role '%s'", role))
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Authentication modes
+const (
+	AuthLocal = "local" // Users sign in with a password stored by SheetBridge
+	AuthProxy = "proxy" // A trusted reverse proxy passes the signed-in username in a header
+	AuthNone  = "none"  // Everyone is let in anonymously
+)
+
+// MinPasswordLength is the shortest password a local user may have
+const MinPasswordLength = 8
+
+// AdminRole is the role, created by the roles migration, that may run every action on every table
+// The bootstrapped user is given it
+const AdminRole = "admin"
+
+// AuthOptions controls how users are authenticated
+type AuthOptions struct {
+	Mode           string
+	SessionTTL     time.Duration  // How long a sign-in lasts
+	CookieSecure   bool           // Whether the session cookie is only sent over HTTPS
+	ProxyHeader    string         // Header holding the username in proxy mode
+	TrustedProxies []netip.Prefix // Addresses whose proxy header is believed
+	DefaultRoles   []string       // Roles given to every user SheetBridge creates
+}
+
+// AuthService signs users in and out and tells who made a request
+type AuthService struct {
+	logger    *logger.Logger
+	repo      *repositories.DBRepository
+	opts      AuthOptions
+	dummyHash []byte // Compared against when a user does not exist, so sign-in takes as long either way
+}
+
+// NewAuthService returns a new authentication service
+func NewAuthService(l *logger.Logger, repo *repositories.DBRepository, opts AuthOptions) *AuthService {
+	dummyHash, _ := bcrypt.GenerateFromPassword([]byte("sheetbridge"), bcrypt.DefaultCost)
+	return &AuthService{logger: l, repo: repo, opts: opts, dummyHash: dummyHash}
+}
+
+// Mode returns the authentication mode: AuthLocal, AuthProxy or AuthNone
+func (s *AuthService) Mode() string {
+	return s.opts.Mode
+}
+
+// CookieSecure reports whether the session cookie is only sent over HTTPS
+func (s *AuthService) CookieSecure() bool {
+	return s.opts.CookieSecure
+}
+
+// ProxyHeader returns the header a trusted reverse proxy passes the username in
+func (s *AuthService) ProxyHeader() string {
+	return s.opts.ProxyHeader
+}
+
+// CreateUser adds a local user who signs in with the given password
+func (s *AuthService) CreateUser(ctx context.Context, username, password string) (*models.User, *apperrors.AppError) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "A username is required.")
+	}
+	if len(password) < MinPasswordLength {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Passwords must be at least %d characters long.", MinPasswordLength))
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrInvalidInput, "The password cannot be hashed; bcrypt accepts at most 72 bytes.")
+	}
+
+	user := &models.User{Username: username, PasswordHash: string(hash)}
+	if appErr := s.repo.CreateUser(ctx, user); appErr != nil {
+		return nil, appErr
+	}
+	s.grantDefaultRoles(ctx, user)
+	return user, nil
+}
+
+// grantDefaultRoles gives a new user the default roles. A role that cannot be given is logged rather than failing,
+// since the user exists by then
+func (s *AuthService) grantDefaultRoles(ctx context.Context, user *models.User) {
+	for _, role := range s.opts.DefaultRoles {
+		if appErr := s.repo.GrantRole(ctx, user.ID, role); appErr != nil {
+			s.logger.Error(appErr)
+		}
+	}
+}
+
+// Bootstrap creates the first local user as an admin, unless users already exist. It reports whether the user was
+// created
+func (s *AuthService) Bootstrap(ctx context.Context, username, password string) (bool, *apperrors.AppError) {
+	count, appErr := s.repo.CountUsers(ctx)
+	if appErr != nil || count > 0 {
+		return false, appErr
+	}
+	user, appErr := s.CreateUser(ctx, username, password)
+	if appErr != nil {
+		return false, appErr
+	}
+	if appErr = s.repo.GrantRole(ctx, user.ID, AdminRole); appErr != nil {
+		return true, appErr
+	}
+	return true, nil
+}
+
+// Authenticate checks a local user's password, returning ErrUnauthorized when the user does not exist, has no
+// password or gave the wrong one
+func (s *AuthService) Authenticate(ctx context.Context, username, password string) (*models.User, *apperrors.AppError) {
+	invalid := apperrors.Wrap(nil, apperrors.ErrUnauthorized, "Invalid username or password.")
+
+	user, appErr := s.repo.GetUserByName(ctx, strings.TrimSpace(username))
+	if appErr != nil {
+		if !apperrors.Is(appErr, apperrors.ErrNotFound) {
+			return nil, appErr
+		}
+		bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+		return nil, invalid
+	}
+	if user.PasswordHash == "" {
+		bcrypt.CompareHashAndPassword(s.dummyHash, []byte(password))
+		return nil, invalid
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, invalid
+	}
+	return s.withPermissions(ctx, user)
+}
+
+// Login checks a local user's password and starts a session, returning its token and when it expires
+func (s *AuthService) Login(ctx context.Context, username, password string) (*models.User, string, time.Time, *apperrors.AppError) {
+	user, appErr := s.Authenticate(ctx, username, password)
+	if appErr != nil {
+		return nil, "", time.Time{}, appErr
+	}
+
+	// Sessions are only ever looked up unexpired, so clearing out old ones can wait for the next sign-in
+	if _, appErr := s.repo.DeleteExpiredSessions(ctx); appErr != nil {
+		s.logger.Error(appErr)
+	}
+
+	tokenBytes := make([]byte, 32)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return nil, "", time.Time{}, apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate session token")
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenBytes)
+	expiresAt := time.Now().Add(s.opts.SessionTTL)
+	if appErr := s.repo.CreateSession(ctx, hashToken(token), user.ID, expiresAt); appErr != nil {
+		return nil, "", time.Time{}, appErr
+	}
+	return user, token, expiresAt, nil
+}
+
+// Logout ends a session
+func (s *AuthService) Logout(ctx context.Context, token string) *apperrors.AppError {
+	return s.repo.DeleteSession(ctx, hashToken(token))
+}
+
+// SessionUser returns the user signed in with a session token, or ErrUnauthorized when the session does not exist
+// or has expired
+func (s *AuthService) SessionUser(ctx context.Context, token string) (*models.User, *apperrors.AppError) {
+	user, appErr := s.repo.GetSessionUser(ctx, hashToken(token))
+	if appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrNotFound) {
+			return nil, apperrors.Wrap(appErr, apperrors.ErrUnauthorized, "Your session has expired. Please sign in again.")
+		}
+		return nil, appErr
+	}
+	return s.withPermissions(ctx, user)
+}
+
+// TrustsProxy reports whether a request from remoteAddr ("host:port") comes from a trusted reverse proxy
+func (s *AuthService) TrustsProxy(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	return slices.ContainsFunc(s.opts.TrustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(addr) })
+}
+
+// ProxyUser returns the user a trusted reverse proxy signed in, creating it with the default roles on first sight so
+// it can be referred to like a local user. Such users have no password
+func (s *AuthService) ProxyUser(ctx context.Context, username string) (*models.User, *apperrors.AppError) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return nil, apperrors.Wrap(nil, apperrors.ErrUnauthorized, fmt.Sprintf("The request has no '%s' header.", s.opts.ProxyHeader))
+	}
+
+	user, appErr := s.repo.GetUserByName(ctx, username)
+	if appErr != nil && apperrors.Is(appErr, apperrors.ErrNotFound) {
+		user, appErr = s.createProxyUser(ctx, username)
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+	return s.withPermissions(ctx, user)
+}
+
+// createProxyUser adds a user first signed in by the reverse proxy
+func (s *AuthService) createProxyUser(ctx context.Context, username string) (*models.User, *apperrors.AppError) {
+	user := &models.User{Username: username}
+	if appErr := s.repo.CreateUser(ctx, user); appErr != nil {
+		if apperrors.Is(appErr, apperrors.ErrDataConflict) {
+			return s.repo.GetUserByName(ctx, username) // Created by a concurrent request
+		}
+		return nil, appErr
+	}
+	s.grantDefaultRoles(ctx, user)
+	s.logger.Infof("Added user '%s' signed in by the reverse proxy", username)
+	return user, nil
+}
+
+// withPermissions loads the permissions a user holds through their roles
+func (s *AuthService) withPermissions(ctx context.Context, user *models.User) (*models.User, *apperrors.AppError) {
+	permissions, appErr := s.repo.GetUserPermissions(ctx, user.ID)
+	if appErr != nil {
+		return nil, appErr
+	}
+	user.Permissions = permissions
+	return user, nil
+}
+
+// hashToken returns the hex-encoded SHA-256 of a session token, which is what the database stores
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// userContextKey is the context key of the signed-in user
+type userContextKey struct{}
+
+// ContextWithUser returns a copy of ctx carrying the signed-in user
+func ContextWithUser(ctx context.Context, user *models.User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// UserFromContext returns the signed-in user carried by ctx, or nil when there is none
+func UserFromContext(ctx context.Context) *models.User {
+	user, _ := ctx.Value(userContextKey{}).(*models.User)
+	return user
+}
+
+// UsernameFromContext returns the name of the signed-in user carried by ctx, or "" when there is none
+func UsernameFromContext(ctx context.Context) string {
+	if user := UserFromContext(ctx); user != nil {
+		return user.Username
+	}
+	return ""
+}
+
+// Authorize checks that the signed-in user carried by ctx may run action on table, returning ErrForbidden when they
+// may not. Without a signed-in user, authentication is disabled or the caller is trusted, and everything is allowed
+func Authorize(ctx context.Context, table models.TableRef, action models.CommitAction) *apperrors.AppError {
+	user := UserFromContext(ctx)
+	if user == nil || user.Can(table, action) {
+		return nil
+	}
+	return apperrors.Wrap(nil, apperrors.ErrForbidden, fmt.Sprintf("User '%s' is not allowed to %s table '%s'.", user.Username, action, table))
+}
+
+// AllowedActions returns the commit actions the signed-in user carried by ctx may run on table
+func AllowedActions(ctx context.Context, table models.TableRef) []models.CommitAction {
+	user := UserFromContext(ctx)
+	if user == nil {
+		return models.CommitActions
+	}
+	var allowed []models.CommitAction
+	for _, action := range models.CommitActions {
+		if user.Can(table, action) {
+			allowed = append(allowed, action)
+		}
+	}
+	return allowed
+}
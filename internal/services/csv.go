@@ -1,16 +1,18 @@
 package services
 
 import (
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime/multipart"
 	"os"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
-	"time"
+	"unicode/utf8"
 
 	"github.com/chiltom/SheetBridge/internal/apperrors"
 	"github.com/chiltom/SheetBridge/internal/models"
@@ -28,46 +30,196 @@ var (
 
 // CSVService represents the CSV parsing service
 type CSVService struct {
+	inference InferenceOptions
 	// Dependencies like logger can be added here if needed
 }
 
 // NewCSVService returns a new CSV parsing service instance
-func NewCSVService() *CSVService {
-	return &CSVService{}
+func NewCSVService(inference InferenceOptions) *CSVService {
+	return &CSVService{inference: inference}
 }
 
-// ParseUploadedCSV Parses an uploaded CSV, stores it temporarily, and returns the headers and preview rows
-func (s *CSVService) ParseUploadedCSV(fileHeader *multipart.FileHeader) (headers []string, previewRows [][]string, tempFilePath string, appErr *apperrors.AppError) {
+// Supported upload formats
+const (
+	FormatCSV  = "csv"
+	FormatXLSX = "xlsx"
+)
+
+// RecordStream is a forward-only source of spreadsheet rows, implemented for both CSV files and XLSX worksheets
+// Read returns io.EOF once all rows have been consumed
+type RecordStream interface {
+	Read() ([]string, error)
+	Close() error
+}
+
+// DetectFormat returns the upload format implied by a filename's extension, and whether it is supported
+func (s *CSVService) DetectFormat(filename string) (string, bool) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return FormatCSV, true
+	case ".xlsx":
+		return FormatXLSX, true
+	default:
+		return "", false
+	}
+}
+
+// SpoolUpload copies the entire upload to a temporary file and returns an upload session describing it
+// The session carries the temp file path along with the byte count and SHA-256 checksum of the spooled file
+// For workbooks, the sheet names are listed and the first sheet is selected; for CSV files, the dialect is resolved
+func (s *CSVService) SpoolUpload(fileHeader *multipart.FileHeader, dialect models.CSVDialect) (*models.UploadSession, *apperrors.AppError) {
+	format, ok := s.DetectFormat(fileHeader.Filename)
+	if !ok {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Invalid file type. Please upload a .csv or .xlsx file.")
+	}
+
 	src, err := fileHeader.Open()
 	if err != nil {
-		return nil, nil, "", apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open uploaded file")
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open uploaded file")
 	}
 	defer src.Close()
 
 	// Create a temporary file in the system's default temp directory
 	// For /opt deployment, ensure this temp dir is writable by the app user
 	// Or, configure a specific temp dir path.
-	tempFile, err := os.CreateTemp("", "sheetbridge-upload-*.csv")
+	tempFile, err := os.CreateTemp("", "sheetbridge-upload-*."+format)
 	if err != nil {
-		return nil, nil, "", apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to create temp file")
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to create temp file")
 	}
-	tempFilePath = tempFile.Name()
-
-	tee := io.TeeReader(src, tempFile)
-	csvReader := csv.NewReader(tee)
+	tempFilePath := tempFile.Name()
 
-	headers, err = csvReader.Read()
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tempFile, hasher), src)
 	if err != nil {
 		tempFile.Close()
 		os.Remove(tempFilePath)
-		if err == io.EOF {
-			return nil, nil, "", apperrors.Wrap(err, apperrors.ErrCSVProcessing, "CSV file is empty or has no headers")
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to write upload to temp file")
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFilePath)
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to close temp file after writing")
+	}
+
+	upload := &models.UploadSession{
+		TempFilePath:     tempFilePath,
+		OriginalFilename: fileHeader.Filename,
+		Format:           format,
+		FileSize:         size,
+		FileChecksum:     hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if appErr := s.resolveFormat(upload, dialect); appErr != nil {
+		os.Remove(tempFilePath)
+		return nil, appErr
+	}
+	return upload, nil
+}
+
+// OpenLocalFile returns an upload session for a file already on disk, as SpoolUpload does for an uploaded file
+// The file is not copied: the session refers to it in place, so the caller must not remove it while it is imported
+func (s *CSVService) OpenLocalFile(path string, dialect models.CSVDialect) (*models.UploadSession, *apperrors.AppError) {
+	format, ok := s.DetectFormat(path)
+	if !ok {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid file type for '%s'. Only .csv and .xlsx files can be imported.", path))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to open '%s'", path))
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to read '%s'", path))
+	}
+
+	upload := &models.UploadSession{
+		TempFilePath:     path,
+		OriginalFilename: filepath.Base(path),
+		Format:           format,
+		FileSize:         size,
+		FileChecksum:     hex.EncodeToString(hasher.Sum(nil)),
+	}
+	if appErr := s.resolveFormat(upload, dialect); appErr != nil {
+		return nil, appErr
+	}
+	return upload, nil
+}
+
+// InspectLocalFile opens a file on disk with OpenLocalFile, selects a worksheet when sheet is set, and infers the
+// file's schema, as the preview page does for an upload
+func (s *CSVService) InspectLocalFile(path string, dialect models.CSVDialect, sheet string) (*models.UploadSession, *apperrors.AppError) {
+	upload, appErr := s.OpenLocalFile(path, dialect)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if sheet != "" && sheet != upload.Sheet {
+		if !slices.Contains(upload.Sheets, sheet) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Sheet '%s' does not exist in '%s'.", sheet, upload.OriginalFilename))
+		}
+		upload.Sheet = sheet
+	}
+
+	headers, _, appErr := s.PreviewUpload(upload)
+	if appErr != nil {
+		return nil, appErr
+	}
+	upload.Headers = headers
+	upload.InferredColumnDefs, upload.Inference, appErr = s.InferSchema(upload)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return upload, nil
+}
+
+// OverrideColumnTypes returns the names and types of inferred columns, with the types given by overrides, which name
+// columns by their header or their sanitized name. An override naming no column is an ErrInvalidInput
+func (s *CSVService) OverrideColumnTypes(inferred []models.ColumnDefinition, overrides map[string]string) ([]string, []string, *apperrors.AppError) {
+	names := make([]string, len(inferred))
+	types := make([]string, len(inferred))
+	used := map[string]bool{}
+	for i, col := range inferred {
+		names[i], types[i] = col.Name, col.Type
+		for _, key := range []string{col.Name, s.SanitizeSQLName(col.Name)} {
+			if colType, ok := overrides[key]; ok {
+				types[i] = colType
+				used[key] = true
+			}
+		}
+	}
+	for key := range overrides {
+		if !used[key] {
+			return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("The file has no column '%s' to set the type of.", key))
+		}
+	}
+	return names, types, nil
+}
+
+// resolveFormat lists the sheets of a workbook and selects the first one, and resolves the dialect of a CSV file
+func (s *CSVService) resolveFormat(upload *models.UploadSession, dialect models.CSVDialect) *apperrors.AppError {
+	if upload.Format == FormatXLSX {
+		wb, err := openXLSXWorkbook(upload.TempFilePath)
+		if err != nil {
+			return apperrors.Wrap(err, apperrors.ErrCSVProcessing, fmt.Sprintf("failed to read workbook: %v", err))
 		}
-		return nil, nil, "", apperrors.Wrap(err, apperrors.ErrCSVProcessing, "failed to read CSV headers")
+		upload.Sheets = wb.sheetNames
+		upload.Sheet = wb.sheetNames[0]
+		wb.Close()
+	}
+	return s.ResolveDialect(upload, dialect)
+}
+
+// PreviewUpload reads the headers and up to MaxPreviewSize rows of a spooled upload
+func (s *CSVService) PreviewUpload(upload *models.UploadSession) (headers []string, previewRows [][]string, appErr *apperrors.AppError) {
+	headers, stream, appErr := s.OpenUploadStream(upload)
+	if appErr != nil {
+		return nil, nil, appErr
 	}
+	defer stream.Close()
 
 	for i := 0; i < MaxPreviewSize; i++ {
-		record, readErr := csvReader.Read()
+		record, readErr := stream.Read()
 		if readErr == io.EOF {
 			break
 		}
@@ -78,44 +230,138 @@ func (s *CSVService) ParseUploadedCSV(fileHeader *multipart.FileHeader) (headers
 		previewRows = append(previewRows, record)
 	}
 
-	// TODO: Find a suitable alternate for io.Copy to write and dump rest of CSV file
-	// if _, copyErr := io.Copy(io.Discard, csvReader); copyErr != nil { // Ensure rest of file is written
-	// 	tempFile.Close()
-	// 	os.Remove(tempFilePath)
-	// 	return nil, nil, "", apperrors.Wrap(copyErr, apperrors.ErrFileOperation, "failed to complete writing to temp file")
-	// }
+	return headers, previewRows, nil
+}
 
-	if err := tempFile.Close(); err != nil {
-		os.Remove(tempFilePath)
-		return nil, nil, "", apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to close temp file after writing")
+// OpenUploadStream opens a spooled upload for streaming according to its format, dialect and selected sheet
+// It returns the header row and a stream positioned at the first data row; the caller must close the stream
+// When the dialect has no header row, column_N names are generated and the first row is kept as data
+func (s *CSVService) OpenUploadStream(upload *models.UploadSession) (headers []string, stream RecordStream, appErr *apperrors.AppError) {
+	source := "CSV file"
+	if upload.Format == FormatXLSX {
+		wb, err := openXLSXWorkbook(upload.TempFilePath)
+		if err != nil {
+			return nil, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, fmt.Sprintf("failed to read workbook: %v", err))
+		}
+		sheet, err := wb.openSheet(upload.Sheet)
+		if err != nil {
+			wb.Close()
+			return nil, nil, apperrors.Wrap(err, apperrors.ErrInvalidInput, err.Error())
+		}
+		stream, source = sheet, fmt.Sprintf("sheet '%s'", upload.Sheet)
+	} else {
+		csvStream, appErr := s.OpenCSVStream(upload.TempFilePath, upload.Dialect)
+		if appErr != nil {
+			return nil, nil, appErr
+		}
+		stream = csvStream
 	}
 
-	return headers, previewRows, tempFilePath, nil
+	firstRow, err := stream.Read()
+	if err != nil {
+		stream.Close()
+		if err == io.EOF {
+			return nil, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, fmt.Sprintf("%s is empty or has no headers", source))
+		}
+		return nil, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, fmt.Sprintf("failed to read headers of %s: %v", source, err))
+	}
+
+	headers = firstRow
+	if !upload.Dialect.HasHeader {
+		headers = make([]string, len(firstRow))
+		for i := range headers {
+			headers[i] = fmt.Sprintf("column_%d", i+1)
+		}
+	}
+	if sheet, ok := stream.(*XLSXStream); ok {
+		sheet.setWidth(len(headers))
+	}
+	if !upload.Dialect.HasHeader {
+		stream = &pushbackStream{RecordStream: stream, pending: firstRow}
+	}
+
+	return headers, stream, nil
 }
 
-// ReadFullCSV reads in an entire CSV file and returns the headers and all records
-func (s *CSVService) ReadFullCSV(filePath string) (headers []string, allRecords [][]string, appErr *apperrors.AppError) {
+// pushbackStream replays a record that was read ahead before continuing with the underlying stream
+type pushbackStream struct {
+	RecordStream
+	pending []string
+}
+
+// Read returns the pushed-back record first, then the records of the underlying stream
+func (ps *pushbackStream) Read() ([]string, error) {
+	if ps.pending != nil {
+		record := ps.pending
+		ps.pending = nil
+		return record, nil
+	}
+	return ps.RecordStream.Read()
+}
+
+// VerifySpooledFile checks that the file at filePath still has the expected byte count and SHA-256 checksum
+func (s *CSVService) VerifySpooledFile(filePath string, expectedSize int64, expectedChecksum string) *apperrors.AppError {
 	file, err := os.Open(filePath)
 	if err != nil {
-		return nil, nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open CSV file for full read")
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open spooled file for verification")
 	}
 	defer file.Close()
 
-	reader := csv.NewReader(file)
-	headers, err = reader.Read()
+	hasher := sha256.New()
+	size, err := io.Copy(hasher, file)
 	if err != nil {
-		if err == io.EOF {
-			return nil, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, "CSV file is empty or has no headers (full read)")
-		}
-		return nil, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, "failed to read CSV headers (full read)")
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to read spooled file for verification")
+	}
+
+	if size != expectedSize {
+		return apperrors.Wrap(nil, apperrors.ErrFileIntegrity, fmt.Sprintf("spooled file is %d bytes, expected %d bytes", size, expectedSize))
+	}
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); !strings.EqualFold(checksum, expectedChecksum) {
+		return apperrors.Wrap(nil, apperrors.ErrFileIntegrity, "spooled file checksum does not match the previewed file")
+	}
+	return nil
+}
+
+// CSVStream is a forward-only reader over a CSV file on disk
+// It lets callers consume records one at a time so memory use stays flat regardless of file size
+type CSVStream struct {
+	file   *os.File
+	reader *csv.Reader
+}
+
+// OpenCSVStream opens a CSV file for streaming with the given dialect, positioned at its first row
+// Records are transcoded from the dialect's encoding to UTF-8, with any byte order mark removed
+// The caller is responsible for closing the returned stream
+func (s *CSVService) OpenCSVStream(filePath string, dialect models.CSVDialect) (*CSVStream, *apperrors.AppError) {
+	if appErr := validateDialect(dialect); appErr != nil {
+		return nil, appErr
 	}
 
-	allRecords, err = reader.ReadAll()
+	file, err := os.Open(filePath)
 	if err != nil {
-		return headers, nil, apperrors.Wrap(err, apperrors.ErrCSVProcessing, "failed to read all CSV records")
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open CSV file for streaming")
 	}
 
-	return headers, allRecords, nil
+	reader := csv.NewReader(newDecodingReader(file, dialect.Encoding))
+	reader.FieldsPerRecord = -1 // Column count mismatches are reported per row by the consumer
+	reader.Comma, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+	if dialect.Comment != "" {
+		reader.Comment, _ = utf8.DecodeRuneInString(dialect.Comment)
+	}
+	reader.LazyQuotes = dialect.LazyQuotes
+	reader.TrimLeadingSpace = dialect.TrimLeadingSpace
+
+	return &CSVStream{file: file, reader: reader}, nil
+}
+
+// Read returns the next record in the stream, or io.EOF when there are no more records
+func (cs *CSVStream) Read() ([]string, error) {
+	return cs.reader.Read()
+}
+
+// Close closes the underlying file
+func (cs *CSVStream) Close() error {
+	return cs.file.Close()
 }
 
 // SanitizeSQLName ensures that field names follow standard naming conventions
@@ -149,6 +395,20 @@ func (s *CSVService) SanitizeSQLName(name string) string {
 	return name
 }
 
+// TableColumns returns the columns of a new table built from column names, sanitized into SQL names, and their types
+// Names that sanitize to nothing become "column_<n>"
+func (s *CSVService) TableColumns(names, types []string) []models.ColumnDefinition {
+	columnDefs := make([]models.ColumnDefinition, len(names))
+	for i, rawColName := range names {
+		sanitizedColName := s.SanitizeSQLName(rawColName)
+		if sanitizedColName == "" {
+			sanitizedColName = fmt.Sprintf("column_%d", i+1)
+		}
+		columnDefs[i] = models.ColumnDefinition{Name: sanitizedColName, Type: types[i]}
+	}
+	return columnDefs
+}
+
 // SanitizeTableName ensures that PostgreSQL table names follow standard naming conventions
 func (s *CSVService) SanitizeTableName(filename string) string {
 	name := strings.TrimSuffix(filename, filepath.Ext(filename))
@@ -158,121 +418,3 @@ func (s *CSVService) SanitizeTableName(filename string) string {
 	}
 	return sanitized
 }
-
-func (s *CSVService) InferSchemaFromPreview(headers []string, previewRows [][]string) []models.ColumnDefinition {
-	numCols := len(headers)
-	if numCols == 0 {
-		return []models.ColumnDefinition{}
-	}
-
-	columnDefinitions := make([]models.ColumnDefinition, numCols)
-
-	for colIdx, headerName := range headers {
-		// For each column, try to determine its type by inspecting its values in the previewRows
-		isStillBoolean := true
-		isStillInteger := true
-		isStillReal := true
-		isStillDate := true
-		isStillTimestamp := true
-
-		hasAtLeastOneNonEmptyValueInColumn := false
-
-		for _, row := range previewRows {
-			if colIdx >= len(row) {
-				// This column value is missing for this row, doesn't help inference much
-				// but doesn't necessarily invalidate types unless all are missing.
-				continue
-			}
-			valStr := strings.TrimSpace(row[colIdx])
-
-			if valStr == "" {
-				continue // Empty strings are compatible with any type for inference purposes
-			}
-			hasAtLeastOneNonEmptyValueInColumn = true
-
-			// Check Boolean: "true", "false", "t", "f", "yes", "no", "1", "0"
-			if isStillBoolean {
-				lcVal := strings.ToLower(valStr)
-				if !(lcVal == "true" || lcVal == "false" || lcVal == "t" || lcVal == "f" ||
-					lcVal == "yes" || lcVal == "no" || lcVal == "0" || lcVal == "1") {
-					isStillBoolean = false
-				}
-			}
-
-			// Check Integer (standard int64)
-			if isStillInteger {
-				if _, err := strconv.ParseInt(valStr, 10, 64); err != nil {
-					isStillInteger = false
-				}
-			}
-
-			// Check Real (float64) - this will also parse integers
-			if isStillReal {
-				if _, err := strconv.ParseFloat(valStr, 64); err != nil {
-					isStillReal = false
-				}
-			}
-
-			// Check Timestamp (more specific than Date)
-			// Common formats for inference
-			tsLayouts := []string{
-				time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02T15:04:05Z07:00",
-				"01/02/2006 15:04:05", "1/2/2006 15:04:05", "Jan 2, 2006 3:04:05 PM", "2006-01-02 15:04",
-				"01/02/2006 12:00",
-			}
-			if isStillTimestamp {
-				parsed := false
-				for _, layout := range tsLayouts {
-					if _, err := time.Parse(layout, valStr); err == nil {
-						parsed = true
-						break
-					}
-				}
-				if !parsed {
-					isStillTimestamp = false
-				}
-			}
-
-			// Check Date (less specific than Timestamp)
-			dateLayouts := []string{
-				"2006-01-02", "01/02/2006", "1/2/2006", "2006/01/02", "Jan 2, 2006", "2-Jan-2006",
-			}
-			if isStillDate {
-				parsed := false
-				for _, layout := range dateLayouts {
-					if _, err := time.Parse(layout, valStr); err == nil {
-						parsed = true
-						break
-					}
-				}
-				if !parsed {
-					isStillDate = false
-				}
-			}
-		} // End of row loop for a column
-
-		// Determine final inferred type based on what's still true
-		// Order of preference: BOOLEAN, INTEGER, REAL, TIMESTAMP, DATE, TEXT
-		inferredAppType := "TEXT" // Default if nothing more specific matches or no non-empty values
-		if hasAtLeastOneNonEmptyValueInColumn {
-			if isStillBoolean {
-				inferredAppType = "BOOLEAN"
-			} else if isStillInteger { // If it's an integer, it's also a real number. Prioritize INTEGER.
-				inferredAppType = "INTEGER" // Or BIGINT if you differentiate and isStillBigInt is true
-			} else if isStillReal {
-				inferredAppType = "REAL" // Could be NUMERIC or REAL depending on your app types
-			} else if isStillTimestamp { // Timestamp is more specific than Date
-				inferredAppType = "TIMESTAMP"
-			} else if isStillDate {
-				inferredAppType = "DATE"
-			}
-		}
-
-		columnDefinitions[colIdx] = models.ColumnDefinition{
-			Name: headerName, // Use the original CSV header name
-			Type: inferredAppType,
-		}
-	}
-
-	return columnDefinitions
-}
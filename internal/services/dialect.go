@@ -0,0 +1,164 @@
+package services
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// dialectSampleSize is how much of a file is inspected when sniffing its delimiter
+const dialectSampleSize = 8 << 10 // 8 KB
+
+// candidateDelimiters are the delimiters considered when sniffing, in order of preference on ties
+var candidateDelimiters = []rune{',', ';', '\t', '|'}
+
+// NormalizeDialect canonicalizes user-supplied dialect options, e.g. "tab" or `\t` becomes a tab and "auto" means sniff
+func (s *CSVService) NormalizeDialect(dialect models.CSVDialect) models.CSVDialect {
+	dialect.Encoding = normalizeEncoding(dialect.Encoding)
+	dialect.EncodingDetected = false
+	switch strings.ToLower(dialect.Delimiter) {
+	case "", "auto":
+		dialect.Delimiter = ""
+	case "tab", `\t`:
+		dialect.Delimiter = "\t"
+	case "space":
+		dialect.Delimiter = " "
+	}
+	dialect.Detected = false
+	return dialect
+}
+
+// validateDialect checks that the encoding is supported and the delimiter and comment characters can be used by encoding/csv
+func validateDialect(dialect models.CSVDialect) *apperrors.AppError {
+	if appErr := validateEncoding(dialect.Encoding); appErr != nil {
+		return appErr
+	}
+	delimiter, appErr := dialectRune(dialect.Delimiter, "delimiter")
+	if appErr != nil {
+		return appErr
+	}
+	if dialect.Comment == "" {
+		return nil
+	}
+	comment, appErr := dialectRune(dialect.Comment, "comment character")
+	if appErr != nil {
+		return appErr
+	}
+	if comment == delimiter {
+		return apperrors.Wrap(nil, apperrors.ErrInvalidInput, "The comment character must differ from the delimiter.")
+	}
+	return nil
+}
+
+// dialectRune converts a single-character dialect option into a rune, rejecting characters encoding/csv cannot use
+func dialectRune(value, label string) (rune, *apperrors.AppError) {
+	r, size := utf8.DecodeRuneInString(value)
+	if value == "" || size != len(value) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid %s %q: it must be a single character other than a quote or line break.", label, value))
+	}
+	return r, nil
+}
+
+// ResolveDialect validates the dialect options and stores them on the upload
+// For CSV uploads, a missing encoding is detected and a missing delimiter is sniffed from the start of the transcoded file
+func (s *CSVService) ResolveDialect(upload *models.UploadSession, dialect models.CSVDialect) *apperrors.AppError {
+	if upload.Format == FormatXLSX {
+		// Workbooks have no delimiter and are always UTF-8; only the header toggle applies
+		upload.Dialect = models.CSVDialect{HasHeader: dialect.HasHeader}
+		return nil
+	}
+
+	file, err := os.Open(upload.TempFilePath)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open file to detect its dialect")
+	}
+	defer file.Close()
+
+	if dialect.Encoding == "" {
+		encoding, err := detectEncoding(file)
+		if err != nil {
+			return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to read file to detect its encoding")
+		}
+		dialect.Encoding = encoding
+		dialect.EncodingDetected = true
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to rewind file after detecting its encoding")
+		}
+	}
+	if appErr := validateEncoding(dialect.Encoding); appErr != nil {
+		return appErr
+	}
+
+	if dialect.Delimiter == "" {
+		sample := make([]byte, dialectSampleSize)
+		n, err := io.ReadFull(newDecodingReader(file, dialect.Encoding), sample)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to read file to detect its delimiter")
+		}
+
+		delimiter, detected := sniffDelimiter(sample[:n], n == dialectSampleSize, dialect.Comment)
+		dialect.Delimiter = string(delimiter)
+		dialect.Detected = detected
+	}
+
+	if appErr := validateDialect(dialect); appErr != nil {
+		return appErr
+	}
+	upload.Dialect = dialect
+	return nil
+}
+
+// sniffDelimiter picks the candidate delimiter that splits the sample into the most consistent number of fields
+// The first criterion is how many records share the most common field count; ties go to the larger field count
+// It falls back to a comma, reporting false, when no candidate yields at least two fields consistently
+func sniffDelimiter(sample []byte, truncated bool, commentChar string) (rune, bool) {
+	if truncated {
+		// Drop the trailing partial line so it does not skew the field counts
+		if idx := bytes.LastIndexByte(sample, '\n'); idx > 0 {
+			sample = sample[:idx+1]
+		}
+	}
+
+	best, bestRecords, bestFields := ',', 0, 0
+	for _, candidate := range candidateDelimiters {
+		reader := csv.NewReader(bytes.NewReader(sample))
+		reader.Comma = candidate
+		reader.FieldsPerRecord = -1
+		reader.LazyQuotes = true
+		if commentChar != "" {
+			if comment, appErr := dialectRune(commentChar, "comment character"); appErr == nil && comment != candidate {
+				reader.Comment = comment
+			}
+		}
+
+		frequencies := make(map[int]int)
+		for {
+			record, err := reader.Read()
+			if err != nil {
+				break // io.EOF, or the sample is not parseable with this candidate
+			}
+			frequencies[len(record)]++
+		}
+
+		modeFields, modeRecords := 0, 0
+		for fields, records := range frequencies {
+			if records > modeRecords || records == modeRecords && fields > modeFields {
+				modeFields, modeRecords = fields, records
+			}
+		}
+		if modeFields < 2 {
+			continue
+		}
+		if modeRecords > bestRecords || modeRecords == bestRecords && modeFields > bestFields {
+			best, bestRecords, bestFields = candidate, modeRecords, modeFields
+		}
+	}
+	return best, bestRecords > 0
+}
@@ -0,0 +1,278 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+)
+
+// Supported text encodings for CSV uploads
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingWindows1252 = "windows-1252"
+	EncodingISO88591    = "iso-8859-1"
+)
+
+// SupportedEncodings lists the encodings a CSV upload can be read as, in the order they are offered to users
+var SupportedEncodings = []string{EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE, EncodingWindows1252, EncodingISO88591}
+
+// Byte order marks recognized at the start of a file
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// windows1252High maps bytes 0x80-0x9F of Windows-1252 to Unicode; the remaining bytes match ISO-8859-1
+// The five bytes Windows-1252 leaves undefined map to the C1 control characters, as browsers do
+var windows1252High = [32]rune{
+	'€', '\u0081', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '\u008D', 'Ž', '\u008F',
+	'\u0090', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '\u009D', 'ž', 'Ÿ',
+}
+
+// normalizeEncoding maps common aliases of the supported encodings onto their canonical names
+// Empty and "auto" both mean the encoding should be detected
+func normalizeEncoding(name string) string {
+	switch strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), "_", "-") {
+	case "", "auto":
+		return ""
+	case "utf-8", "utf8", "utf-8-sig":
+		return EncodingUTF8
+	case "utf-16le", "utf16le", "utf-16":
+		return EncodingUTF16LE
+	case "utf-16be", "utf16be":
+		return EncodingUTF16BE
+	case "windows-1252", "windows1252", "cp1252":
+		return EncodingWindows1252
+	case "iso-8859-1", "iso8859-1", "latin1", "latin-1":
+		return EncodingISO88591
+	default:
+		return name
+	}
+}
+
+// validateEncoding checks that an encoding is one SheetBridge can transcode
+func validateEncoding(name string) *apperrors.AppError {
+	for _, supported := range SupportedEncodings {
+		if name == supported {
+			return nil
+		}
+	}
+	return apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Unsupported encoding %q. Choose one of: %s.", name, strings.Join(SupportedEncodings, ", ")))
+}
+
+// detectEncoding determines the encoding of a text file
+// A byte order mark wins; otherwise BOM-less UTF-16 is recognized by its pattern of zero bytes,
+// and the whole file is checked for valid UTF-8, falling back to Windows-1252 when it is not
+func detectEncoding(r io.Reader) (string, error) {
+	br := bufio.NewReaderSize(r, 64<<10)
+	head, err := br.Peek(dialectSampleSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, bomUTF8):
+		return EncodingUTF8, nil
+	case bytes.HasPrefix(head, bomUTF16LE):
+		return EncodingUTF16LE, nil
+	case bytes.HasPrefix(head, bomUTF16BE):
+		return EncodingUTF16BE, nil
+	}
+	if encoding, ok := sniffUTF16(head); ok {
+		return encoding, nil
+	}
+
+	valid, err := isValidUTF8(br)
+	if err != nil {
+		return "", err
+	}
+	if valid {
+		return EncodingUTF8, nil
+	}
+	return EncodingWindows1252, nil
+}
+
+// sniffUTF16 recognizes BOM-less UTF-16 text, which for mostly-ASCII content has a zero in every other byte
+func sniffUTF16(sample []byte) (string, bool) {
+	pairs := len(sample) / 2
+	if pairs < 2 {
+		return "", false
+	}
+	evenZeros, oddZeros := 0, 0
+	for i := 0; i+1 < len(sample); i += 2 {
+		if sample[i] == 0 {
+			evenZeros++
+		}
+		if sample[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	switch {
+	case oddZeros*10 >= pairs*4 && evenZeros*20 < pairs:
+		return EncodingUTF16LE, true
+	case evenZeros*10 >= pairs*4 && oddZeros*20 < pairs:
+		return EncodingUTF16BE, true
+	default:
+		return "", false
+	}
+}
+
+// isValidUTF8 reports whether everything read from r is valid UTF-8, without holding the whole input in memory
+func isValidUTF8(r io.Reader) (bool, error) {
+	buf := make([]byte, 64<<10)
+	carry := 0 // Bytes of an incomplete rune kept at the start of buf from the previous chunk
+	for {
+		n, err := r.Read(buf[carry:])
+		data := buf[:carry+n]
+
+		// Hold back a trailing incomplete rune so it can be completed by the next chunk
+		complete := len(data)
+		for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+			if utf8.RuneStart(data[i]) {
+				if !utf8.FullRune(data[i:]) {
+					complete = i
+				}
+				break
+			}
+		}
+		if !utf8.Valid(data[:complete]) {
+			return false, nil
+		}
+		carry = copy(buf, data[complete:])
+
+		if err == io.EOF {
+			return carry == 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// newDecodingReader returns a reader that transcodes r from the given encoding to UTF-8, dropping any byte order mark
+func newDecodingReader(r io.Reader, encoding string) io.Reader {
+	br := bufio.NewReader(r)
+	switch encoding {
+	case EncodingUTF16LE:
+		skipBOM(br, bomUTF16LE)
+		return &transcodingReader{src: br, decode: func(br *bufio.Reader) (rune, error) { return decodeUTF16(br, false) }}
+	case EncodingUTF16BE:
+		skipBOM(br, bomUTF16BE)
+		return &transcodingReader{src: br, decode: func(br *bufio.Reader) (rune, error) { return decodeUTF16(br, true) }}
+	case EncodingWindows1252:
+		return &transcodingReader{src: br, decode: decodeWindows1252}
+	case EncodingISO88591:
+		return &transcodingReader{src: br, decode: decodeISO88591}
+	default:
+		skipBOM(br, bomUTF8)
+		return br
+	}
+}
+
+// skipBOM discards bom from the start of br when it is present
+func skipBOM(br *bufio.Reader, bom []byte) {
+	if head, err := br.Peek(len(bom)); err == nil && bytes.Equal(head, bom) {
+		br.Discard(len(bom))
+	}
+}
+
+// transcodingReader converts a stream of runes decoded from src into UTF-8 bytes
+type transcodingReader struct {
+	src    *bufio.Reader
+	decode func(*bufio.Reader) (rune, error)
+	buf    []byte // UTF-8 output not yet returned to the caller
+	err    error  // Error from src, reported once buf is drained
+}
+
+// Read fills p with UTF-8 encoded text
+func (t *transcodingReader) Read(p []byte) (int, error) {
+	for len(t.buf) < len(p) && t.err == nil {
+		r, err := t.decode(t.src)
+		if err != nil {
+			t.err = err
+			break
+		}
+		t.buf = utf8.AppendRune(t.buf, r)
+	}
+	if len(t.buf) == 0 {
+		return 0, t.err
+	}
+	n := copy(p, t.buf)
+	t.buf = t.buf[:copy(t.buf, t.buf[n:])]
+	return n, nil
+}
+
+// decodeUTF16 decodes one rune of UTF-16, replacing unpaired surrogates and a dangling odd byte with U+FFFD
+func decodeUTF16(br *bufio.Reader, bigEndian bool) (rune, error) {
+	unit, err := readUTF16Unit(br, bigEndian)
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(unit)) {
+		return rune(unit), nil
+	}
+
+	next, err := br.Peek(2)
+	if err != nil || unit >= 0xDC00 {
+		return utf8.RuneError, nil
+	}
+	low := uint16(next[0])<<8 | uint16(next[1])
+	if !bigEndian {
+		low = uint16(next[1])<<8 | uint16(next[0])
+	}
+	r := utf16.DecodeRune(rune(unit), rune(low))
+	if r == utf8.RuneError {
+		return utf8.RuneError, nil // Leave the unpaired unit to be decoded on its own
+	}
+	br.Discard(2)
+	return r, nil
+}
+
+// readUTF16Unit reads one 16-bit code unit
+func readUTF16Unit(br *bufio.Reader, bigEndian bool) (uint16, error) {
+	b, err := br.Peek(2)
+	if len(b) == 1 {
+		br.Discard(1)
+		return uint16(utf8.RuneError), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	br.Discard(2)
+	if bigEndian {
+		return uint16(b[0])<<8 | uint16(b[1]), nil
+	}
+	return uint16(b[1])<<8 | uint16(b[0]), nil
+}
+
+// decodeWindows1252 decodes one byte of Windows-1252
+func decodeWindows1252(br *bufio.Reader) (rune, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b >= 0x80 && b <= 0x9F {
+		return windows1252High[b-0x80], nil
+	}
+	return rune(b), nil
+}
+
+// decodeISO88591 decodes one byte of ISO-8859-1, whose code points match the first 256 of Unicode
+func decodeISO88591(br *bufio.Reader) (rune, error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	return rune(b), nil
+}
@@ -0,0 +1,98 @@
+package services
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+)
+
+// PlanSchemaEvolution proposes the changes that let an append load every column of the file into an existing table
+// File columns that no table column is mapped from are added to the table, named after their header, and mapped to
+// their new column; mapped table columns that cannot hold the inferred type of their file column are widened
+// File columns without any value are never used to widen a column. It returns the changes and the extended mapping
+func (s *CSVService) PlanSchemaEvolution(table models.TableRef, headers []string, inferred []models.ColumnDefinition, inference *models.SchemaInference, tableDefs []models.ColumnDefinition, mapping []models.ColumnMapping) ([]models.SchemaChange, []models.ColumnMapping) {
+	hasValues := func(index int) bool {
+		return inference == nil || index >= len(inference.Stats) || inference.Stats[index].NonNullCount > 0
+	}
+	// Statistics only have a min and max when every value of the column is a number
+	numericValues := func(index int) bool {
+		return inference != nil && index < len(inference.Stats) && inference.Stats[index].Min != nil
+	}
+	inferredType := func(index int) string {
+		if index < len(inferred) {
+			return inferred[index].Type
+		}
+		return "TEXT"
+	}
+
+	var changes []models.SchemaChange
+	used := make([]bool, len(headers))
+	for _, m := range mapping {
+		if m.Source == "" {
+			continue
+		}
+		index := s.headerIndex(headers, m.Source)
+		if index < 0 {
+			continue // Reported when the mapping is resolved
+		}
+		used[index] = true
+
+		defIndex := slices.IndexFunc(tableDefs, func(cd models.ColumnDefinition) bool { return cd.Name == m.Column })
+		if defIndex < 0 || !hasValues(index) {
+			continue
+		}
+		if toType := repositories.WidenType(tableDefs[defIndex].Type, inferredType(index), numericValues(index)); toType != "" {
+			changes = append(changes, models.SchemaChange{
+				Action:   models.SchemaAlterType,
+				Column:   m.Column,
+				Source:   headers[index],
+				FromType: tableDefs[defIndex].Type,
+				ToType:   toType,
+			})
+		}
+	}
+
+	taken := make(map[string]bool, len(tableDefs))
+	for _, cd := range tableDefs {
+		taken[cd.Name] = true
+	}
+	evolved := slices.Clone(mapping)
+	for i, header := range headers {
+		if used[i] {
+			continue
+		}
+		name := s.SanitizeSQLName(header)
+		for n := 2; taken[name]; n++ {
+			name = fmt.Sprintf("%s_%d", s.SanitizeSQLName(header), n)
+		}
+		taken[name] = true
+
+		changes = append(changes, models.SchemaChange{Action: models.SchemaAddColumn, Column: name, Source: header, ToType: inferredType(i)})
+		evolved = append(evolved, models.ColumnMapping{Column: name, Source: header})
+	}
+
+	for i := range changes {
+		changes[i].Statement = repositories.SchemaChangeSQL(table, changes[i])
+	}
+	return changes, evolved
+}
+
+// evolveColumnDefs returns the table's columns as they are once the schema changes have been applied
+func evolveColumnDefs(tableDefs []models.ColumnDefinition, changes []models.SchemaChange) []models.ColumnDefinition {
+	evolved := slices.Clone(tableDefs)
+	for _, change := range changes {
+		switch change.Action {
+		case models.SchemaAddColumn:
+			evolved = append(evolved, models.ColumnDefinition{Name: change.Column, Type: change.ToType})
+		case models.SchemaAlterType:
+			for i := range evolved {
+				if evolved[i].Name == change.Column {
+					evolved[i].Type = change.ToType
+				}
+			}
+		}
+	}
+	return evolved
+}
@@ -0,0 +1,429 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+)
+
+// ImportService runs commits of spooled uploads into the database
+// It is shared by the HTML handlers and the JSON API so both follow the exact same rules
+type ImportService struct {
+	logger  *logger.Logger
+	csv     *CSVService
+	repo    *repositories.DBRepository
+	schemas SchemaOptions
+}
+
+// NewImportService returns a new import service
+func NewImportService(l *logger.Logger, csv *CSVService, repo *repositories.DBRepository, schemas SchemaOptions) *ImportService {
+	return &ImportService{logger: l, csv: csv, repo: repo, schemas: schemas}
+}
+
+// Commit imports the spooled upload into the table named by the request, using the requested action
+// The caller owns the upload and is responsible for removing its temp file afterwards
+// When the request skips invalid rows and some were rejected, a result describing them is returned even if the
+// import failed, so the rejected rows can still be reviewed; its RejectFile then belongs to the caller
+// A validate-only request is never committed: it always returns its report, along with the error that would have
+// aborted the import, if any
+// Every import that is not validate-only is recorded in the import history, whether it was committed or not
+func (s *ImportService) Commit(ctx context.Context, upload *models.UploadSession, req models.CommitRequest) (*models.CommitResult, *apperrors.AppError) {
+	started := time.Now()
+	result, appErr := s.commit(ctx, upload, req)
+	if !req.ValidateOnly {
+		// Recorded even when the client has gone away, as the import itself may have been committed
+		s.recordHistory(context.WithoutCancel(ctx), upload, req, result, appErr, time.Since(started))
+	}
+	return result, appErr
+}
+
+// AuthorizeCommit checks that the signed-in user may run a commit request, so that a request they are not allowed
+// to make can be turned away before its upload is claimed. Commit checks again on its own
+func (s *ImportService) AuthorizeCommit(ctx context.Context, req models.CommitRequest) *apperrors.AppError {
+	schema, appErr := s.ResolveSchema(ctx, req.Schema)
+	if appErr != nil {
+		return appErr
+	}
+	return Authorize(ctx, models.TableRef{Schema: schema, Name: s.csv.SanitizeTableName(req.TableName)}, req.Action)
+}
+
+// commit runs the import described by Commit
+func (s *ImportService) commit(ctx context.Context, upload *models.UploadSession, req models.CommitRequest) (*models.CommitResult, *apperrors.AppError) {
+	req.TableName = s.csv.SanitizeTableName(req.TableName)
+
+	trace := importTraceFromContext(ctx)
+	progress := models.ImportProgress{Phase: models.PhasePreparing}
+	trace.progress(progress)
+
+	if req.MaxRejectedRows < 0 || req.MaxRejectedPercent < 0 || req.MaxRejectedPercent > 100 {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Rejected row limits must be positive, and the percentage at most 100.")
+	}
+
+	if req.ValidateOnly {
+		// Validation reports every row that would be rejected, whatever the limits
+		req.SkipInvalidRows, req.MaxRejectedRows, req.MaxRejectedPercent = true, 0, 0
+	}
+
+	if req.EvolveSchema && req.Action != models.ActionAppend {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Schema evolution is only available when appending.")
+	}
+
+	sheetChanged := false
+	if req.Sheet != "" && req.Sheet != upload.Sheet {
+		if !slices.Contains(upload.Sheets, req.Sheet) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Sheet '%s' does not exist in the uploaded workbook.", req.Sheet))
+		}
+		upload.Sheet = req.Sheet
+		sheetChanged = true
+	}
+	if upload.Inference != nil && upload.Inference.Complete && !sheetChanged {
+		progress.RowsTotal = upload.Inference.RowsScanned
+	}
+
+	if appErr := s.csv.VerifySpooledFile(upload.TempFilePath, upload.FileSize, upload.FileChecksum); appErr != nil {
+		return nil, appErr
+	}
+
+	schema, appErr := s.ResolveSchema(ctx, req.Schema)
+	if appErr != nil {
+		return nil, appErr
+	}
+	req.Schema = schema
+	table := models.TableRef{Schema: schema, Name: req.TableName}
+	if appErr := Authorize(ctx, table, req.Action); appErr != nil {
+		return nil, appErr
+	}
+
+	tableExists, appErr := s.repo.TableExists(ctx, table)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	finalColumnDefs, appErr := s.resolveColumnDefs(ctx, req, table, tableExists)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	headers, stream, appErr := s.csv.OpenUploadStream(upload)
+	if appErr != nil {
+		return nil, appErr
+	}
+	defer stream.Close()
+
+	result := &models.CommitResult{Schema: req.Schema, TableName: req.TableName, Action: req.Action, ValidateOnly: req.ValidateOnly}
+	if req.ValidateOnly {
+		result.UploadID = upload.ID
+	}
+
+	// Overwrite and append load the table's columns from the upload columns they are mapped to
+	insertDefs := finalColumnDefs
+	opts := &repositories.InsertOptions{}
+	if req.Action != models.ActionCreate {
+		mapping := req.Mapping
+		if len(mapping) == 0 {
+			mapping = s.csv.AutoMapColumns(headers, finalColumnDefs)
+		}
+		if req.EvolveSchema {
+			// The schema inferred for the preview no longer applies once another worksheet is selected
+			inferred, inference := upload.InferredColumnDefs, upload.Inference
+			if sheetChanged || len(inferred) != len(headers) {
+				if inferred, inference, appErr = s.csv.InferSchema(upload); appErr != nil {
+					return nil, appErr
+				}
+			}
+			result.SchemaChanges, mapping = s.csv.PlanSchemaEvolution(table, headers, inferred, inference, finalColumnDefs, mapping)
+			finalColumnDefs = evolveColumnDefs(finalColumnDefs, result.SchemaChanges)
+		}
+		if insertDefs, opts.Sources, appErr = s.csv.resolveMapping(mapping, headers, finalColumnDefs); appErr != nil {
+			return nil, appErr
+		}
+		opts.RecordWidth = len(headers)
+	}
+	if req.Action == models.ActionUpsert {
+		if appErr = validateKeyColumns(req.KeyColumns, insertDefs, opts.Sources); appErr != nil {
+			return nil, appErr
+		}
+	}
+
+	var rejects *rejectWriter
+	if req.SkipInvalidRows {
+		if rejects, appErr = newRejectWriter(headers); appErr != nil {
+			return nil, appErr
+		}
+		// Discard the reject file unless it was handed over to the result
+		defer func() {
+			if rejects != nil {
+				rejects.discard()
+			}
+		}()
+		opts.OnReject = func(rowErr models.RowError, record []string) *apperrors.AppError {
+			result.RowsRejected++
+			if len(result.RowErrors) < MaxReportedRowErrors {
+				result.RowErrors = append(result.RowErrors, rowErr)
+			}
+			countColumnError(result, rowErr.Column)
+			trace.rejected(rowErr)
+			if appErr := rejects.write(rowErr, record); appErr != nil {
+				return appErr
+			}
+			if req.MaxRejectedRows > 0 && result.RowsRejected > req.MaxRejectedRows {
+				return apperrors.Wrap(nil, apperrors.ErrRejectThreshold, fmt.Sprintf("More than %d rows were rejected; the import into '%s' was rolled back.", req.MaxRejectedRows, req.TableName))
+			}
+			return nil
+		}
+	}
+
+	tx, err := s.repo.BeginTxx(ctx)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to begin transaction")
+	}
+	committed := false
+	// Roll back unless the transaction was committed, including when a panic unwinds through here
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	switch req.Action {
+	case models.ActionOverwrite:
+		// The replaced table is kept as a backup instead of being dropped, so the overwrite can be undone
+		result.BackupTable = repositories.BackupTableName(req.TableName, time.Now())
+		result.Statements = append(repositories.BackupTableSQL(table, result.BackupTable), repositories.CreateTableSQL(table, finalColumnDefs))
+		if appErr = s.repo.BackupTable(ctx, tx, table, result.BackupTable); appErr == nil {
+			appErr = s.repo.CreateTable(ctx, tx, table, finalColumnDefs)
+		}
+		result.Message = fmt.Sprintf("Success: Table '%s' overwritten, keeping the previous table as backup '%s'.", req.TableName, result.BackupTable)
+	case models.ActionAppend:
+		for _, change := range result.SchemaChanges {
+			result.Statements = append(result.Statements, change.Statement)
+		}
+		// Appended rows are tagged with a batch ID, so the append can be undone
+		result.Statements = append(result.Statements, repositories.BatchColumnSQL(table))
+		if appErr = s.repo.ApplySchemaChanges(ctx, tx, table, result.SchemaChanges); appErr == nil {
+			appErr = s.repo.EnsureBatchColumn(ctx, tx, table)
+		}
+		if appErr == nil {
+			result.BatchID, appErr = newBatchID()
+			opts.BatchID = result.BatchID
+		}
+		result.Message = fmt.Sprintf("Success: Data appended to table '%s'.", req.TableName)
+	case models.ActionCreate:
+		result.Statements = []string{repositories.CreateTableSQL(table, finalColumnDefs)}
+		appErr = s.repo.CreateTable(ctx, tx, table, finalColumnDefs)
+		result.Message = fmt.Sprintf("Success: Table '%s' created.", req.TableName)
+	case models.ActionUpsert:
+		var statement string
+		if statement, appErr = s.repo.EnsureUniqueIndex(ctx, tx, table, req.KeyColumns); statement != "" {
+			result.Statements = []string{statement}
+		}
+		result.Message = fmt.Sprintf("Success: Data upserted into table '%s'.", req.TableName)
+	}
+	if appErr != nil {
+		if req.ValidateOnly {
+			return validationReport(result, appErr)
+		}
+		return nil, appErr
+	}
+
+	opts.OnProgress = func(rowsRead, rowsLoaded int64) {
+		progress.RowsRead, progress.RowsLoaded, progress.RowsRejected = rowsRead, rowsLoaded, result.RowsRejected
+		progress.Batch = (rowsRead + repositories.ProgressInterval - 1) / repositories.ProgressInterval
+		trace.progress(progress)
+	}
+	progress.Phase = models.PhaseLoading
+	trace.progress(progress)
+	if req.Action == models.ActionUpsert {
+		result.RowsInserted, result.RowsUpdated, appErr = s.repo.UpsertData(ctx, tx, table, insertDefs, req.KeyColumns, stream, opts)
+		result.RowsImported = result.RowsInserted + result.RowsUpdated
+	} else {
+		result.RowsImported, appErr = s.repo.InsertData(ctx, tx, table, insertDefs, stream, opts)
+		result.RowsInserted = result.RowsImported
+	}
+	if appErr != nil && !apperrors.Is(appErr, apperrors.ErrRejectThreshold) {
+		appErr = apperrors.Wrap(appErr, appErr, fmt.Sprintf("Error inserting data into '%s': %s", req.TableName, appErr.Message))
+	}
+	if appErr == nil && req.MaxRejectedPercent > 0 && result.RowsRejected > 0 {
+		if percent := float64(result.RowsRejected) * 100 / float64(result.RowsImported+result.RowsRejected); percent > req.MaxRejectedPercent {
+			appErr = apperrors.Wrap(nil, apperrors.ErrRejectThreshold, fmt.Sprintf("%.1f%% of rows were rejected, more than the allowed %g%%; the import into '%s' was rolled back.", percent, req.MaxRejectedPercent, req.TableName))
+		}
+	}
+	if appErr == nil && !req.ValidateOnly {
+		progress.Phase = models.PhaseCommitting
+		trace.progress(progress)
+		if err = tx.Commit(); err != nil {
+			appErr = apperrors.Wrap(err, apperrors.ErrDatabase, "failed to commit transaction")
+		} else {
+			committed = true
+		}
+	}
+
+	if result.RowsRejected > 0 {
+		// A reject file that cannot be saved does not undo a committed import; the result simply has no file
+		result.RejectFile, _ = rejects.close()
+		rejects = nil
+	}
+
+	if req.ValidateOnly {
+		return validationReport(result, appErr) // The deferred rollback undoes everything
+	}
+
+	result.Committed = committed
+	if !committed {
+		if result.RowsRejected == 0 {
+			return nil, appErr
+		}
+		result.RowsImported, result.RowsInserted, result.RowsUpdated = 0, 0, 0 // Nothing was kept
+		result.SchemaChanges = nil
+		result.BatchID, result.BackupTable = "", ""
+		result.Message = appErr.Message
+		return result, appErr
+	}
+
+	if req.Action == models.ActionUpsert {
+		result.Message = fmt.Sprintf("%s %d rows imported (%d inserted, %d updated).", result.Message, result.RowsImported, result.RowsInserted, result.RowsUpdated)
+	} else {
+		result.Message = fmt.Sprintf("%s %d rows imported.", result.Message, result.RowsImported)
+	}
+	if len(result.SchemaChanges) > 0 {
+		result.Message = fmt.Sprintf("%s %d schema changes applied.", result.Message, len(result.SchemaChanges))
+	}
+	if result.RowsRejected > 0 {
+		result.Message = fmt.Sprintf("%s %d rows rejected.", result.Message, result.RowsRejected)
+		if result.RejectFile == "" {
+			result.Message += " The reject file could not be saved."
+		}
+	}
+	return result, nil
+}
+
+// recordHistory adds an import to the import history
+// A history entry that cannot be saved does not undo the import, so the failure is only logged
+func (s *ImportService) recordHistory(ctx context.Context, upload *models.UploadSession, req models.CommitRequest, result *models.CommitResult, appErr *apperrors.AppError, elapsed time.Duration) {
+	record := &models.ImportRecord{
+		OriginalFilename: upload.OriginalFilename,
+		FileChecksum:     upload.FileChecksum,
+		FileSize:         upload.FileSize,
+		Sheet:            upload.Sheet,
+		TableSchema:      cmp.Or(req.Schema, s.DefaultSchema()),
+		TableName:        s.csv.SanitizeTableName(req.TableName),
+		Action:           req.Action,
+		Status:           models.ImportFailed,
+		DurationMS:       elapsed.Milliseconds(),
+		ImportedBy:       UsernameFromContext(ctx),
+	}
+	if req.Sheet != "" {
+		record.Sheet = req.Sheet
+	}
+	if result != nil {
+		record.RowsImported = result.RowsImported
+		record.RowsInserted = result.RowsInserted
+		record.RowsUpdated = result.RowsUpdated
+		record.RowsRejected = result.RowsRejected
+		if result.Committed {
+			record.Status = models.ImportCommitted
+			record.BatchID = result.BatchID
+			record.BackupTable = result.BackupTable
+		}
+	}
+	if appErr != nil {
+		record.ErrorMessage = appErr.Message
+	}
+
+	if err := s.repo.RecordImport(ctx, record); err != nil {
+		s.logger.Error(err)
+	}
+}
+
+// resolveColumnDefs validates the requested action against the table's existence and returns the columns to load
+// For overwrite and append the schema always comes from the database; for create it comes from the request
+func (s *ImportService) resolveColumnDefs(ctx context.Context, req models.CommitRequest, table models.TableRef, tableExists bool) ([]models.ColumnDefinition, *apperrors.AppError) {
+	switch {
+	case (req.Action == models.ActionOverwrite || req.Action == models.ActionAppend || req.Action == models.ActionUpsert) && tableExists:
+		dbSchema, appErr := s.repo.GetTableSchema(ctx, table)
+		if appErr != nil {
+			return nil, apperrors.Wrap(appErr, appErr, fmt.Sprintf("Could not retrieve schema for table '%s' to %s", req.TableName, req.Action))
+		}
+		return dbSchema, nil
+	case req.Action == models.ActionCreate:
+		if tableExists { // Trying to "create" a table that now exists (e.g., race or user error)
+			return nil, apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Table '%s' already exists. Cannot 'Create'. Choose 'Overwrite' or 'Append'.", req.TableName))
+		}
+		if len(req.ColumnNames) == 0 || len(req.ColumnNames) != len(req.ColumnTypes) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Column names and types mismatch or missing for create action.")
+		}
+		return s.csv.TableColumns(req.ColumnNames, req.ColumnTypes), nil
+	case (req.Action == models.ActionAppend || req.Action == models.ActionUpsert) && !tableExists:
+		return nil, apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Cannot %s into table '%s' because it does not exist. Choose 'Create'.", req.Action, req.TableName))
+	default:
+		// Handle invalid action/state combinations
+		return nil, apperrors.New("invalid_action", fmt.Sprintf("Invalid action '%s' for table '%s'. Table existence: %t.", req.Action, req.TableName, tableExists))
+	}
+}
+
+// validateKeyColumns checks that upsert key columns were chosen and that each one is loaded from the upload
+func validateKeyColumns(keyColumns []string, insertDefs []models.ColumnDefinition, sources []int) *apperrors.AppError {
+	if len(keyColumns) == 0 {
+		return apperrors.Wrap(nil, apperrors.ErrInvalidInput, "Choose at least one key column to upsert on.")
+	}
+	for i, key := range keyColumns {
+		if slices.Contains(keyColumns[:i], key) {
+			return apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Key column '%s' is listed more than once.", key))
+		}
+		index := slices.IndexFunc(insertDefs, func(cd models.ColumnDefinition) bool { return cd.Name == key })
+		if index < 0 || sources[index] < 0 {
+			return apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Key column '%s' must be mapped to a column of the upload.", key))
+		}
+	}
+	return nil
+}
+
+// countColumnError counts a rejected row against the column that caused it
+func countColumnError(result *models.CommitResult, column string) {
+	for i := range result.ColumnErrors {
+		if result.ColumnErrors[i].Column == column {
+			result.ColumnErrors[i].Count++
+			return
+		}
+	}
+	result.ColumnErrors = append(result.ColumnErrors, models.ColumnErrorCount{Column: column, Count: 1})
+}
+
+// validationReport completes the result of a validate-only commit, whose transaction is never committed
+// A failure that would have aborted the import is returned along with the report
+func validationReport(result *models.CommitResult, appErr *apperrors.AppError) (*models.CommitResult, *apperrors.AppError) {
+	result.BatchID, result.BackupTable = "", "" // Nothing was kept
+	if appErr != nil {
+		result.Message = fmt.Sprintf("Validation failed: %s", appErr.Message)
+		return result, appErr
+	}
+
+	verdict := "Validation passed"
+	if result.RowsRejected > 0 {
+		verdict = fmt.Sprintf("Validation found %d rows that would be rejected", result.RowsRejected)
+	}
+	result.Message = fmt.Sprintf("%s: %d rows would be imported into '%s'.", verdict, result.RowsImported, result.TableName)
+	if result.Action == models.ActionUpsert {
+		result.Message = fmt.Sprintf("%s: %d rows would be imported into '%s' (%d inserted, %d updated).", verdict, result.RowsImported, result.TableName, result.RowsInserted, result.RowsUpdated)
+	}
+	return result, nil
+}
+
+// newBatchID returns a random version 4 UUID identifying the rows loaded by one append
+func newBatchID() (string, *apperrors.AppError) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate batch ID")
+	}
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
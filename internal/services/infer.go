@@ -0,0 +1,372 @@
+package services
+
+import (
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/utils"
+)
+
+// Sampling strategies used when schema inference is limited to a sample of rows
+const (
+	SamplingHead      = "head"      // The first SampleRows rows
+	SamplingReservoir = "reservoir" // A uniform random sample of SampleRows rows from the whole file
+)
+
+// InferenceOptions controls how many rows InferSchema looks at
+type InferenceOptions struct {
+	SampleRows int    // 0 infers types from every row of the file
+	Sampling   string // SamplingHead or SamplingReservoir, used when SampleRows > 0
+}
+
+// Layouts recognized when inferring TIMESTAMP and DATE columns
+var (
+	inferTimestampLayouts = []string{
+		time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02T15:04:05Z07:00",
+		"01/02/2006 15:04:05", "1/2/2006 15:04:05", "Jan 2, 2006 3:04:05 PM", "2006-01-02 15:04",
+		"01/02/2006 12:00",
+	}
+	inferDateLayouts = []string{
+		"2006-01-02", "01/02/2006", "1/2/2006", "2006/01/02", "Jan 2, 2006", "2-Jan-2006",
+	}
+	// TIMESTAMPTZ is only inferred when every value carries an explicit UTC offset
+	inferTimestampTZLayouts = []string{
+		time.RFC3339Nano, "2006-01-02 15:04:05.999999999Z07:00", "2006-01-02 15:04:05.999999999Z07",
+		"2006-01-02T15:04:05.999999999Z07",
+	}
+)
+
+// maxInferredPrecision is the largest precision PostgreSQL accepts in NUMERIC(p,s)
+const maxInferredPrecision = 1000
+
+// columnInferrer accumulates what is known about one column as its values are observed one at a time
+// Each candidate type stays possible until a non-empty value fails to parse as it
+type columnInferrer struct {
+	name      string
+	statsOnly bool // Only gather statistics, leaving type checks to inferrers run over a sample
+
+	nonEmpty  int64
+	nulls     int64
+	maxLength int
+
+	isBoolean     bool
+	isInteger     bool
+	isBigint      bool
+	isDecimal     bool
+	isReal        bool
+	isUUID        bool
+	isTimestampTZ bool
+	isTimestamp   bool
+	isDate        bool
+	isTime        bool
+	isInterval    bool
+	isJSON        bool
+
+	hasNumeric bool
+	min, max   float64
+
+	// Largest number of integer and fractional digits seen, used for NUMERIC(p,s)
+	intDigits, scale int
+}
+
+// newColumnInferrers returns one inferrer per header
+func newColumnInferrers(headers []string) []*columnInferrer {
+	inferrers := make([]*columnInferrer, len(headers))
+	for i, name := range headers {
+		inferrers[i] = &columnInferrer{
+			name:          name,
+			isBoolean:     true,
+			isInteger:     true,
+			isBigint:      true,
+			isDecimal:     true,
+			isReal:        true,
+			isUUID:        true,
+			isTimestampTZ: true,
+			isTimestamp:   true,
+			isDate:        true,
+			isTime:        true,
+			isInterval:    true,
+			isJSON:        true,
+		}
+	}
+	return inferrers
+}
+
+// newStatsInferrers returns one inferrer per header that only gathers the cheap statistics: null counts, lengths
+// and numeric min/max
+func newStatsInferrers(headers []string) []*columnInferrer {
+	inferrers := newColumnInferrers(headers)
+	for _, c := range inferrers {
+		c.statsOnly = true
+	}
+	return inferrers
+}
+
+// observeRecord feeds one record to a set of column inferrers; values missing from short rows are ignored
+func observeRecord(inferrers []*columnInferrer, record []string) {
+	for i, c := range inferrers {
+		if i < len(record) {
+			c.observe(record[i])
+		}
+	}
+}
+
+// observe updates the column with one raw value
+func (c *columnInferrer) observe(raw string) {
+	valStr := strings.TrimSpace(raw)
+	if valStr == "" {
+		c.nulls++ // Empty strings are loaded as NULL and are compatible with any type
+		return
+	}
+	c.nonEmpty++
+	if length := utf8.RuneCountInString(valStr); length > c.maxLength {
+		c.maxLength = length
+	}
+
+	if c.statsOnly {
+		c.observeNumeric(valStr)
+		return
+	}
+
+	// Check Boolean: "true", "false", "t", "f", "yes", "no", "1", "0"
+	if c.isBoolean {
+		lcVal := strings.ToLower(valStr)
+		if !(lcVal == "true" || lcVal == "false" || lcVal == "t" || lcVal == "f" ||
+			lcVal == "yes" || lcVal == "no" || lcVal == "0" || lcVal == "1") {
+			c.isBoolean = false
+		}
+	}
+
+	// Check Integer (int32), then Bigint (int64)
+	if c.isInteger {
+		if _, err := strconv.ParseInt(valStr, 10, 32); err != nil {
+			c.isInteger = false
+		}
+	}
+	if c.isBigint {
+		if _, err := strconv.ParseInt(valStr, 10, 64); err != nil {
+			c.isBigint = false
+		}
+	}
+
+	// Check Decimal (plain digits with an optional fraction) and track its precision
+	if c.isDecimal {
+		if intDigits, scale, ok := utils.ParseDecimal(valStr); !ok {
+			c.isDecimal = false
+		} else {
+			c.intDigits = max(c.intDigits, intDigits)
+			c.scale = max(c.scale, scale)
+		}
+	}
+
+	// Check Real (float64) - this will also parse integers
+	c.observeNumeric(valStr)
+
+	// Check UUID
+	if c.isUUID && !utils.IsUUID(valStr) {
+		c.isUUID = false
+	}
+
+	// Check Timestamp with an explicit offset (more specific than Timestamp)
+	if c.isTimestampTZ && !parsesWithAnyLayout(valStr, inferTimestampTZLayouts) {
+		c.isTimestampTZ = false
+	}
+
+	// Check Timestamp (more specific than Date)
+	if c.isTimestamp && !parsesWithAnyLayout(valStr, inferTimestampLayouts) {
+		c.isTimestamp = false
+	}
+
+	// Check Date (less specific than Timestamp)
+	if c.isDate && !parsesWithAnyLayout(valStr, inferDateLayouts) {
+		c.isDate = false
+	}
+
+	// Check Time of day
+	if c.isTime {
+		if _, ok := utils.ParseTimeOfDay(valStr); !ok {
+			c.isTime = false
+		}
+	}
+
+	// Check Interval
+	if c.isInterval && !utils.IsInterval(valStr) {
+		c.isInterval = false
+	}
+
+	// Check JSON (objects and arrays only; bare scalars are better served by the types above)
+	if c.isJSON && !utils.IsJSONDocument(valStr) {
+		c.isJSON = false
+	}
+}
+
+// observeNumeric checks whether a non-empty value is a real number and tracks the column's min and max
+func (c *columnInferrer) observeNumeric(valStr string) {
+	if !c.isReal {
+		return
+	}
+	f, err := strconv.ParseFloat(valStr, 64)
+	if err != nil {
+		c.isReal = false
+		return
+	}
+	if !c.hasNumeric || f < c.min {
+		c.min = f
+	}
+	if !c.hasNumeric || f > c.max {
+		c.max = f
+	}
+	c.hasNumeric = true
+}
+
+// parsesWithAnyLayout reports whether value parses with at least one of the time layouts
+func parsesWithAnyLayout(value string, layouts []string) bool {
+	for _, layout := range layouts {
+		if _, err := time.Parse(layout, value); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// inferredType returns the most specific type still consistent with every observed value
+// Order of preference: BOOLEAN, INTEGER, BIGINT, NUMERIC, REAL, UUID, TIMESTAMPTZ, TIMESTAMP, DATE, TIME, INTERVAL, JSONB, TEXT
+func (c *columnInferrer) inferredType() string {
+	switch {
+	case c.nonEmpty == 0:
+		return "TEXT" // Nothing to go on
+	case c.isBoolean:
+		return "BOOLEAN"
+	case c.isInteger: // If it's an integer, it's also a real number. Prioritize INTEGER.
+		return "INTEGER"
+	case c.isBigint:
+		return "BIGINT"
+	case c.isDecimal: // Exact decimals keep their digits, unlike REAL
+		precision := max(c.intDigits+c.scale, 1)
+		if precision > maxInferredPrecision {
+			return "NUMERIC"
+		}
+		return fmt.Sprintf("NUMERIC(%d,%d)", precision, c.scale)
+	case c.isReal:
+		return "REAL"
+	case c.isUUID:
+		return "UUID"
+	case c.isTimestampTZ:
+		return "TIMESTAMPTZ"
+	case c.isTimestamp: // Timestamp is more specific than Date
+		return "TIMESTAMP"
+	case c.isDate:
+		return "DATE"
+	case c.isTime:
+		return "TIME"
+	case c.isInterval:
+		return "INTERVAL"
+	case c.isJSON:
+		return "JSONB"
+	default:
+		return "TEXT"
+	}
+}
+
+// stats returns the statistics gathered for the column; min and max are only set for numeric columns
+func (c *columnInferrer) stats() models.ColumnStats {
+	stats := models.ColumnStats{
+		Name:         c.name,
+		NullCount:    c.nulls,
+		NonNullCount: c.nonEmpty,
+		MaxLength:    c.maxLength,
+	}
+	if c.isReal && c.hasNumeric {
+		minVal, maxVal := c.min, c.max
+		stats.Min, stats.Max = &minVal, &maxVal
+	}
+	return stats
+}
+
+// columnDefinitions returns the inferred column definitions, named after the original headers
+func columnDefinitions(inferrers []*columnInferrer) []models.ColumnDefinition {
+	defs := make([]models.ColumnDefinition, len(inferrers))
+	for i, c := range inferrers {
+		defs[i] = models.ColumnDefinition{Name: c.name, Type: c.inferredType()}
+	}
+	return defs
+}
+
+// InferSchema scans a spooled upload to infer the type of each column and gather per-column statistics
+// By default every row is read; the service's InferenceOptions can limit type inference to a sample instead
+// A reservoir sample still reads every row, but only gathers statistics from the rows outside the sample
+// A read error ends the scan early: the result then covers the rows read so far and carries a warning
+func (s *CSVService) InferSchema(upload *models.UploadSession) ([]models.ColumnDefinition, *models.SchemaInference, *apperrors.AppError) {
+	headers, stream, appErr := s.OpenUploadStream(upload)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	defer stream.Close()
+
+	sampleRows := s.inference.SampleRows
+	useReservoir := sampleRows > 0 && s.inference.Sampling != SamplingHead
+
+	statsInferrers := newColumnInferrers(headers)
+	if useReservoir {
+		statsInferrers = newStatsInferrers(headers) // Types are only checked on the sample
+	}
+	var reservoir [][]string
+	inference := &models.SchemaInference{}
+	for {
+		record, err := stream.Read()
+		if err == io.EOF {
+			inference.Complete = true
+			break
+		}
+		if err != nil {
+			inference.Warning = fmt.Sprintf("Inference stopped at row %d: %v", inference.RowsScanned+1, err)
+			break
+		}
+		if sampleRows > 0 && !useReservoir && inference.RowsScanned == int64(sampleRows) {
+			break // Head sample is full and the file has more rows
+		}
+		inference.RowsScanned++
+		observeRecord(statsInferrers, record)
+
+		if useReservoir {
+			// Algorithm R: after n rows, each row is in the reservoir with probability sampleRows/n
+			if len(reservoir) < sampleRows {
+				reservoir = append(reservoir, record)
+			} else if j := rand.Int64N(inference.RowsScanned); j < int64(sampleRows) {
+				reservoir[j] = record
+			}
+		}
+	}
+
+	typeInferrers := statsInferrers
+	inference.RowsSampled = inference.RowsScanned
+	if useReservoir {
+		typeInferrers = newColumnInferrers(headers)
+		for _, record := range reservoir {
+			observeRecord(typeInferrers, record)
+		}
+		inference.RowsSampled = int64(len(reservoir))
+	}
+
+	inference.Stats = make([]models.ColumnStats, len(statsInferrers))
+	for i, c := range statsInferrers {
+		inference.Stats[i] = c.stats()
+	}
+	return columnDefinitions(typeInferrers), inference, nil
+}
+
+// InferSchemaFromPreview infers column types from the given rows only, e.g. the rows of a preview
+func (s *CSVService) InferSchemaFromPreview(headers []string, previewRows [][]string) []models.ColumnDefinition {
+	inferrers := newColumnInferrers(headers)
+	for _, row := range previewRows {
+		observeRecord(inferrers, row)
+	}
+	return columnDefinitions(inferrers)
+}
@@ -0,0 +1,377 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// JobOptions controls the pool of workers running import jobs
+type JobOptions struct {
+	Workers   int           // Imports run at the same time
+	QueueSize int           // Jobs that can wait for a free worker; more are refused
+	TTL       time.Duration // How long a finished job is kept
+}
+
+// JobQueue runs commits as background jobs on a pool of workers, so an import is not bound to the request that
+// started it, and keeps their progress and outcome in memory keyed by opaque random IDs
+type JobQueue struct {
+	logger   *logger.Logger
+	importer *ImportService
+	uploads  *UploadStore
+	opts     JobOptions
+	queue    chan *importJob
+
+	mu      sync.Mutex
+	jobs    map[string]*importJob
+	pending int  // Jobs in the queue
+	closed  bool // Whether the workers have stopped
+}
+
+// jobEventBuffer is how many events a subscriber can fall behind by before further events are dropped for it
+const jobEventBuffer = 64
+
+// importJob is a job along with what it needs to run
+type importJob struct {
+	job         models.ImportJob                  // Guarded by JobQueue.mu
+	subscribers map[chan models.JobEvent]struct{} // Guarded by JobQueue.mu
+	ctx         context.Context
+	cancel      context.CancelFunc
+	upload      *models.UploadSession
+	req         models.CommitRequest
+}
+
+// NewJobQueue returns a new job queue; its workers only start with Run
+func NewJobQueue(l *logger.Logger, importer *ImportService, uploads *UploadStore, opts JobOptions) *JobQueue {
+	opts.Workers = max(opts.Workers, 1)
+	opts.QueueSize = max(opts.QueueSize, 1)
+	return &JobQueue{
+		logger:   l,
+		importer: importer,
+		uploads:  uploads,
+		opts:     opts,
+		queue:    make(chan *importJob, opts.QueueSize),
+		jobs:     make(map[string]*importJob),
+	}
+}
+
+// Submit claims the upload a commit request refers to and queues the commit as a job
+// A real commit takes the upload out of the store so it cannot be committed twice, and the job removes its temp file
+// once finished; validation leaves it in place so it can still be committed afterwards, but holds it until done so it
+// cannot be committed meanwhile
+// The job runs with the values of ctx, such as the signed-in user, but is not cancelled along with it
+// It returns ErrUnavailable, leaving the upload alone, when the queue is full
+func (q *JobQueue) Submit(ctx context.Context, req models.CommitRequest) (*models.ImportJob, *apperrors.AppError) {
+	id, err := newUploadID()
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate job ID")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.pending >= q.opts.QueueSize {
+		return nil, apperrors.Wrap(nil, apperrors.ErrUnavailable)
+	}
+	var upload *models.UploadSession
+	var appErr *apperrors.AppError
+	if req.ValidateOnly {
+		upload, appErr = q.uploads.Acquire(ctx, req.UploadID)
+	} else {
+		upload, appErr = q.uploads.Take(ctx, req.UploadID)
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	j := &importJob{upload: upload, req: req}
+	j.ctx, j.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	j.job = models.ImportJob{
+		ID:             id,
+		Status:         models.JobQueued,
+		ImportProgress: models.ImportProgress{Phase: models.PhaseQueued},
+		Filename:       upload.OriginalFilename,
+		Table:          models.TableRef{Schema: cmp.Or(req.Schema, q.importer.DefaultSchema()), Name: q.importer.csv.SanitizeTableName(req.TableName)},
+		Action:         req.Action,
+		ValidateOnly:   req.ValidateOnly,
+		User:           UsernameFromContext(ctx),
+		SubmittedAt:    time.Now(),
+	}
+	q.jobs[id] = j
+	q.pending++
+	q.queue <- j // Never blocks, as fewer jobs than the queue holds are pending
+	return q.snapshot(j), nil
+}
+
+// Get returns a snapshot of a job, or ErrNotFound when it is unknown, has expired or was submitted by another user
+// than the one signed in with ctx
+func (q *JobQueue) Get(ctx context.Context, id string) (*models.ImportJob, *apperrors.AppError) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, appErr := q.lookup(ctx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	return q.snapshot(j), nil
+}
+
+// Cancel stops a queued or running job; its import is rolled back. It returns ErrDataConflict when the job has
+// already finished
+func (q *JobQueue) Cancel(ctx context.Context, id string) (*models.ImportJob, *apperrors.AppError) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, appErr := q.lookup(ctx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if j.job.Finished() {
+		return nil, apperrors.Wrap(nil, apperrors.ErrDataConflict, "This import has already finished.")
+	}
+	j.cancel()
+	return q.snapshot(j), nil
+}
+
+// Subscribe returns a snapshot of a job and a channel receiving the job's progress and warnings from then on, which
+// is closed once the job finishes, at once if it already has. Events a subscriber is too slow to receive are dropped
+// The caller must call unsubscribe once it stops receiving
+func (q *JobQueue) Subscribe(ctx context.Context, id string) (*models.ImportJob, <-chan models.JobEvent, func(), *apperrors.AppError) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	j, appErr := q.lookup(ctx, id)
+	if appErr != nil {
+		return nil, nil, nil, appErr
+	}
+	events := make(chan models.JobEvent, jobEventBuffer)
+	if j.job.Finished() {
+		close(events)
+		return q.snapshot(j), events, func() {}, nil
+	}
+	if j.subscribers == nil {
+		j.subscribers = make(map[chan models.JobEvent]struct{})
+	}
+	j.subscribers[events] = struct{}{}
+
+	unsubscribe := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, ok := j.subscribers[events]; ok {
+			delete(j.subscribers, events)
+			close(events)
+		}
+	}
+	return q.snapshot(j), events, unsubscribe, nil
+}
+
+// lookup returns a job visible to the user signed in with ctx; q.mu must be held
+func (q *JobQueue) lookup(ctx context.Context, id string) (*importJob, *apperrors.AppError) {
+	j, ok := q.jobs[id]
+	if !ok || (j.job.Finished() && time.Now().After(j.job.ExpiresAt)) || j.job.User != UsernameFromContext(ctx) {
+		return nil, apperrors.Wrap(nil, apperrors.ErrNotFound, "import job not found or expired")
+	}
+	return j, nil
+}
+
+// snapshot returns a copy of a job that stays unchanged as the job goes on; q.mu must be held
+func (q *JobQueue) snapshot(j *importJob) *models.ImportJob {
+	snapshot := q.summary(j)
+	snapshot.RowErrors = append([]models.RowError(nil), j.job.RowErrors...)
+	return snapshot
+}
+
+// summary returns a copy of a job without its row errors; q.mu must be held
+func (q *JobQueue) summary(j *importJob) *models.ImportJob {
+	summary := j.job
+	summary.RowErrors = nil
+	if elapsed := summary.Elapsed(); elapsed > 0 {
+		summary.RowsPerSecond = float64(summary.RowsRead) / elapsed.Seconds()
+	}
+	return &summary
+}
+
+// update applies fn to a job while holding the queue lock, and sends the job's new progress to its subscribers
+func (q *JobQueue) update(j *importJob, fn func(job *models.ImportJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	fn(&j.job)
+	if len(j.subscribers) > 0 {
+		q.publish(j, models.JobEvent{Type: models.JobEventProgress, Job: q.summary(j)})
+	}
+}
+
+// publish sends an event to a job's subscribers, dropping it for those that have fallen behind; q.mu must be held
+func (q *JobQueue) publish(j *importJob, event models.JobEvent) {
+	for events := range j.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// unsubscribeAll closes the channels of a finished job's subscribers
+func (q *JobQueue) unsubscribeAll(j *importJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for events := range j.subscribers {
+		close(events)
+	}
+	j.subscribers = nil
+}
+
+// Run starts the workers and removes finished jobs once they expire, every interval, until ctx is cancelled
+// Running and queued jobs are then cancelled, and Run returns once every worker has stopped
+func (q *JobQueue) Run(ctx context.Context, interval time.Duration) {
+	var wg sync.WaitGroup
+	for range q.opts.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-q.queue:
+					q.run(j)
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			q.shutdown(&wg)
+			return
+		case now := <-ticker.C:
+			if removed := q.purgeExpired(now); removed > 0 {
+				q.logger.Infof("Job janitor removed %d expired import job(s)", removed)
+			}
+		}
+	}
+}
+
+// shutdown cancels every job, waits for the workers to stop and finishes the jobs still queued as cancelled
+func (q *JobQueue) shutdown(wg *sync.WaitGroup) {
+	q.mu.Lock()
+	q.closed = true
+	for _, j := range q.jobs {
+		j.cancel()
+	}
+	q.mu.Unlock()
+
+	wg.Wait()
+	for {
+		select {
+		case j := <-q.queue:
+			q.run(j) // Finishes at once, as the job is cancelled
+		default:
+			return
+		}
+	}
+}
+
+// run runs a job's import and records its outcome
+func (q *JobQueue) run(j *importJob) {
+	defer j.cancel()
+	if j.req.ValidateOnly {
+		defer q.uploads.Release(j.upload.ID)
+	} else {
+		defer q.uploads.removeFile(j.upload.TempFilePath)
+	}
+
+	started := time.Now()
+	q.update(j, func(job *models.ImportJob) {
+		q.pending--
+		job.Status = models.JobRunning
+		job.StartedAt = &started
+	})
+
+	var result *models.CommitResult
+	var appErr *apperrors.AppError
+	if err := j.ctx.Err(); err != nil {
+		appErr = apperrors.Wrap(err, apperrors.ErrCancelled) // Cancelled while queued
+	} else {
+		ctx := WithImportTrace(j.ctx, &ImportTrace{
+			Progress: func(progress models.ImportProgress) {
+				q.update(j, func(job *models.ImportJob) { job.ImportProgress = progress })
+			},
+			Rejected: func(rowErr models.RowError) {
+				q.mu.Lock()
+				defer q.mu.Unlock()
+				if len(j.job.RowErrors) < MaxReportedRowErrors {
+					j.job.RowErrors = append(j.job.RowErrors, rowErr)
+					q.publish(j, models.JobEvent{Type: models.JobEventWarning, Warning: &rowErr})
+				}
+			},
+		})
+		result, appErr = q.importer.Commit(ctx, j.upload, j.req)
+		q.keepResult(j.ctx, result)
+	}
+
+	finished := time.Now()
+	q.update(j, func(job *models.ImportJob) {
+		job.Phase = models.PhaseDone
+		job.Result = result
+		job.FinishedAt = &finished
+		job.ExpiresAt = finished.Add(q.opts.TTL)
+		if result != nil {
+			job.RowsRejected = result.RowsRejected
+		}
+		switch {
+		case appErr == nil:
+			job.Status = models.JobSucceeded
+		case j.ctx.Err() != nil:
+			job.Status = models.JobCancelled
+			job.Error, job.ErrorCode = apperrors.ErrCancelled.Message, apperrors.ErrCancelled.Code
+		default:
+			job.Status = models.JobFailed
+			job.Error, job.ErrorCode = appErr.Message, appErr.Code
+		}
+	})
+	q.unsubscribeAll(j)
+	if appErr != nil && j.ctx.Err() == nil {
+		q.logger.Error(appErr)
+	}
+}
+
+// keepResult stores a validation report or a commit result that rejected rows, so its summary and reject file can be
+// fetched later by the user who submitted the job, carried by ctx
+func (q *JobQueue) keepResult(ctx context.Context, result *models.CommitResult) {
+	if result == nil || (result.RowsRejected == 0 && !result.ValidateOnly) {
+		return
+	}
+	if appErr := q.uploads.AddResult(ctx, result); appErr != nil {
+		q.logger.Error(appErr)
+		if result.RejectFile != "" {
+			os.Remove(result.RejectFile)
+		}
+	}
+}
+
+// purgeExpired removes the finished jobs that expired before now and returns how many were removed
+func (q *JobQueue) purgeExpired(now time.Time) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := 0
+	for id, j := range q.jobs {
+		if j.job.Finished() && now.After(j.job.ExpiresAt) {
+			delete(q.jobs, id)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// AutoMapColumns suggests where each column of an existing table reads its values from
+// Headers are matched to columns on their SanitizeSQLName form, each header at most once; unmatched columns are
+// filled with their default. When no header matches but the upload has exactly one value per column, the columns
+// are matched by position instead, as for files without a header row
+func (s *CSVService) AutoMapColumns(headers []string, columns []models.ColumnDefinition) []models.ColumnMapping {
+	mapping := make([]models.ColumnMapping, len(columns))
+	used := make([]bool, len(headers))
+	matched := false
+	for i, col := range columns {
+		mapping[i] = models.ColumnMapping{Column: col.Name, Fill: models.FillDefault}
+		for j, header := range headers {
+			if !used[j] && s.SanitizeSQLName(header) == col.Name {
+				mapping[i] = models.ColumnMapping{Column: col.Name, Source: header}
+				used[j] = true
+				matched = true
+				break
+			}
+		}
+	}
+
+	if !matched && len(headers) == len(columns) {
+		for i, col := range columns {
+			mapping[i] = models.ColumnMapping{Column: col.Name, Source: headers[i]}
+		}
+	}
+	return mapping
+}
+
+// resolveMapping checks a column mapping against the upload headers and the table columns
+// It returns the columns to load, in table order, and for each of them the index of the record value loaded into it,
+// or -1 to load NULL. Columns filled with their default are left out
+func (s *CSVService) resolveMapping(mapping []models.ColumnMapping, headers []string, columns []models.ColumnDefinition) ([]models.ColumnDefinition, []int, *apperrors.AppError) {
+	byColumn := make(map[string]models.ColumnMapping, len(mapping))
+	for _, m := range mapping {
+		if _, dup := byColumn[m.Column]; dup {
+			return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Column '%s' is mapped more than once.", m.Column))
+		}
+		byColumn[m.Column] = m
+	}
+
+	var loadDefs []models.ColumnDefinition
+	var sources []int
+	for _, col := range columns {
+		m, ok := byColumn[col.Name]
+		if !ok {
+			continue // Not mapped: the column keeps its default
+		}
+		delete(byColumn, col.Name)
+
+		switch {
+		case m.Source != "":
+			index := s.headerIndex(headers, m.Source)
+			if index < 0 {
+				return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Column '%s' is mapped from '%s', which is not a column of the upload.", col.Name, m.Source))
+			}
+			loadDefs = append(loadDefs, col)
+			sources = append(sources, index)
+		case m.Fill == models.FillNull:
+			loadDefs = append(loadDefs, col)
+			sources = append(sources, -1)
+		case m.Fill == models.FillDefault || m.Fill == "":
+			// Left out of the load
+		default:
+			return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Invalid fill '%s' for column '%s'; use '%s' or '%s'.", m.Fill, col.Name, models.FillNull, models.FillDefault))
+		}
+	}
+
+	for name := range byColumn {
+		return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("The mapping refers to column '%s', which the table does not have.", name))
+	}
+	if len(loadDefs) == 0 {
+		return nil, nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, "The mapping leaves every column to its default, so there is nothing to load.")
+	}
+	return loadDefs, sources, nil
+}
+
+// headerIndex finds a header by its exact name, then by its SanitizeSQLName form, returning -1 if there is none
+func (s *CSVService) headerIndex(headers []string, name string) int {
+	for i, header := range headers {
+		if header == name {
+			return i
+		}
+	}
+	sanitized := s.SanitizeSQLName(name)
+	for i, header := range headers {
+		if s.SanitizeSQLName(header) == sanitized {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"context"
+
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// ImportTrace holds hooks called as an import runs, on the goroutine running it; either may be nil
+type ImportTrace struct {
+	Progress func(progress models.ImportProgress) // The import moved to another phase, or loaded more rows
+	Rejected func(rowErr models.RowError)         // A row was skipped because it could not be loaded
+}
+
+// importTraceContextKey is the context key of an import's trace
+type importTraceContextKey struct{}
+
+// WithImportTrace returns a copy of ctx that makes the imports run with it report to trace
+func WithImportTrace(ctx context.Context, trace *ImportTrace) context.Context {
+	return context.WithValue(ctx, importTraceContextKey{}, trace)
+}
+
+// importTraceFromContext returns the trace carried by ctx, or an empty one
+func importTraceFromContext(ctx context.Context) *ImportTrace {
+	if trace, ok := ctx.Value(importTraceContextKey{}).(*ImportTrace); ok && trace != nil {
+		return trace
+	}
+	return &ImportTrace{}
+}
+
+// progress reports the progress of the import, if anyone is listening
+func (t *ImportTrace) progress(progress models.ImportProgress) {
+	if t.Progress != nil {
+		t.Progress(progress)
+	}
+}
+
+// rejected reports a rejected row, if anyone is listening
+func (t *ImportTrace) rejected(rowErr models.RowError) {
+	if t.Rejected != nil {
+		t.Rejected(rowErr)
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// rejectTempPattern is the glob matching the temp files holding rejected rows
+const rejectTempPattern = "sheetbridge-rejects-*"
+
+// MaxReportedRowErrors caps how many row errors are kept in a CommitResult; the reject file always has every row
+const MaxReportedRowErrors = 100
+
+// rejectWriter writes rejected rows to a CSV file, prefixed with the row number and the reason they were rejected
+// The original values follow the error columns so rows with the wrong number of values are kept intact
+type rejectWriter struct {
+	file   *os.File
+	writer *csv.Writer
+}
+
+// newRejectWriter creates a temp reject file and writes its header row
+func newRejectWriter(headers []string) (*rejectWriter, *apperrors.AppError) {
+	file, err := os.CreateTemp("", "sheetbridge-rejects-*.csv")
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to create reject file")
+	}
+	rw := &rejectWriter{file: file, writer: csv.NewWriter(file)}
+	if err := rw.writer.Write(append([]string{"_row", "_column", "_value", "_error"}, headers...)); err != nil {
+		rw.discard()
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to write reject file header")
+	}
+	return rw, nil
+}
+
+// write appends a rejected row
+func (rw *rejectWriter) write(rowErr models.RowError, record []string) *apperrors.AppError {
+	line := append([]string{strconv.FormatInt(rowErr.Row, 10), rowErr.Column, rowErr.Value, rowErr.Reason}, record...)
+	if err := rw.writer.Write(line); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to write row %d to reject file", rowErr.Row))
+	}
+	return nil
+}
+
+// close flushes and closes the reject file, returning its path
+func (rw *rejectWriter) close() (string, *apperrors.AppError) {
+	rw.writer.Flush()
+	if err := rw.writer.Error(); err != nil {
+		rw.discard()
+		return "", apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to flush reject file")
+	}
+	if err := rw.file.Close(); err != nil {
+		os.Remove(rw.file.Name())
+		return "", apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to close reject file")
+	}
+	return rw.file.Name(), nil
+}
+
+// discard closes and deletes the reject file
+func (rw *rejectWriter) discard() {
+	rw.file.Close()
+	os.Remove(rw.file.Name())
+}
+
+// MoveRejectFile moves the temp file holding an import's rejected rows to dst, copying it when it cannot be renamed,
+// e.g. because the temp directory is on another file system. The temp file is removed either way
+func MoveRejectFile(src, dst string) *apperrors.AppError {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	defer os.Remove(src)
+	in, err := os.Open(src)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, "failed to open the rejected rows")
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to create '%s'", dst))
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to write '%s'", dst))
+	}
+	if err := out.Close(); err != nil {
+		return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to write '%s'", dst))
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// SchemaOptions controls which schemas tables can be imported into
+type SchemaOptions struct {
+	Default string   // Schema used when none is chosen
+	Allowed []string // Schemas that may be chosen; empty allows every schema
+}
+
+// DefaultSchema returns the schema tables are imported into unless another one is chosen
+func (s *ImportService) DefaultSchema() string {
+	if s.schemas.Default == "" {
+		return models.DefaultSchema
+	}
+	return s.schemas.Default
+}
+
+// Schemas lists the existing schemas that tables can be imported into
+func (s *ImportService) Schemas(ctx context.Context) ([]string, *apperrors.AppError) {
+	names, appErr := s.repo.GetSchemaNames(ctx)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if len(s.schemas.Allowed) == 0 {
+		return names, nil
+	}
+	return slices.DeleteFunc(names, func(name string) bool { return !slices.Contains(s.schemas.Allowed, name) }), nil
+}
+
+// ResolveSchema returns the schema a request targets, which is the default schema when name is empty
+// The schema must exist and be allowed by the configuration; SheetBridge's own schema is never allowed
+func (s *ImportService) ResolveSchema(ctx context.Context, name string) (string, *apperrors.AppError) {
+	if name == "" {
+		name = s.DefaultSchema()
+	}
+	schemas, appErr := s.Schemas(ctx)
+	if appErr != nil {
+		return "", appErr
+	}
+	if !slices.Contains(schemas, name) {
+		return "", apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Schema '%s' does not exist or cannot be imported into.", name))
+	}
+	return name, nil
+}
@@ -0,0 +1,134 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/models"
+	"github.com/chiltom/SheetBridge/internal/repositories"
+)
+
+// Undo reverts a committed import recorded in the import history: an overwrite gets its table back from the backup,
+// and an append has the rows of its batch deleted. Columns added by schema evolution are kept
+// Imports are undone newest first, so an import cannot be undone while a later import into its table is in effect
+// Only users allowed to run the import's action on its table may undo it
+func (s *ImportService) Undo(ctx context.Context, id int64, user string) (*models.UndoResult, *apperrors.AppError) {
+	tx, err := s.repo.BeginTxx(ctx)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to begin transaction")
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.Rollback()
+		}
+	}()
+
+	record, appErr := s.repo.GetImportRecord(ctx, tx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if appErr = Authorize(ctx, record.Table(), record.Action); appErr != nil {
+		return nil, appErr
+	}
+	if appErr = undoableCheck(record); appErr != nil {
+		return nil, appErr
+	}
+	later, appErr := s.repo.HasLaterImport(ctx, tx, record)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if later {
+		return nil, apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Import %d cannot be undone while a later import into '%s' is in effect. Undo the later imports first.", id, record.Table()))
+	}
+
+	result := &models.UndoResult{}
+	switch record.Action {
+	case models.ActionOverwrite:
+		result.Statements = repositories.RestoreBackupSQL(record.Table(), record.BackupTable)
+		appErr = s.repo.RestoreBackup(ctx, tx, record.Table(), record.BackupTable)
+		result.Message = fmt.Sprintf("Import %d undone: table '%s' was restored from backup '%s'.", id, record.Table(), record.BackupTable)
+	case models.ActionAppend:
+		result.RowsDeleted, appErr = s.repo.DeleteBatch(ctx, tx, record.Table(), record.BatchID)
+		result.Message = fmt.Sprintf("Import %d undone: %d rows were deleted from table '%s'.", id, result.RowsDeleted, record.Table())
+	}
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if appErr = s.repo.MarkImportUndone(ctx, tx, record, user); appErr != nil {
+		return nil, appErr
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrDatabase, "failed to commit transaction")
+	}
+	committed = true
+
+	result.Import = *record
+	return result, nil
+}
+
+// undoableCheck explains why an import cannot be undone, if it cannot
+func undoableCheck(record *models.ImportRecord) *apperrors.AppError {
+	switch {
+	case record.UndoneAt != nil:
+		return apperrors.Wrap(nil, apperrors.ErrDataConflict, fmt.Sprintf("Import %d was already undone.", record.ID))
+	case record.Status != models.ImportCommitted:
+		return apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Import %d was not committed, so there is nothing to undo.", record.ID))
+	case record.Action != models.ActionOverwrite && record.Action != models.ActionAppend:
+		return apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Import %d is a %s; only overwrites and appends can be undone.", record.ID, record.Action))
+	case !record.Undoable():
+		if record.Action == models.ActionOverwrite {
+			return apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("The backup kept by import %d has expired, so it can no longer be undone.", record.ID))
+		}
+		return apperrors.Wrap(nil, apperrors.ErrNotFound, fmt.Sprintf("The rows of import %d were not tagged with a batch, so it cannot be undone.", record.ID))
+	}
+	return nil
+}
+
+// RunBackupJanitor periodically drops the backup tables kept by overwrites for longer than retention, until ctx is
+// cancelled. A retention of 0 keeps backups forever
+func (s *ImportService) RunBackupJanitor(ctx context.Context, retention, interval time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	s.dropExpiredBackups(ctx, time.Now().Add(-retention))
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.dropExpiredBackups(ctx, now.Add(-retention))
+		}
+	}
+}
+
+// dropExpiredBackups drops the backup tables of imports committed before cutoff
+func (s *ImportService) dropExpiredBackups(ctx context.Context, cutoff time.Time) {
+	records, appErr := s.repo.ListExpiredBackups(ctx, cutoff)
+	if appErr != nil {
+		s.logger.Error(appErr)
+		return
+	}
+
+	dropped := 0
+	for _, record := range records {
+		if appErr := s.repo.DropBackup(ctx, record.BackupTable); appErr != nil {
+			s.logger.Error(appErr)
+			continue
+		}
+		if appErr := s.repo.ClearBackup(ctx, record.ID); appErr != nil {
+			s.logger.Error(appErr)
+			continue
+		}
+		dropped++
+	}
+	if dropped > 0 {
+		s.logger.Infof("Backup janitor dropped %d expired backup table(s)", dropped)
+	}
+}
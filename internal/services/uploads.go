@@ -0,0 +1,253 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// uploadTempPattern is the glob matching the temp files created for uploads
+const uploadTempPattern = "sheetbridge-upload-*"
+
+// UploadStore keeps upload sessions, and the results of committing them, in memory keyed by opaque random IDs
+// Temp file paths never leave the server; clients only refer to uploads and results by ID
+// Uploads and results belong to the user who made them, and are not found for anyone else
+type UploadStore struct {
+	mu       sync.Mutex
+	sessions map[string]*models.UploadSession
+	inUse    map[string]int // Validations still reading an upload, by upload ID
+	results  map[string]*models.CommitResult
+	ttl      time.Duration
+	logger   *logger.Logger
+}
+
+// NewUploadStore returns a new upload session store whose sessions expire after ttl
+func NewUploadStore(l *logger.Logger, ttl time.Duration) *UploadStore {
+	return &UploadStore{
+		sessions: make(map[string]*models.UploadSession),
+		inUse:    make(map[string]int),
+		results:  make(map[string]*models.CommitResult),
+		ttl:      ttl,
+		logger:   l,
+	}
+}
+
+// Add assigns a new ID and expiry time to an upload session and stores it as belonging to the user signed in with ctx
+func (s *UploadStore) Add(ctx context.Context, session *models.UploadSession) *apperrors.AppError {
+	id, err := newUploadID()
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate upload ID")
+	}
+	session.ID = id
+	session.User = UsernameFromContext(ctx)
+	session.ExpiresAt = time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	s.sessions[id] = session
+	s.mu.Unlock()
+	return nil
+}
+
+// Get returns a snapshot of the upload session for the given ID, or ErrNotFound if it is unknown, has expired or
+// belongs to another user than the one signed in with ctx
+func (s *UploadStore) Get(ctx context.Context, id string) (*models.UploadSession, *apperrors.AppError) {
+	return s.Update(ctx, id, nil)
+}
+
+// Update applies fn to the upload session while holding the store lock and returns a snapshot of the result
+func (s *UploadStore) Update(ctx context.Context, id string, fn func(session *models.UploadSession)) (*models.UploadSession, *apperrors.AppError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, appErr := s.lookup(ctx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if fn != nil {
+		fn(session)
+	}
+	snapshot := *session
+	return &snapshot, nil
+}
+
+// Take removes the upload session from the store and returns it, so that only one commit can claim an upload
+// The caller becomes responsible for removing the session's temp file
+func (s *UploadStore) Take(ctx context.Context, id string) (*models.UploadSession, *apperrors.AppError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, appErr := s.lookup(ctx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if s.inUse[id] > 0 {
+		return nil, apperrors.Wrap(nil, apperrors.ErrDataConflict, "This upload is still being validated. Commit it once the validation has finished.")
+	}
+	delete(s.sessions, id)
+	return session, nil
+}
+
+// Acquire returns a snapshot of the upload session for the given ID, as Get does, and keeps its temp file in place
+// until Release is called: meanwhile the upload cannot be taken for a commit, nor expire
+func (s *UploadStore) Acquire(ctx context.Context, id string) (*models.UploadSession, *apperrors.AppError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, appErr := s.lookup(ctx, id)
+	if appErr != nil {
+		return nil, appErr
+	}
+	s.inUse[id]++
+	snapshot := *session
+	return &snapshot, nil
+}
+
+// Release lets go of an upload session acquired with Acquire
+func (s *UploadStore) Release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.inUse[id]--; s.inUse[id] <= 0 {
+		delete(s.inUse, id)
+	}
+}
+
+// lookup returns the upload session for an ID when it has not expired and belongs to the user signed in with ctx;
+// s.mu must be held
+func (s *UploadStore) lookup(ctx context.Context, id string) (*models.UploadSession, *apperrors.AppError) {
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) || session.User != UsernameFromContext(ctx) {
+		return nil, apperrors.Wrap(nil, apperrors.ErrNotFound, "upload not found or expired")
+	}
+	return session, nil
+}
+
+// Remove deletes an upload session and its temp file
+func (s *UploadStore) Remove(id string) {
+	s.mu.Lock()
+	session, ok := s.sessions[id]
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	if ok {
+		s.removeFile(session.TempFilePath)
+	}
+}
+
+// AddResult assigns a new ID and expiry time to a commit result and keeps it, along with its reject file, as belonging
+// to the user signed in with ctx
+func (s *UploadStore) AddResult(ctx context.Context, result *models.CommitResult) *apperrors.AppError {
+	id, err := newUploadID()
+	if err != nil {
+		return apperrors.Wrap(err, apperrors.ErrInternalServer, "failed to generate result ID")
+	}
+	result.ID = id
+	result.User = UsernameFromContext(ctx)
+	result.ExpiresAt = time.Now().Add(s.ttl)
+
+	s.mu.Lock()
+	s.results[id] = result
+	s.mu.Unlock()
+	return nil
+}
+
+// GetResult returns a snapshot of the commit result for the given ID, or ErrNotFound if it is unknown, has expired or
+// belongs to another user than the one signed in with ctx
+func (s *UploadStore) GetResult(ctx context.Context, id string) (*models.CommitResult, *apperrors.AppError) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[id]
+	if !ok || time.Now().After(result.ExpiresAt) || result.User != UsernameFromContext(ctx) {
+		return nil, apperrors.Wrap(nil, apperrors.ErrNotFound, "import result not found or expired")
+	}
+	snapshot := *result
+	return &snapshot, nil
+}
+
+// RunJanitor periodically deletes expired upload sessions, commit results and their temp files until ctx is cancelled
+func (s *UploadStore) RunJanitor(ctx context.Context, interval time.Duration) {
+	s.sweepOrphans()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if removed := s.purgeExpired(now); removed > 0 {
+				s.logger.Infof("Upload janitor removed %d expired upload(s) and result(s)", removed)
+			}
+		}
+	}
+}
+
+// purgeExpired removes all sessions and results that expired before now and returns how many were removed
+func (s *UploadStore) purgeExpired(now time.Time) int {
+	var expiredFiles []string
+	s.mu.Lock()
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) && s.inUse[id] == 0 {
+			expiredFiles = append(expiredFiles, session.TempFilePath)
+			delete(s.sessions, id)
+		}
+	}
+	for id, result := range s.results {
+		if now.After(result.ExpiresAt) {
+			expiredFiles = append(expiredFiles, result.RejectFile)
+			delete(s.results, id)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, path := range expiredFiles {
+		if path != "" {
+			s.removeFile(path)
+		}
+	}
+	return len(expiredFiles)
+}
+
+// sweepOrphans removes upload and reject temp files left behind by a previous run that are older than the session TTL
+func (s *UploadStore) sweepOrphans() {
+	var matches []string
+	for _, pattern := range []string{uploadTempPattern, rejectTempPattern} {
+		found, err := filepath.Glob(filepath.Join(os.TempDir(), pattern))
+		if err != nil {
+			s.logger.Errorf("Upload janitor failed to list temp files: %v", err)
+			return
+		}
+		matches = append(matches, found...)
+	}
+	cutoff := time.Now().Add(-s.ttl)
+	for _, path := range matches {
+		if info, err := os.Stat(path); err == nil && info.ModTime().Before(cutoff) {
+			s.removeFile(path)
+		}
+	}
+}
+
+// removeFile removes a temp file, logging anything other than the file already being gone
+func (s *UploadStore) removeFile(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		s.logger.Errorf("Failed to remove upload temp file %s: %v", path, err)
+	}
+}
+
+// newUploadID returns a random 128-bit hex-encoded identifier
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,273 @@
+package services
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/chiltom/SheetBridge/internal/apperrors"
+	"github.com/chiltom/SheetBridge/internal/logger"
+	"github.com/chiltom/SheetBridge/internal/models"
+)
+
+// Subdirectories of the watched directory that imported files are moved to
+const (
+	WatchProcessedDir = "processed"
+	WatchFailedDir    = "failed"
+)
+
+// watchTimeFormat prefixes the names of moved files, so files dropped again under the same name do not collide
+const watchTimeFormat = "20060102-150405"
+
+// WatchOptions controls the drop-folder watcher
+type WatchOptions struct {
+	Dir      string
+	Interval time.Duration // How often the directory is listed
+	Settle   time.Duration // How long a file's size must stay the same before it is imported
+	Rules    []models.WatchRule
+}
+
+// Watcher imports the files dropped into a directory through the same pipeline as the web interface, routing each
+// to a table by the first rule its name matches, then moves it to processed/ or failed/ along with a JSON sidecar
+// describing the outcome. Files matching no rule are left alone
+type Watcher struct {
+	logger   *logger.Logger
+	csv      *CSVService
+	importer *ImportService
+	opts     WatchOptions
+	pending  map[string]watchedFile // Files waiting for their size to settle, by name
+	skipped  map[string]bool        // Files left alone until they are removed, by name
+}
+
+// watchedFile is how a file waiting to settle last looked
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time // When it was first seen looking this way
+}
+
+// NewWatcher returns a new drop-folder watcher; it only starts polling with Run
+func NewWatcher(l *logger.Logger, csv *CSVService, importer *ImportService, opts WatchOptions) *Watcher {
+	return &Watcher{
+		logger:   l,
+		csv:      csv,
+		importer: importer,
+		opts:     opts,
+		pending:  make(map[string]watchedFile),
+		skipped:  make(map[string]bool),
+	}
+}
+
+// LoadWatchRules reads the watch rules from a JSON file holding an array of them, checking their patterns and actions
+func LoadWatchRules(path string) ([]models.WatchRule, *apperrors.AppError) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to read watch rules from '%s'", path))
+	}
+	var rules []models.WatchRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("The watch rules in '%s' are not a valid JSON array of rules: %v.", path, err))
+	}
+	if len(rules) == 0 {
+		return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("'%s' has no watch rules.", path))
+	}
+	for i, rule := range rules {
+		if _, err := filepath.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" || strings.ContainsRune(rule.Pattern, filepath.Separator) {
+			return nil, apperrors.Wrap(err, apperrors.ErrInvalidInput, fmt.Sprintf("Watch rule %d has an invalid pattern '%s'; use a glob matching file names, such as 'sales_*.csv'.", i+1, rule.Pattern))
+		}
+		if !slices.Contains(models.CommitActions, rule.Action) {
+			return nil, apperrors.Wrap(nil, apperrors.ErrInvalidInput, fmt.Sprintf("Watch rule %d has an invalid action '%s'; use create, overwrite, append or upsert.", i+1, rule.Action))
+		}
+	}
+	return rules, nil
+}
+
+// Run polls the watched directory until ctx is done, importing each file once its size has settled
+// It creates the processed/ and failed/ subdirectories first, and only fails if it cannot
+func (w *Watcher) Run(ctx context.Context) *apperrors.AppError {
+	for _, dir := range []string{WatchProcessedDir, WatchFailedDir} {
+		if err := os.MkdirAll(filepath.Join(w.opts.Dir, dir), 0o755); err != nil {
+			return apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to create '%s' in the watched directory", dir))
+		}
+	}
+	w.logger.Infof("Watching '%s' for files to import, with %d rule(s)", w.opts.Dir, len(w.opts.Rules))
+
+	ticker := time.NewTicker(w.opts.Interval)
+	defer ticker.Stop()
+	for {
+		w.poll(ctx, time.Now())
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll lists the watched directory and imports the files whose size has not changed for the settle time
+// Files are imported one at a time, in name order
+func (w *Watcher) poll(ctx context.Context, now time.Time) {
+	entries, err := os.ReadDir(w.opts.Dir)
+	if err != nil {
+		w.logger.Error(apperrors.Wrap(err, apperrors.ErrFileOperation, fmt.Sprintf("failed to list '%s'", w.opts.Dir)))
+		return
+	}
+
+	present := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		// Hidden files and Office lock files are often the temp files of a copy still in progress
+		if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~$") {
+			continue
+		}
+		present[name] = true
+		if w.skipped[name] {
+			continue
+		}
+		rule := w.match(name)
+		if rule == nil {
+			w.logger.Infof("Watcher: '%s' matches no rule and is left alone", name)
+			w.skipped[name] = true
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || !w.settled(name, info, now) {
+			continue // Removed since the directory was listed, or still being written
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		delete(w.pending, name)
+		w.importFile(ctx, name, rule)
+	}
+
+	// Forget the files that are gone, so a new file dropped with the same name is looked at afresh
+	for name := range w.pending {
+		if !present[name] {
+			delete(w.pending, name)
+		}
+	}
+	for name := range w.skipped {
+		if !present[name] {
+			delete(w.skipped, name)
+		}
+	}
+}
+
+// match returns the first rule whose pattern matches a file name, or nil when none does
+func (w *Watcher) match(name string) *models.WatchRule {
+	for i := range w.opts.Rules {
+		if ok, _ := filepath.Match(w.opts.Rules[i].Pattern, name); ok {
+			return &w.opts.Rules[i]
+		}
+	}
+	return nil
+}
+
+// settled reports whether a file's size and modification time have stayed the same for the settle time, which
+// takes at least two polls, so a file still being copied into the directory is not imported half-written
+func (w *Watcher) settled(name string, info os.FileInfo, now time.Time) bool {
+	prev, ok := w.pending[name]
+	if !ok || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+		w.pending[name] = watchedFile{size: info.Size(), modTime: info.ModTime(), since: now}
+		return false
+	}
+	return now.Sub(prev.since) >= w.opts.Settle
+}
+
+// importFile imports a settled file by its rule, then moves it to processed/ when the import committed, or to
+// failed/ otherwise. An import interrupted by ctx leaves the file in place, to be imported on the next run
+func (w *Watcher) importFile(ctx context.Context, name string, rule *models.WatchRule) {
+	outcome := &models.WatchOutcome{File: name, Rule: rule.Pattern, StartedAt: time.Now()}
+	result, appErr := w.commit(ctx, name, rule, outcome)
+	if appErr != nil && ctx.Err() != nil {
+		if result != nil && result.RejectFile != "" {
+			os.Remove(result.RejectFile)
+		}
+		w.logger.Infof("Watcher: the import of '%s' was interrupted and rolled back; the file is left in place", name)
+		return
+	}
+
+	outcome.FinishedAt = time.Now()
+	outcome.Result = result
+	dir := WatchProcessedDir
+	if appErr != nil {
+		outcome.Error, outcome.ErrorCode = appErr.Message, appErr.Code
+		dir = WatchFailedDir
+		w.logger.Errorf("Watcher: failed to import '%s': %v", name, appErr)
+	} else {
+		outcome.Succeeded = true
+		w.logger.Infof("Watcher: imported '%s' into %s.%s (%d row(s))", name, result.Schema, result.TableName, result.RowsImported)
+	}
+	w.archive(dir, name, result, outcome)
+}
+
+// commit runs the import of a file in the watched directory described by its rule
+func (w *Watcher) commit(ctx context.Context, name string, rule *models.WatchRule, outcome *models.WatchOutcome) (*models.CommitResult, *apperrors.AppError) {
+	dialect := models.DefaultCSVDialect()
+	dialect.Encoding = rule.Encoding
+	dialect.Delimiter = rule.Delimiter
+	dialect.Comment = rule.Comment
+	dialect.LazyQuotes = rule.LazyQuotes
+	dialect.TrimLeadingSpace = rule.TrimLeadingSpace
+	dialect.HasHeader = !rule.NoHeader
+
+	upload, appErr := w.csv.InspectLocalFile(filepath.Join(w.opts.Dir, name), w.csv.NormalizeDialect(dialect), rule.Sheet)
+	if appErr != nil {
+		return nil, appErr
+	}
+	outcome.Checksum = upload.FileChecksum
+	names, types, appErr := w.csv.OverrideColumnTypes(upload.InferredColumnDefs, rule.ColumnTypes)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	return w.importer.Commit(ctx, upload, models.CommitRequest{
+		TableName:          cmp.Or(rule.TableName, name),
+		Action:             rule.Action,
+		ColumnNames:        names,
+		ColumnTypes:        types,
+		Sheet:              upload.Sheet,
+		Schema:             rule.Schema,
+		EvolveSchema:       rule.EvolveSchema,
+		KeyColumns:         rule.KeyColumns,
+		SkipInvalidRows:    rule.SkipInvalidRows,
+		MaxRejectedRows:    rule.MaxRejectedRows,
+		MaxRejectedPercent: rule.MaxRejectedPercent,
+	})
+}
+
+// archive moves an imported file into a subdirectory of the watched directory under a timestamped name, along with
+// its rejected rows, and writes the outcome next to it as <name>.result.json
+// A file that cannot be moved is left alone until it is removed, rather than imported again on every poll
+func (w *Watcher) archive(dir, name string, result *models.CommitResult, outcome *models.WatchOutcome) {
+	stem := outcome.FinishedAt.Format(watchTimeFormat) + "_" + name
+	dst := filepath.Join(w.opts.Dir, dir, stem)
+
+	if result != nil && result.RejectFile != "" {
+		if appErr := MoveRejectFile(result.RejectFile, dst+".rejects.csv"); appErr != nil {
+			w.logger.Error(appErr)
+		} else {
+			outcome.RejectFile = stem + ".rejects.csv"
+		}
+	}
+
+	if err := os.Rename(filepath.Join(w.opts.Dir, name), dst); err != nil {
+		w.skipped[name] = true
+		w.logger.Errorf("Watcher: failed to move '%s' to %s/, so it is left alone until removed: %v", name, dir, err)
+	}
+
+	data, err := json.MarshalIndent(outcome, "", "  ")
+	if err == nil {
+		err = os.WriteFile(dst+".result.json", data, 0o644)
+	}
+	if err != nil {
+		w.logger.Errorf("Watcher: failed to write the result of '%s': %v", name, err)
+	}
+}
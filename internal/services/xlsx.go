@@ -0,0 +1,502 @@
+package services
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dateFormatKind classifies a cell number format by the kind of temporal value it displays
+type dateFormatKind int
+
+const (
+	dateFormatNone dateFormatKind = iota
+	dateFormatDate
+	dateFormatTime
+	dateFormatDateTime
+)
+
+// xlsxWorkbook is a minimal, read-only view of an .xlsx workbook
+// Only what is needed to stream cell values is parsed: sheet names, shared strings and date number formats
+type xlsxWorkbook struct {
+	zr            *zip.ReadCloser
+	sheetNames    []string
+	sheetPaths    map[string]string // Sheet name -> zip entry path
+	sharedStrings []string
+	styleFormats  []dateFormatKind // Indexed by the cell style attribute "s"
+	date1904      bool
+}
+
+// XML shapes for the workbook parts that are read in full
+
+type xlsxWorkbookXML struct {
+	WorkbookPr struct {
+		Date1904 string `xml:"date1904,attr"`
+	} `xml:"workbookPr"`
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationshipsXML struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxSharedStringsXML struct {
+	Items []struct {
+		T    *string `xml:"t"`
+		Runs []struct {
+			T string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"si"`
+}
+
+type xlsxStylesXML struct {
+	NumFmts []struct {
+		ID         int    `xml:"numFmtId,attr"`
+		FormatCode string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+// openXLSXWorkbook opens an .xlsx file and loads its sheet list, shared strings and styles
+func openXLSXWorkbook(filePath string) (*xlsxWorkbook, error) {
+	zr, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("file is not a valid .xlsx workbook: %w", err)
+	}
+	wb := &xlsxWorkbook{zr: zr, sheetPaths: make(map[string]string)}
+	if err := wb.load(); err != nil {
+		zr.Close()
+		return nil, err
+	}
+	return wb, nil
+}
+
+// load parses the workbook-level parts of the archive
+func (wb *xlsxWorkbook) load() error {
+	var workbook xlsxWorkbookXML
+	if err := wb.decodePart("xl/workbook.xml", &workbook); err != nil {
+		return fmt.Errorf("failed to read workbook: %w", err)
+	}
+	wb.date1904 = workbook.WorkbookPr.Date1904 == "1" || workbook.WorkbookPr.Date1904 == "true"
+
+	var rels xlsxRelationshipsXML
+	if err := wb.decodePart("xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return fmt.Errorf("failed to read workbook relationships: %w", err)
+	}
+	targets := make(map[string]string, len(rels.Relationships))
+	for _, rel := range rels.Relationships {
+		target := rel.Target
+		if strings.HasPrefix(target, "/") {
+			target = strings.TrimPrefix(target, "/")
+		} else {
+			target = path.Join("xl", target)
+		}
+		targets[rel.ID] = target
+	}
+
+	for _, sheet := range workbook.Sheets {
+		target, ok := targets[sheet.RID]
+		if !ok {
+			continue // Chart sheets and other non-worksheet parts have no usable target
+		}
+		wb.sheetNames = append(wb.sheetNames, sheet.Name)
+		wb.sheetPaths[sheet.Name] = target
+	}
+	if len(wb.sheetNames) == 0 {
+		return fmt.Errorf("workbook contains no worksheets")
+	}
+
+	// Shared strings and styles are optional parts
+	var sst xlsxSharedStringsXML
+	if err := wb.decodePart("xl/sharedStrings.xml", &sst); err != nil && err != errPartNotFound {
+		return fmt.Errorf("failed to read shared strings: %w", err)
+	}
+	wb.sharedStrings = make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		if item.T != nil {
+			wb.sharedStrings[i] = *item.T
+			continue
+		}
+		var sb strings.Builder
+		for _, run := range item.Runs {
+			sb.WriteString(run.T)
+		}
+		wb.sharedStrings[i] = sb.String()
+	}
+
+	var styles xlsxStylesXML
+	if err := wb.decodePart("xl/styles.xml", &styles); err != nil && err != errPartNotFound {
+		return fmt.Errorf("failed to read styles: %w", err)
+	}
+	customFormats := make(map[int]string, len(styles.NumFmts))
+	for _, numFmt := range styles.NumFmts {
+		customFormats[numFmt.ID] = numFmt.FormatCode
+	}
+	wb.styleFormats = make([]dateFormatKind, len(styles.CellXfs))
+	for i, xf := range styles.CellXfs {
+		wb.styleFormats[i] = classifyNumFmt(xf.NumFmtID, customFormats[xf.NumFmtID])
+	}
+	return nil
+}
+
+// errPartNotFound is returned by decodePart when the archive has no such entry
+var errPartNotFound = errors.New("part not found")
+
+// decodePart unmarshals a whole XML part of the archive into v
+func (wb *xlsxWorkbook) decodePart(name string, v any) error {
+	rc, err := wb.openPart(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// openPart opens an entry of the archive by name
+func (wb *xlsxWorkbook) openPart(name string) (io.ReadCloser, error) {
+	for _, f := range wb.zr.File {
+		if f.Name == name {
+			return f.Open()
+		}
+	}
+	return nil, errPartNotFound
+}
+
+// Close closes the underlying archive
+func (wb *xlsxWorkbook) Close() error {
+	return wb.zr.Close()
+}
+
+// openSheet returns a stream over the rows of the named worksheet
+// The stream takes ownership of the workbook and closes it when closed
+func (wb *xlsxWorkbook) openSheet(name string) (*XLSXStream, error) {
+	partName, ok := wb.sheetPaths[name]
+	if !ok {
+		return nil, fmt.Errorf("sheet '%s' does not exist in workbook", name)
+	}
+	rc, err := wb.openPart(partName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sheet '%s': %w", name, err)
+	}
+	return &XLSXStream{workbook: wb, part: rc, decoder: xml.NewDecoder(rc)}, nil
+}
+
+// XLSXStream is a forward-only reader over the rows of a single worksheet
+// Rows are decoded from the sheet XML one at a time, so only shared strings are held in memory
+type XLSXStream struct {
+	workbook *xlsxWorkbook
+	part     io.ReadCloser
+	decoder  *xml.Decoder
+	width    int // When set, rows are padded or trimmed to this many columns
+}
+
+// setWidth fixes the number of columns returned per row, normally to the width of the header row
+func (xs *XLSXStream) setWidth(width int) {
+	xs.width = width
+}
+
+// Read returns the next non-empty row of the sheet, or io.EOF when there are no more rows
+func (xs *XLSXStream) Read() ([]string, error) {
+	for {
+		row, err := xs.nextRow()
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			continue // Entirely blank row
+		}
+		return xs.fit(row), nil
+	}
+}
+
+// fit pads short rows to the stream width and drops trailing empty cells beyond it
+func (xs *XLSXStream) fit(row []string) []string {
+	if xs.width == 0 {
+		return row
+	}
+	for len(row) < xs.width {
+		row = append(row, "")
+	}
+	for len(row) > xs.width && row[len(row)-1] == "" {
+		row = row[:len(row)-1]
+	}
+	return row
+}
+
+// nextRow decodes the next <row> element; it returns nil for rows without any values
+func (xs *XLSXStream) nextRow() ([]string, error) {
+	for {
+		tok, err := xs.decoder.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed to parse sheet XML: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local == "row" {
+			return xs.decodeRow()
+		}
+	}
+}
+
+// decodeRow reads the cells of the current <row> element
+func (xs *XLSXStream) decodeRow() ([]string, error) {
+	var row []string
+	hasValue := false
+	nextCol := 0
+
+	for {
+		tok, err := xs.decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sheet row: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local != "c" {
+				continue
+			}
+			col, value, err := xs.decodeCell(t, nextCol)
+			if err != nil {
+				return nil, err
+			}
+			if col > maxXLSXColumn {
+				return nil, fmt.Errorf("failed to parse sheet row: more than %d columns", maxXLSXColumn+1)
+			}
+			for len(row) <= col {
+				row = append(row, "")
+			}
+			row[col] = value
+			if value != "" {
+				hasValue = true
+			}
+			nextCol = col + 1
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				if !hasValue {
+					return nil, nil
+				}
+				return row, nil
+			}
+		}
+	}
+}
+
+// decodeCell reads a <c> element and returns its column index and display value
+func (xs *XLSXStream) decodeCell(start xml.StartElement, defaultCol int) (int, string, error) {
+	col := defaultCol
+	cellType := ""
+	style := -1
+	for _, attr := range start.Attr {
+		switch attr.Name.Local {
+		case "r":
+			idx, ok := columnIndexFromRef(attr.Value)
+			if !ok {
+				return 0, "", fmt.Errorf("failed to parse sheet cell: invalid cell reference %q", attr.Value)
+			}
+			col = idx
+		case "t":
+			cellType = attr.Value
+		case "s":
+			if s, err := strconv.Atoi(attr.Value); err == nil {
+				style = s
+			}
+		}
+	}
+
+	var raw, inline strings.Builder
+	var inValue, inInline bool
+	for {
+		tok, err := xs.decoder.Token()
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to parse sheet cell: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "v":
+				inValue = true
+			case "t":
+				inInline = true
+			}
+		case xml.CharData:
+			if inValue {
+				raw.Write(t)
+			} else if inInline {
+				inline.Write(t)
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "v":
+				inValue = false
+			case "t":
+				inInline = false
+			case "c":
+				return col, xs.cellValue(cellType, style, raw.String(), inline.String()), nil
+			}
+		}
+	}
+}
+
+// cellValue converts a raw cell value into the string handed to the import pipeline
+func (xs *XLSXStream) cellValue(cellType string, style int, raw, inline string) string {
+	switch cellType {
+	case "s":
+		idx, err := strconv.Atoi(raw)
+		if err != nil || idx < 0 || idx >= len(xs.workbook.sharedStrings) {
+			return raw
+		}
+		return xs.workbook.sharedStrings[idx]
+	case "inlineStr":
+		return inline
+	case "b":
+		if raw == "1" {
+			return "true"
+		}
+		return "false"
+	case "str", "e", "d":
+		return raw // Formula string results, error values such as #N/A, and ISO 8601 dates are used as-is
+	}
+
+	if raw == "" {
+		return ""
+	}
+	if style >= 0 && style < len(xs.workbook.styleFormats) && xs.workbook.styleFormats[style] != dateFormatNone {
+		if serial, err := strconv.ParseFloat(raw, 64); err == nil {
+			return formatExcelSerial(serial, xs.workbook.date1904, xs.workbook.styleFormats[style])
+		}
+	}
+	return raw
+}
+
+// Close closes the sheet and its workbook
+func (xs *XLSXStream) Close() error {
+	xs.part.Close()
+	return xs.workbook.Close()
+}
+
+// maxXLSXColumn is the zero-based index of XFD, the last column a worksheet can have
+const maxXLSXColumn = 16383
+
+// columnIndexFromRef converts a cell reference such as "AB12" into a zero-based column index
+// It reports false for references without column letters or beyond column XFD
+func columnIndexFromRef(ref string) (int, bool) {
+	col := 0
+	i := 0
+	for ; i < len(ref); i++ {
+		c := ref[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c < 'A' || c > 'Z' {
+			break
+		}
+		if i == 3 {
+			return 0, false // No column has more than three letters
+		}
+		col = col*26 + int(c-'A'+1)
+	}
+	if i == 0 || col-1 > maxXLSXColumn {
+		return 0, false
+	}
+	return col - 1, true
+}
+
+// classifyNumFmt reports whether a number format displays dates, times or both
+func classifyNumFmt(id int, formatCode string) dateFormatKind {
+	// Built-in formats defined by ECMA-376 and commonly used locale variants
+	switch {
+	case id >= 14 && id <= 17, id >= 27 && id <= 31, id >= 34 && id <= 36, id >= 50 && id <= 58:
+		return dateFormatDate
+	case id >= 18 && id <= 21, id >= 32 && id <= 33, id >= 45 && id <= 47:
+		return dateFormatTime
+	case id == 22:
+		return dateFormatDateTime
+	}
+	if formatCode == "" {
+		return dateFormatNone
+	}
+
+	// Strip quoted literals, escaped characters and bracketed sections such as colors or locales
+	var cleaned strings.Builder
+	inQuote, inBracket := false, false
+	for i := 0; i < len(formatCode); i++ {
+		c := formatCode[i]
+		switch {
+		case inQuote:
+			inQuote = c != '"'
+		case inBracket:
+			inBracket = c != ']'
+		case c == '"':
+			inQuote = true
+		case c == '[':
+			inBracket = true
+		case c == '\\' || c == '_' || c == '*':
+			i++ // Skip the escaped or padding character
+		default:
+			cleaned.WriteByte(c)
+		}
+	}
+	code := strings.ToLower(cleaned.String())
+	if section, _, found := strings.Cut(code, ";"); found {
+		code = section // Only the positive-number section matters
+	}
+
+	hasDate := strings.ContainsAny(code, "yd")
+	hasTime := strings.ContainsAny(code, "hs")
+	switch {
+	case hasDate && hasTime:
+		return dateFormatDateTime
+	case hasTime:
+		return dateFormatTime
+	case hasDate || strings.Contains(code, "m") && !strings.ContainsAny(code, "0#?"):
+		return dateFormatDate
+	default:
+		return dateFormatNone
+	}
+}
+
+// formatExcelSerial converts an Excel date serial number into a DATE, TIME or TIMESTAMP string
+func formatExcelSerial(serial float64, date1904 bool, kind dateFormatKind) string {
+	epoch := time.Date(1899, time.December, 30, 0, 0, 0, 0, time.UTC)
+	if date1904 {
+		epoch = time.Date(1904, time.January, 1, 0, 0, 0, 0, time.UTC)
+	} else if serial >= 1 && serial < 61 {
+		// Excel treats 1900 as a leap year, so serials before March 1900 are off by one day. Serials below 1 are
+		// times of day without a date and are left alone
+		serial++
+	}
+
+	days := math.Floor(serial)
+	millis := math.Round((serial - days) * 24 * 60 * 60 * 1000)
+	t := epoch.AddDate(0, 0, int(days)).Add(time.Duration(millis) * time.Millisecond)
+
+	switch kind {
+	case dateFormatDate:
+		if millis == 0 {
+			return t.Format("2006-01-02")
+		}
+		return t.Format("2006-01-02 15:04:05.999")
+	case dateFormatTime:
+		if days == 0 {
+			return t.Format("15:04:05.999")
+		}
+		return t.Format("2006-01-02 15:04:05.999")
+	default:
+		return t.Format("2006-01-02 15:04:05.999")
+	}
+}
@@ -3,7 +3,9 @@ package utils
 import (
 	"fmt"
 	"log"
+	"net/netip"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +30,41 @@ type Config struct {
 		MaxOpenConns int
 		MaxIdleConns int
 		MaxIdleTime  time.Duration
+
+		DefaultSchema  string   // Schema tables are imported into unless another one is chosen
+		AllowedSchemas []string // Schemas tables may be imported into; empty allows every schema
+	}
+	Uploads struct {
+		TTL             time.Duration // How long an upload stays available for commit after preview
+		JanitorInterval time.Duration // How often expired uploads are cleaned up
+	}
+	Jobs struct {
+		Workers   int // Imports run at the same time
+		QueueSize int // Imports that can wait for a free worker; more are refused
+	}
+	Watch struct {
+		Dir      string        // Directory the CLI's watch command polls for files to import, unless -dir is given
+		Rules    string        // JSON file of the rules routing dropped files to tables, unless -rules is given
+		Interval time.Duration // How often the directory is polled
+		Settle   time.Duration // How long a file's size must stay the same before it is imported
+	}
+	Backups struct {
+		Retention       time.Duration // How long tables replaced by an overwrite are kept for undo; 0 keeps them forever
+		JanitorInterval time.Duration // How often expired backups are dropped
+	}
+	Inference struct {
+		SampleRows int    // Rows used to infer column types; 0 scans the whole file
+		Sampling   string // "reservoir" (random rows from the whole file) or "head" (the first rows)
+	}
+	Auth struct {
+		Mode              string         // "local" (passwords stored by SheetBridge), "proxy" (trusted reverse-proxy header) or "none"
+		SessionTTL        time.Duration  // How long a sign-in lasts
+		CookieSecure      bool           // Whether the session cookie is only sent over HTTPS
+		ProxyHeader       string         // Header holding the username in proxy mode
+		TrustedProxies    []netip.Prefix // Addresses whose proxy header is believed
+		DefaultRoles      []string       // Roles given to every user SheetBridge creates
+		BootstrapUser     string         // First local user, created when there are no users yet
+		BootstrapPassword string
 	}
 	// Add other configs when needed
 }
@@ -107,6 +144,128 @@ func LoadConfig(path ...string) *Config {
 		cfg.DB.MaxIdleTime = 15 * time.Minute
 	}
 
+	cfg.DB.DefaultSchema = strings.TrimSpace(os.Getenv("DB_DEFAULT_SCHEMA"))
+	if cfg.DB.DefaultSchema == "" {
+		cfg.DB.DefaultSchema = "public"
+	}
+
+	for _, schema := range strings.Split(os.Getenv("DB_ALLOWED_SCHEMAS"), ",") {
+		if schema = strings.TrimSpace(schema); schema != "" {
+			cfg.DB.AllowedSchemas = append(cfg.DB.AllowedSchemas, schema)
+		}
+	}
+	if len(cfg.DB.AllowedSchemas) > 0 && !slices.Contains(cfg.DB.AllowedSchemas, cfg.DB.DefaultSchema) {
+		log.Printf("Info: Default schema %q is not in DB_ALLOWED_SCHEMAS, using %q instead.", cfg.DB.DefaultSchema, cfg.DB.AllowedSchemas[0])
+		cfg.DB.DefaultSchema = cfg.DB.AllowedSchemas[0]
+	}
+
+	cfg.Uploads.TTL, err = time.ParseDuration(os.Getenv("UPLOAD_TTL"))
+	if err != nil || cfg.Uploads.TTL <= 0 {
+		cfg.Uploads.TTL = time.Hour
+	}
+
+	cfg.Uploads.JanitorInterval, err = time.ParseDuration(os.Getenv("UPLOAD_JANITOR_INTERVAL"))
+	if err != nil || cfg.Uploads.JanitorInterval <= 0 {
+		cfg.Uploads.JanitorInterval = 5 * time.Minute
+	}
+
+	cfg.Jobs.Workers, err = strconv.Atoi(os.Getenv("JOB_WORKERS"))
+	if err != nil || cfg.Jobs.Workers <= 0 {
+		cfg.Jobs.Workers = 2
+	}
+
+	cfg.Jobs.QueueSize, err = strconv.Atoi(os.Getenv("JOB_QUEUE_SIZE"))
+	if err != nil || cfg.Jobs.QueueSize <= 0 {
+		cfg.Jobs.QueueSize = 50
+	}
+
+	cfg.Watch.Dir = strings.TrimSpace(os.Getenv("WATCH_DIR"))
+	cfg.Watch.Rules = strings.TrimSpace(os.Getenv("WATCH_RULES"))
+
+	cfg.Watch.Interval, err = time.ParseDuration(os.Getenv("WATCH_INTERVAL"))
+	if err != nil || cfg.Watch.Interval <= 0 {
+		cfg.Watch.Interval = 5 * time.Second
+	}
+
+	cfg.Watch.Settle, err = time.ParseDuration(os.Getenv("WATCH_SETTLE"))
+	if err != nil || cfg.Watch.Settle < 0 {
+		cfg.Watch.Settle = 10 * time.Second
+	}
+
+	cfg.Backups.Retention, err = time.ParseDuration(os.Getenv("BACKUP_RETENTION"))
+	if err != nil || cfg.Backups.Retention < 0 {
+		cfg.Backups.Retention = 7 * 24 * time.Hour
+	}
+
+	cfg.Backups.JanitorInterval, err = time.ParseDuration(os.Getenv("BACKUP_JANITOR_INTERVAL"))
+	if err != nil || cfg.Backups.JanitorInterval <= 0 {
+		cfg.Backups.JanitorInterval = time.Hour
+	}
+
+	cfg.Inference.SampleRows, err = strconv.Atoi(os.Getenv("INFER_SAMPLE_ROWS"))
+	if err != nil || cfg.Inference.SampleRows < 0 {
+		cfg.Inference.SampleRows = 0
+	}
+
+	cfg.Inference.Sampling = strings.ToLower(os.Getenv("INFER_SAMPLING"))
+	if cfg.Inference.Sampling != "head" {
+		cfg.Inference.Sampling = "reservoir"
+	}
+
+	cfg.Auth.Mode = strings.ToLower(strings.TrimSpace(os.Getenv("AUTH_MODE")))
+	switch cfg.Auth.Mode {
+	case "local", "proxy", "none":
+	case "":
+		cfg.Auth.Mode = "local"
+	default:
+		log.Printf("Info: Unknown AUTH_MODE %q, using \"local\" instead.", cfg.Auth.Mode)
+		cfg.Auth.Mode = "local"
+	}
+
+	cfg.Auth.SessionTTL, err = time.ParseDuration(os.Getenv("AUTH_SESSION_TTL"))
+	if err != nil || cfg.Auth.SessionTTL <= 0 {
+		cfg.Auth.SessionTTL = 12 * time.Hour
+	}
+
+	cfg.Auth.CookieSecure, err = strconv.ParseBool(os.Getenv("AUTH_COOKIE_SECURE"))
+	if err != nil {
+		cfg.Auth.CookieSecure = !cfg.IsDevelopment()
+	}
+
+	cfg.Auth.ProxyHeader = strings.TrimSpace(os.Getenv("AUTH_PROXY_HEADER"))
+	if cfg.Auth.ProxyHeader == "" {
+		cfg.Auth.ProxyHeader = "X-Forwarded-User"
+	}
+
+	trustedProxies := os.Getenv("AUTH_TRUSTED_PROXIES")
+	if trustedProxies == "" {
+		trustedProxies = "127.0.0.1/32,::1/128"
+	}
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(proxy)
+			if addrErr != nil {
+				log.Printf("Info: Ignoring invalid AUTH_TRUSTED_PROXIES entry %q: %v", proxy, err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		cfg.Auth.TrustedProxies = append(cfg.Auth.TrustedProxies, prefix.Masked())
+	}
+
+	for _, role := range strings.Split(os.Getenv("AUTH_DEFAULT_ROLES"), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			cfg.Auth.DefaultRoles = append(cfg.Auth.DefaultRoles, role)
+		}
+	}
+
+	cfg.Auth.BootstrapUser = strings.TrimSpace(os.Getenv("AUTH_BOOTSTRAP_USER"))
+	cfg.Auth.BootstrapPassword = os.Getenv("AUTH_BOOTSTRAP_PASSWORD")
+
 	return &cfg
 }
 
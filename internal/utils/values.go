@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Patterns for recognizing typed values in spreadsheet cells
+var (
+	uuidRegex        = regexp.MustCompile(`^\{?[0-9a-fA-F]{8}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{4}-?[0-9a-fA-F]{12}\}?$`)
+	decimalRegex     = regexp.MustCompile(`^[+-]?(\d+)?(?:\.(\d*))?$`)
+	isoIntervalRegex = regexp.MustCompile(`^P(?:\d+(?:\.\d+)?[YMWD])*(?:T(?:\d+(?:\.\d+)?[HMS])+)?$`)
+	pgIntervalRegex  = regexp.MustCompile(`^(?:[+-]?\d+(?:\.\d+)?\s*(?:microseconds?|milliseconds?|seconds?|secs?|s|minutes?|mins?|m|hours?|hrs?|h|days?|d|weeks?|w|months?|mons?|years?|yrs?|y|decades?|centuries|century|millennia|millennium)\b\s*)*(?:[+-]?\d+:\d{2}(?::\d{2}(?:\.\d+)?)?)?\s*(?:ago)?$`)
+)
+
+// TimeOfDayLayouts are the layouts accepted for TIME values
+var TimeOfDayLayouts = []string{"15:04:05.999999999", "15:04:05", "15:04", "3:04:05 PM", "3:04 PM", "3:04:05PM", "3:04PM"}
+
+// IsUUID reports whether s is a UUID, with or without hyphens and braces
+func IsUUID(s string) bool {
+	return uuidRegex.MatchString(s)
+}
+
+// ParseDecimal reports whether s is a plain decimal number (no exponent), along with
+// its number of significant integer digits and its number of fractional digits
+func ParseDecimal(s string) (intDigits, scale int, ok bool) {
+	m := decimalRegex.FindStringSubmatch(s)
+	if m == nil || (m[1] == "" && m[2] == "") {
+		return 0, 0, false
+	}
+	return len(strings.TrimLeft(m[1], "0")), len(m[2]), true
+}
+
+// IsInterval reports whether s is an ISO 8601 duration (e.g. "P1DT2H") or a PostgreSQL-style interval
+// with units (e.g. "3 days 04:05:06" or "2 hours ago")
+// Bare numbers are not considered intervals, since they carry no unit
+func IsInterval(s string) bool {
+	if isoIntervalRegex.MatchString(s) {
+		return s != "P"
+	}
+	lower := strings.ToLower(strings.TrimSpace(s))
+	if lower == "" || lower == "ago" || !strings.ContainsAny(lower, "abcdefghijklmnopqrstuvwxyz:") {
+		return false
+	}
+	return pgIntervalRegex.MatchString(lower)
+}
+
+// IsJSONDocument reports whether s is a JSON object or array
+func IsJSONDocument(s string) bool {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") && !strings.HasPrefix(s, "[") {
+		return false
+	}
+	return json.Valid([]byte(s))
+}
+
+// ParseTimeOfDay parses a time of day such as "14:30", "14:30:15.5" or "2:30 PM"
+func ParseTimeOfDay(s string) (time.Time, bool) {
+	for _, layout := range TimeOfDayLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sheetbridge.import_history;
+DROP SCHEMA IF EXISTS sheetbridge CASCADE;
@@ -0,0 +1,23 @@
+CREATE SCHEMA IF NOT EXISTS sheetbridge;
+
+CREATE TABLE IF NOT EXISTS sheetbridge.import_history (
+    id                BIGSERIAL PRIMARY KEY,
+    original_filename TEXT        NOT NULL,
+    file_checksum     TEXT        NOT NULL,
+    file_size         BIGINT      NOT NULL DEFAULT 0,
+    sheet             TEXT        NOT NULL DEFAULT '',
+    table_name        TEXT        NOT NULL,
+    action            TEXT        NOT NULL,
+    status            TEXT        NOT NULL,
+    rows_imported     BIGINT      NOT NULL DEFAULT 0,
+    rows_inserted     BIGINT      NOT NULL DEFAULT 0,
+    rows_updated      BIGINT      NOT NULL DEFAULT 0,
+    rows_rejected     BIGINT      NOT NULL DEFAULT 0,
+    error_message     TEXT        NOT NULL DEFAULT '',
+    duration_ms       BIGINT      NOT NULL DEFAULT 0,
+    imported_by       TEXT        NOT NULL DEFAULT '',
+    imported_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS import_history_imported_at_idx ON sheetbridge.import_history (imported_at DESC);
+CREATE INDEX IF NOT EXISTS import_history_table_name_idx ON sheetbridge.import_history (table_name, imported_at DESC);
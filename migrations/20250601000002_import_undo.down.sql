@@ -0,0 +1,5 @@
+ALTER TABLE sheetbridge.import_history
+    DROP COLUMN IF EXISTS batch_id,
+    DROP COLUMN IF EXISTS backup_table,
+    DROP COLUMN IF EXISTS undone_at,
+    DROP COLUMN IF EXISTS undone_by;
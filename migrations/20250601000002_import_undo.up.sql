@@ -0,0 +1,5 @@
+ALTER TABLE sheetbridge.import_history
+    ADD COLUMN IF NOT EXISTS batch_id     TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS backup_table TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS undone_at    TIMESTAMPTZ,
+    ADD COLUMN IF NOT EXISTS undone_by    TEXT        NOT NULL DEFAULT '';
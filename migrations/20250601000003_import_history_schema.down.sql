@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS sheetbridge.import_history_table_idx;
+CREATE INDEX IF NOT EXISTS import_history_table_name_idx ON sheetbridge.import_history (table_name, imported_at DESC);
+
+ALTER TABLE sheetbridge.import_history
+    DROP COLUMN IF EXISTS table_schema;
@@ -0,0 +1,5 @@
+ALTER TABLE sheetbridge.import_history
+    ADD COLUMN IF NOT EXISTS table_schema TEXT NOT NULL DEFAULT 'public';
+
+DROP INDEX IF EXISTS sheetbridge.import_history_table_name_idx;
+CREATE INDEX IF NOT EXISTS import_history_table_idx ON sheetbridge.import_history (table_schema, table_name, imported_at DESC);
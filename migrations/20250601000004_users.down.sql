@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS sheetbridge.sessions;
+DROP TABLE IF EXISTS sheetbridge.users;
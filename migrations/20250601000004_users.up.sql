@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS sheetbridge.users (
+    id            BIGSERIAL PRIMARY KEY,
+    username      TEXT        NOT NULL UNIQUE,
+    password_hash TEXT        NOT NULL DEFAULT '', -- bcrypt; empty for users who only sign in through the proxy header
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS sheetbridge.sessions (
+    token_hash TEXT PRIMARY KEY, -- Hex-encoded SHA-256 of the session cookie
+    user_id    BIGINT      NOT NULL REFERENCES sheetbridge.users (id) ON DELETE CASCADE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS sessions_expires_at_idx ON sheetbridge.sessions (expires_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS sheetbridge.user_roles;
+DROP TABLE IF EXISTS sheetbridge.role_permissions;
+DROP TABLE IF EXISTS sheetbridge.roles;
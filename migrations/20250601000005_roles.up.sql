@@ -0,0 +1,33 @@
+CREATE TABLE IF NOT EXISTS sheetbridge.roles (
+    name        TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+-- A permission lets a role run an action on the tables whose schema and name match its glob patterns
+CREATE TABLE IF NOT EXISTS sheetbridge.role_permissions (
+    id             BIGSERIAL PRIMARY KEY,
+    role           TEXT NOT NULL REFERENCES sheetbridge.roles (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    schema_pattern TEXT NOT NULL DEFAULT '*',
+    table_pattern  TEXT NOT NULL DEFAULT '*',
+    action         TEXT NOT NULL, -- create, overwrite, append, upsert, or * for every action
+    UNIQUE (role, schema_pattern, table_pattern, action)
+);
+
+CREATE TABLE IF NOT EXISTS sheetbridge.user_roles (
+    user_id BIGINT NOT NULL REFERENCES sheetbridge.users (id) ON DELETE CASCADE,
+    role    TEXT   NOT NULL REFERENCES sheetbridge.roles (name) ON DELETE CASCADE ON UPDATE CASCADE,
+    PRIMARY KEY (user_id, role)
+);
+
+INSERT INTO sheetbridge.roles (name, description)
+VALUES ('admin', 'Every action on every table')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO sheetbridge.role_permissions (role, schema_pattern, table_pattern, action)
+VALUES ('admin', '*', '*', '*')
+ON CONFLICT DO NOTHING;
+
+-- Users who signed in before roles existed keep full access
+INSERT INTO sheetbridge.user_roles (user_id, role)
+SELECT id, 'admin' FROM sheetbridge.users
+ON CONFLICT DO NOTHING;
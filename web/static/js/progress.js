@@ -0,0 +1,118 @@
+// Follows import jobs over Server-Sent Events, so their progress shows without polling
+// A [data-job] element is filled from its job's event stream: [data-field] elements receive the job's values,
+// [data-job-bar] the share of rows read and [data-job-log] the rejected rows. Once the job finishes, the browser goes
+// to its status page. A [data-job-form] form is submitted in the background and followed in the [data-job] element
+// its attribute names, instead of leaving the page
+(() => {
+  "use strict";
+
+  const jobPage = (id) => `/jobs/${encodeURIComponent(id)}`;
+
+  function follow(panel, id) {
+    const set = (name, value) => {
+      panel.querySelectorAll(`[data-field="${name}"]`).forEach((el) => {
+        el.textContent = value;
+      });
+    };
+    const bar = panel.querySelector("[data-job-bar]");
+    const log = panel.querySelector("[data-job-log]");
+    const logCard = panel.querySelector("[data-job-log-card]");
+
+    const source = new EventSource(`/api/v1/jobs/${encodeURIComponent(id)}/events`);
+    source.addEventListener("open", () => {
+      log?.replaceChildren(); // The rows rejected so far are sent again on every connection
+    });
+    source.addEventListener("progress", (event) => {
+      const job = JSON.parse(event.data);
+      set("status", job.status);
+      set("phase", job.status === "queued" ? "Waiting for a free worker" : job.phase);
+      set("rowsRead", job.rowsRead);
+      set("rowsTotal", job.rowsTotal ? `of ${job.rowsTotal}` : "");
+      set("rowsLoaded", job.rowsLoaded);
+      set("rowsRejected", job.rowsRejected);
+      set("batch", job.batch);
+      set("rate", Math.round(job.rowsPerSecond));
+      if (job.startedAt) {
+        set("elapsed", `${((Date.now() - Date.parse(job.startedAt)) / 1000).toFixed(1)}s`);
+      }
+      if (bar && job.rowsTotal) {
+        bar.max = job.rowsTotal;
+        bar.value = Math.min(job.rowsRead, job.rowsTotal);
+      }
+    });
+    source.addEventListener("warning", (event) => {
+      if (!log) {
+        return;
+      }
+      const rowErr = JSON.parse(event.data);
+      const row = log.insertRow();
+      for (const value of [rowErr.row, rowErr.column, rowErr.value, rowErr.reason]) {
+        const cell = row.insertCell();
+        cell.className = "font-mono text-xs";
+        cell.textContent = value ?? "";
+      }
+      logCard?.classList.remove("hidden");
+    });
+    source.addEventListener("done", () => {
+      source.close();
+      window.location.assign(jobPage(id));
+    });
+    source.addEventListener("error", () => {
+      // A dropped connection is retried by the browser; a refused one is explained by the status page
+      if (source.readyState === EventSource.CLOSED) {
+        window.location.assign(jobPage(id));
+      }
+    });
+  }
+
+  async function submitInBackground(event) {
+    const form = event.currentTarget;
+    const panel = document.getElementById(form.dataset.jobForm);
+    if (!panel) {
+      return;
+    }
+    event.preventDefault();
+    form.querySelectorAll("button").forEach((button) => {
+      button.disabled = true;
+    });
+
+    let response;
+    try {
+      response = await fetch(form.action, {
+        method: "POST",
+        headers: { Accept: "application/json" },
+        body: new URLSearchParams(new FormData(form, event.submitter)),
+      });
+    } catch {
+      // Leave the next submission to the browser, which reports why the server cannot be reached
+      form.removeEventListener("submit", submitInBackground);
+      form.querySelectorAll("button").forEach((button) => {
+        button.disabled = false;
+      });
+      return;
+    }
+    if (response.status === 202) {
+      const job = await response.json();
+      panel.classList.remove("hidden");
+      panel.scrollIntoView({ behavior: "smooth" });
+      follow(panel, job.id);
+      return;
+    }
+    if (response.redirected) {
+      window.location.assign(response.url); // Sent back with an error message
+      return;
+    }
+    document.open();
+    document.write(await response.text());
+    document.close();
+  }
+
+  document.querySelectorAll("[data-job]").forEach((panel) => {
+    if (panel.dataset.job) {
+      follow(panel, panel.dataset.job);
+    }
+  });
+  document.querySelectorAll("[data-job-form]").forEach((form) => {
+    form.addEventListener("submit", submitInBackground);
+  });
+})();